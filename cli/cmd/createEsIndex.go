@@ -62,6 +62,8 @@ var createEsIndexCmd = &cobra.Command{
 			fmt.Fprintln(os.Stderr, "field names not found")
 			os.Exit(-1)
 		}
+		fatal(buildEnrichers())
+		fieldsNames = enrichedNames(setupParser(new(parser.FileParser)).SetFieldNames(fieldsNames))
 
 		opts := newEsOpts(shards, replicas, check, time.Duration(refreshInterval)*time.Second, fieldsNames, excludes)
 		optionsBody, err := json.Marshal(opts)
@@ -135,6 +137,10 @@ func init() {
 	createEsIndexCmd.Flags().StringVar(&username, "username", "", "username for HTTP Basic Auth")
 	createEsIndexCmd.Flags().StringVar(&password, "password", "", "password for HTTP Basic Auth")
 	createEsIndexCmd.Flags().StringArrayVar(&excludedFields, "exclude", []string{}, "exclude that field from collection (can be repeated)")
+	createEsIndexCmd.Flags().BoolVar(&groupHeaders, "headers", false, "group the HTTP header fields into request.headers and response.headers objects")
+	addMapFlags(createEsIndexCmd)
+	addEnrichFlags(createEsIndexCmd)
+	createEsIndexCmd.Flags().BoolVar(&flattenedMaps, "flattened", false, "map the headers, cookies and query fields with the flattened type (Elasticsearch >= 7.3)")
 }
 
 type ESLogger struct {
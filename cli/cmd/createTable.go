@@ -23,6 +23,7 @@ func pgKey(key string) string {
 	key = strings.Replace(key, "-", "_", -1)
 	key = strings.Replace(key, "(", "$", -1)
 	key = strings.Replace(key, ")", "$", -1)
+	key = strings.Replace(key, ".", "_", -1)
 	return key
 }
 
@@ -34,8 +35,8 @@ var createTableCmd = &cobra.Command{
 		fieldsLine = strings.TrimSpace(fieldsLine)
 		fname := strings.TrimSpace(filename)
 
-		if len(fieldsLine) == 0 && len(fname) == 0 {
-			fatal(errors.New("Specify fields with --filename or --fields"))
+		if len(fieldsLine) == 0 && len(fname) == 0 && len(typedColumns) == 0 {
+			fatal(errors.New("Specify fields with --filename, --fields or --columns"))
 		}
 		if len(fieldsLine) != 0 && len(fname) != 0 {
 			fatal(errors.New("--fields and --filename options are exclusive"))
@@ -48,6 +49,8 @@ var createTableCmd = &cobra.Command{
 		}
 		if len(fieldsLine) > 0 {
 			fieldsNames = strings.Split(fieldsLine, " ")
+		} else if len(fname) == 0 {
+			fieldsNames = typedColumns
 		} else {
 			f, err := os.Open(fname)
 			fatal(err)
@@ -60,6 +63,8 @@ var createTableCmd = &cobra.Command{
 		if len(fieldsNames) == 0 {
 			fatal(errors.New("field names not found"))
 		}
+		fatal(buildEnrichers())
+		fieldsNames = enrichedNames(setupParser(new(parser.FileParser)).SetFieldNames(fieldsNames))
 		hasGMT := false
 		for _, name := range fieldsNames {
 			if name == "gmttime" {
@@ -71,6 +76,11 @@ var createTableCmd = &cobra.Command{
 			fieldsNames = append([]string{"gmttime"}, fieldsNames...)
 		}
 		fieldsNames = append([]string{"id"}, fieldsNames...)
+		if len(typedColumns) > 0 {
+			// the other fields are stored in the extra column
+			fieldsNames, _ = splitColumns(fieldsNames)
+			fieldsNames = append(fieldsNames, extraColumn)
+		}
 
 		excludes := make(map[string]bool)
 		for _, fName := range excludedFields {
@@ -78,7 +88,6 @@ var createTableCmd = &cobra.Command{
 		}
 		excludes["date"] = true
 		excludes["time"] = true
-		// todo: parse user agent
 
 		createStmt := ""
 		if len(parentPartitionKey) == 0 {
@@ -144,32 +153,7 @@ func buildCreateStmt(tName string, fNames []string, excludes map[string]bool, pK
 			columns["id"] = "UUID"
 			continue
 		}
-		if fName == "gmttime" {
-			columns["gmttime"] = "TIMESTAMP WITH TIME ZONE NULL"
-			continue
-		}
-		switch parser.GuessType(fName) {
-		case parser.MyDate:
-			columns[pgKey(fName)] = "DATE NULL"
-		case parser.MyIP:
-			columns[pgKey(fName)] = "INET NULL"
-		case parser.MyTime:
-			columns[pgKey(fName)] = "TIME NULL"
-		case parser.MyTimestamp:
-			columns[pgKey(fName)] = "TIMESTAMP WITH TIME ZONE NULL"
-		case parser.MyURI:
-			columns[pgKey(fName)] = "TEXT DEFAULT '' NOT NULL"
-		case parser.Float64:
-			columns[pgKey(fName)] = "DOUBLE PRECISION NULL"
-		case parser.Int64:
-			columns[pgKey(fName)] = "BIGINT NULL"
-		case parser.Bool:
-			columns[pgKey(fName)] = "BOOLEAN NULL"
-		case parser.String:
-			columns[pgKey(fName)] = "TEXT DEFAULT '' NOT NULL"
-		default:
-			columns[pgKey(fName)] = "TEXT DEFAULT '' NOT NULL"
-		}
+		columns[pgKey(fName)] = pgColumnType(fName)
 	}
 
 	createStmt := "CREATE TABLE %s (\n"
@@ -190,6 +174,44 @@ func buildCreateStmt(tName string, fNames []string, excludes map[string]bool, pK
 	return fmt.Sprintf(createStmt, tName)
 }
 
+// pgColumnType returns the type of the column that stores a field.
+func pgColumnType(fName string) string {
+	if fName == "gmttime" {
+		return "TIMESTAMP WITH TIME ZONE NULL"
+	}
+	if fName == extraColumn {
+		return "JSONB NULL"
+	}
+	switch guessType(fName) {
+	case parser.MyDate:
+		return "DATE NULL"
+	case parser.MyIP:
+		return "INET NULL"
+	case parser.MyIPList:
+		return "INET[] NULL"
+	case parser.MyTime:
+		return "TIME NULL"
+	case parser.MyTimestamp:
+		return "TIMESTAMP WITH TIME ZONE NULL"
+	case parser.MyURI:
+		return "TEXT DEFAULT '' NOT NULL"
+	case parser.Float64:
+		return "DOUBLE PRECISION NULL"
+	case parser.Int64:
+		return "BIGINT NULL"
+	case parser.Bool:
+		return "BOOLEAN NULL"
+	case parser.Map:
+		return "JSONB NULL"
+	case parser.MyGeoPoint:
+		return "POINT NULL"
+	case parser.String:
+		return "TEXT DEFAULT '' NOT NULL"
+	default:
+		return "TEXT DEFAULT '' NOT NULL"
+	}
+}
+
 func buildIndexStmt(tName string, fName string, excludes map[string]bool, isChild bool, nofulltext bool) string {
 	if excludes[strings.ToLower(fName)] {
 		return ""
@@ -197,7 +219,8 @@ func buildIndexStmt(tName string, fName string, excludes map[string]bool, isChil
 	if fName == "id" {
 		// primary key
 		if isChild {
-			return fmt.Sprintf("CREATE INDEX %s_%s_idx ON %s (%s);", tName, pgKey(fName), tName, pgKey(fName))
+			// unique, so that the deterministic IDs are not inserted twice
+			return fmt.Sprintf("CREATE UNIQUE INDEX %s_%s_idx ON %s (%s);", tName, pgKey(fName), tName, pgKey(fName))
 		}
 		return ""
 	}
@@ -205,6 +228,9 @@ func buildIndexStmt(tName string, fName string, excludes map[string]bool, isChil
 		// fields too large for a BTREE index
 		return ""
 	}
+	if fName == extraColumn {
+		return fmt.Sprintf("CREATE INDEX %s_%s_idx ON %s USING GIN (%s);", tName, fName, tName, fName)
+	}
 	if fName == "cs(user-agent)" {
 		if nofulltext {
 			return fmt.Sprintf("CREATE INDEX %s_%s_idx ON %s (%s);", tName, pgKey(fName), tName, pgKey(fName))
@@ -217,7 +243,7 @@ func buildIndexStmt(tName string, fName string, excludes map[string]bool, isChil
 		)
 	}
 
-	switch parser.GuessType(fName) {
+	switch guessType(fName) {
 	case parser.MyDate, parser.MyTime, parser.MyTimestamp:
 		return fmt.Sprintf("CREATE INDEX %s_%s_idx ON %s (%s);", tName, pgKey(fName), tName, pgKey(fName))
 
@@ -229,6 +255,12 @@ func buildIndexStmt(tName string, fName string, excludes map[string]bool, isChil
 
 	case parser.String, parser.MyURI:
 		return fmt.Sprintf("CREATE INDEX %s_%s_idx ON %s (%s);", tName, pgKey(fName), tName, pgKey(fName))
+
+	case parser.Map, parser.MyIPList:
+		return fmt.Sprintf("CREATE INDEX %s_%s_idx ON %s USING GIN (%s);", tName, pgKey(fName), tName, pgKey(fName))
+
+	case parser.MyGeoPoint:
+		return fmt.Sprintf("CREATE INDEX %s_%s_idx ON %s USING GIST (%s);", tName, pgKey(fName), tName, pgKey(fName))
 	default:
 		return ""
 	}
@@ -247,4 +279,8 @@ func init() {
 	createTableCmd.Flags().StringVar(&rangeStart, "start", "", "range start for the child partition")
 	createTableCmd.Flags().StringVar(&rangeEnd, "end", "", "range end for the child partition")
 	createTableCmd.Flags().StringArrayVar(&excludedFields, "exclude", []string{}, "exclude that field from collection (can be repeated)")
+	createTableCmd.Flags().BoolVar(&groupHeaders, "headers", false, "group the HTTP header fields into JSONB request_headers and response_headers columns")
+	addColumnsFlag(createTableCmd)
+	addMapFlags(createTableCmd)
+	addEnrichFlags(createTableCmd)
 }
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var deadLetterFile string
+
+// deadLetters receives the rows that could not be uploaded. It is nil when
+// --dead-letter is not set.
+var deadLetters *deadLetter
+
+func addDeadLetterFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&deadLetterFile, "dead-letter", "", "append the rows rejected by the database, or with values that do not match their column, to that NDJSON file")
+}
+
+// deadRecord describes a rejected row.
+type deadRecord struct {
+	Source string `json:"source"`
+	// Line is the number of the line in the source file.
+	Line int `json:"line"`
+	// Offset is the byte offset of the line in the source file.
+	Offset int64                  `json:"offset"`
+	Error  string                 `json:"error"`
+	Fields map[string]interface{} `json:"fields"`
+	Time   time.Time              `json:"time"`
+}
+
+// deadLetter appends the rejected rows to a NDJSON file.
+type deadLetter struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// openDeadLetter opens the dead-letter file when --dead-letter is set.
+func openDeadLetter() error {
+	if deadLetterFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(deadLetterFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	deadLetters = &deadLetter{f: f, enc: json.NewEncoder(f)}
+	return nil
+}
+
+func closeDeadLetter() {
+	if deadLetters != nil {
+		deadLetters.f.Close()
+	}
+}
+
+func (d *deadLetter) write(records []deadRecord) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, rec := range records {
+		err := d.enc.Encode(rec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deadValue returns a value of a row, as it is printed in the dead-letter
+// file.
+func deadValue(v interface{}) interface{} {
+	valuer, ok := v.(driver.Valuer)
+	if !ok {
+		return v
+	}
+	dv, err := valuer.Value()
+	if err != nil {
+		return nil
+	}
+	if b, ok := dv.([]byte); ok {
+		return string(b)
+	}
+	return dv
+}
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+var decryptKeyFile string
+var decryptFields []string
+
+var decryptCmd = &cobra.Command{
+	Use:   "decrypt",
+	Short: "Decrypt the encrypted fields of exported JSON or CSV logs",
+	Run: func(cmd *cobra.Command, args []string) {
+		if decryptKeyFile == "" {
+			fatal(errors.New("specify the keyfile"))
+		}
+		keys, err := loadKeyring(decryptKeyFile)
+		fatal(err)
+		if len(filenames) == 0 {
+			fatal(decryptStream(keys, os.Stdin, os.Stdout, csvExport))
+			return
+		}
+		for _, fname := range filenames {
+			fname = strings.TrimSpace(fname)
+			f, err := os.Open(fname)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error opening '%s': %s\n", fname, err)
+				continue
+			}
+			err = decryptStream(keys, f, os.Stdout, csvExport)
+			f.Close()
+			fatal(err)
+		}
+	},
+}
+
+// decryptStream copies the exported logs from in to out, decrypting the
+// encrypted values. The selected fields are compared to the names of the
+// exported fields once sanitized, as the CSV headers are.
+func decryptStream(keys *keyring, in io.Reader, out io.Writer, isCSV bool) error {
+	selected := toSet(foreach(decryptFields, sanitize))
+	keep := func(name string) bool {
+		return len(selected) == 0 || selected[strings.ToLower(sanitize(name))]
+	}
+	if isCSV {
+		return decryptCSV(keys, in, out, keep)
+	}
+	return decryptJSON(keys, in, out, keep)
+}
+
+func decryptCSV(keys *keyring, in io.Reader, out io.Writer, keep func(string) bool) error {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	w := csv.NewWriter(out)
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	names := toSet(foreach(header, sanitize))
+	for _, field := range decryptFields {
+		if !names[strings.ToLower(sanitize(strings.TrimSpace(field)))] {
+			return fmt.Errorf("field '%s' is not in the CSV header", field)
+		}
+	}
+	err = w.Write(header)
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for i, value := range record {
+			if i >= len(header) {
+				record[i], err = keys.decrypt(value)
+			} else if isHeaderGroup(header[i]) && strings.HasPrefix(value, "{") {
+				record[i], err = decryptHeaders(keys, value, keep(header[i]))
+			} else if keep(header[i]) || strings.HasPrefix(value, escPrefix) {
+				record[i], err = keys.decrypt(value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		err = w.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func decryptJSON(keys *keyring, in io.Reader, out io.Writer, keep func(string) bool) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.UseNumber()
+		fields := make(map[string]interface{})
+		err := dec.Decode(&fields)
+		if err != nil {
+			return err
+		}
+		for name, value := range fields {
+			if h, ok := value.(map[string]interface{}); ok && isHeaderGroup(name) {
+				err = decryptMap(keys, h, keep(name))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			s, ok := value.(string)
+			if !ok || !strings.HasPrefix(s, encPrefix) {
+				continue
+			}
+			if !keep(name) && !strings.HasPrefix(s, escPrefix) {
+				continue
+			}
+			plaintext, err := keys.decrypt(s)
+			if err != nil {
+				return err
+			}
+			// the encrypted maps are restored as JSON objects
+			if strings.HasPrefix(plaintext, "{") && json.Valid([]byte(plaintext)) {
+				fields[name] = json.RawMessage(plaintext)
+			} else {
+				fields[name] = plaintext
+			}
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(b))
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// isHeaderGroup returns true for the names of the header groups, like
+// request.headers, whose values are the encrypted header fields.
+func isHeaderGroup(name string) bool {
+	return name == parser.RequestHeaders || name == parser.ResponseHeaders ||
+		name == sanitize(parser.RequestHeaders) || name == sanitize(parser.ResponseHeaders)
+}
+
+// decryptMap decrypts the values of a header group in place. The escaped
+// values are unescaped even if the group is not selected.
+func decryptMap(keys *keyring, h map[string]interface{}, selected bool) (err error) {
+	for k, v := range h {
+		s, ok := v.(string)
+		if !ok || !(selected || strings.HasPrefix(s, escPrefix)) {
+			continue
+		}
+		h[k], err = keys.decrypt(s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptHeaders decrypts the values of a header group exported as a JSON
+// object in a CSV column.
+func decryptHeaders(keys *keyring, value string, selected bool) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	h := make(map[string]interface{})
+	if err := dec.Decode(&h); err != nil {
+		// not an exported header group
+		if selected {
+			return keys.decrypt(value)
+		}
+		return value, nil
+	}
+	err := decryptMap(keys, h, selected)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func init() {
+	rootCmd.AddCommand(decryptCmd)
+	decryptCmd.Flags().StringVar(&decryptKeyFile, "keyfile", "", "file that holds the encryption keys")
+	decryptCmd.Flags().StringArrayVar(&filenames, "filename", []string{}, "the files to decrypt (default: stdin)")
+	decryptCmd.Flags().BoolVar(&csvExport, "csv", false, "the logs are CSV instead of JSON")
+	decryptCmd.Flags().StringArrayVar(&decryptFields, "field", []string{}, "only decrypt that field (can be repeated)")
+}
@@ -0,0 +1,373 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var deriveConfig string
+
+func addDeriveFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&deriveConfig, "derive-config", "", "YAML file that declares the fields derived from regex captures and templates")
+}
+
+// deriveRuleConfig declares derived fields in the configuration file. A rule
+// either extracts the named capture groups of Regex from the From field, or
+// builds the Name field from a Template where {field} is replaced by the value
+// of field.
+//
+//	fields:
+//	  - from: cs-uri-stem
+//	    regex: '^/api/(?P<version>v\d+)/tenants/(?P<tenant>\d+)'
+//	    prefix: api.
+//	    types:
+//	      tenant: int
+//	  - name: url
+//	    template: 'https://{cs-host}{cs-uri-stem}'
+type deriveRuleConfig struct {
+	From     string            `yaml:"from"`
+	Regex    string            `yaml:"regex"`
+	Prefix   string            `yaml:"prefix"`
+	Types    map[string]string `yaml:"types"`
+	Name     string            `yaml:"name"`
+	Template string            `yaml:"template"`
+	Type     string            `yaml:"type"`
+}
+
+type deriveConfigFile struct {
+	Fields []deriveRuleConfig `yaml:"fields"`
+}
+
+// deriveRule is a compiled deriveRuleConfig.
+type deriveRule struct {
+	from     string
+	re       *regexp.Regexp
+	groups   []string
+	template []templatePart
+	sources  []string
+	// names stores the added field names, in the order of the capture groups
+	names []string
+	kinds map[string]parser.Kind
+}
+
+// templatePart is a literal string, or a field reference.
+type templatePart struct {
+	literal string
+	field   string
+}
+
+var placeholderRe = regexp.MustCompile(`\{([^{}]+)\}`)
+
+func parseTemplate(template string) (parts []templatePart, fields []string) {
+	last := 0
+	for _, loc := range placeholderRe.FindAllStringSubmatchIndex(template, -1) {
+		if loc[0] > last {
+			parts = append(parts, templatePart{literal: template[last:loc[0]]})
+		}
+		field := strings.ToLower(strings.TrimSpace(template[loc[2]:loc[3]]))
+		parts = append(parts, templatePart{field: field})
+		fields = append(fields, field)
+		last = loc[1]
+	}
+	if last < len(template) {
+		parts = append(parts, templatePart{literal: template[last:]})
+	}
+	return parts, fields
+}
+
+// castKind returns the data type of a cast.
+func castKind(typ string) (parser.Kind, error) {
+	switch strings.ToLower(typ) {
+	case "", "string", "str":
+		return parser.String, nil
+	case "int", "integer":
+		return parser.Int64, nil
+	case "float", "double":
+		return parser.Float64, nil
+	case "bool", "boolean":
+		return parser.Bool, nil
+	case "ip":
+		return parser.MyIP, nil
+	default:
+		return parser.Invalid, fmt.Errorf("unknown type: '%s' (expected string, int, float, bool or ip)", typ)
+	}
+}
+
+// cast converts s to the given data type. It returns nil if s is empty or
+// cannot be converted.
+func cast(kind parser.Kind, s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	switch kind {
+	case parser.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil
+		}
+		return i
+	case parser.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil
+		}
+		return f
+	case parser.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil
+		}
+		return b
+	case parser.MyIP:
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil
+		}
+		return ip
+	default:
+		return s
+	}
+}
+
+func loadDeriveRules(fname string) ([]*deriveRule, error) {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var config deriveConfigFile
+	err = yaml.Unmarshal(content, &config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	rules := make([]*deriveRule, 0, len(config.Fields))
+	for i, c := range config.Fields {
+		rule, err := compileDeriveRule(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %s", fname, i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func compileDeriveRule(c deriveRuleConfig) (rule *deriveRule, err error) {
+	rule = &deriveRule{kinds: make(map[string]parser.Kind)}
+	switch {
+	case c.Regex != "" && c.Template != "":
+		return nil, errors.New("a rule has either a regex or a template")
+	case c.Regex != "":
+		if c.From == "" {
+			return nil, errors.New("a regex rule needs the field to extract from")
+		}
+		rule.from = strings.ToLower(c.From)
+		rule.sources = []string{rule.from}
+		rule.re, err = regexp.Compile(c.Regex)
+		if err != nil {
+			return nil, err
+		}
+		rule.groups = rule.re.SubexpNames()
+		for _, group := range rule.groups[1:] {
+			if group == "" {
+				continue
+			}
+			name := c.Prefix + group
+			kind, err := castKind(c.Types[group])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", group, err)
+			}
+			rule.names = append(rule.names, name)
+			rule.kinds[name] = kind
+		}
+		if len(rule.names) == 0 {
+			return nil, errors.New("the regex has no named capture group")
+		}
+		for group := range c.Types {
+			if _, ok := rule.kinds[c.Prefix+group]; !ok {
+				return nil, fmt.Errorf("no capture group named '%s'", group)
+			}
+		}
+	case c.Template != "":
+		if c.Name == "" {
+			return nil, errors.New("a template rule needs the name of the field")
+		}
+		rule.template, rule.sources = parseTemplate(c.Template)
+		if len(rule.sources) == 0 {
+			return nil, errors.New("the template does not use any field")
+		}
+		kind, err := castKind(c.Type)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(c.Name)
+		rule.names = []string{name}
+		rule.kinds[name] = kind
+	default:
+		return nil, errors.New("a rule needs a regex or a template")
+	}
+	return rule, nil
+}
+
+// computedFields are the fields that the lines compute from other fields.
+var computedFields = map[string]bool{
+	"gmttime":              true,
+	parser.RequestHeaders:  true,
+	parser.ResponseHeaders: true,
+}
+
+// applies returns true if names contain a source field of the rule.
+func (r *deriveRule) applies(names []string) bool {
+	for _, source := range r.sources {
+		if computedFields[source] {
+			return true
+		}
+		for _, name := range names {
+			if name == source {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// appliesTo returns true if the line has a source field of the rule.
+func (r *deriveRule) appliesTo(l *parser.Line) bool {
+	for _, source := range r.sources {
+		if l.Has(source) || (computedFields[source] && l.Get(source) != nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldString returns the value of a field of the line as a string, formatted
+// as in the JSON export.
+func fieldString(l *parser.Line, name string) string {
+	switch v := l.Get(name).(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format(time.RFC3339Nano)
+	case []net.IP:
+		ips := make([]string, 0, len(v))
+		for _, ip := range v {
+			if ip == nil {
+				ips = append(ips, "-")
+			} else {
+				ips = append(ips, ip.String())
+			}
+		}
+		return strings.Join(ips, ",")
+	case map[string]interface{}, map[string]string, map[string][]string:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (r *deriveRule) apply(l *parser.Line) {
+	if r.re != nil {
+		var match []string
+		if r.appliesTo(l) {
+			match = r.re.FindStringSubmatch(fieldString(l, r.from))
+		}
+		i := 0
+		for j, group := range r.groups[1:] {
+			if group == "" {
+				continue
+			}
+			name := r.names[i]
+			i++
+			if match == nil {
+				l.Set(name, nil)
+				continue
+			}
+			l.Set(name, cast(r.kinds[name], match[j+1]))
+		}
+		return
+	}
+	var b strings.Builder
+	for _, part := range r.template {
+		if part.field == "" {
+			b.WriteString(part.literal)
+		} else {
+			b.WriteString(fieldString(l, part.field))
+		}
+	}
+	l.Set(r.names[0], cast(r.kinds[r.names[0]], b.String()))
+}
+
+// deriveEnricher adds the fields declared in the derive configuration file.
+// The rules are applied in order, so that a rule can use the fields derived
+// by the previous ones.
+type deriveEnricher struct {
+	rules []*deriveRule
+}
+
+func newDeriveEnricher(fname string) (*deriveEnricher, error) {
+	rules, err := loadDeriveRules(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &deriveEnricher{rules: rules}, nil
+}
+
+// Fields returns the derived fields. A derived field that has the name of an
+// existing field replaces its value, and is not added again.
+func (e *deriveEnricher) Fields(names []string) (added []string, removed []string) {
+	available := append([]string(nil), names...)
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+	}
+	for _, rule := range e.rules {
+		if !rule.applies(available) {
+			continue
+		}
+		for _, name := range rule.names {
+			if !seen[name] {
+				seen[name] = true
+				added = append(added, name)
+				available = append(available, name)
+			}
+		}
+	}
+	return added, nil
+}
+
+func (e *deriveEnricher) Kind(name string) (parser.Kind, bool) {
+	for i := len(e.rules) - 1; i >= 0; i-- {
+		if k, ok := e.rules[i].kinds[name]; ok {
+			return k, true
+		}
+	}
+	return parser.Invalid, false
+}
+
+func (e *deriveEnricher) Process(l *parser.Line) (bool, error) {
+	for _, rule := range e.rules {
+		if rule.appliesTo(l) {
+			rule.apply(l)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+var encryptFields []string
+var encryptKeyFile string
+var encryptKeyID string
+
+func addEncryptFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&encryptFields, "encrypt", []string{}, "field to encrypt with AES-GCM (can be repeated)")
+	cmd.Flags().StringVar(&encryptKeyFile, "encrypt-keyfile", "", "file that holds the encryption keys, one 'id:base64 key' per line")
+	cmd.Flags().StringVar(&encryptKeyID, "encrypt-key-id", "", "ID of the key used to encrypt (default: the last key of the keyfile)")
+}
+
+// encPrefix starts the encrypted values: enc:<key id>:<base64 nonce and
+// ciphertext>.
+const encPrefix = "enc:"
+
+// escPrefix starts the plaintext values that would look encrypted: the
+// value enc:x is exported as enc::enc:x. The key IDs are never empty.
+const escPrefix = encPrefix + ":"
+
+// keyring stores the AES-GCM ciphers of a keyfile, indexed by key ID.
+type keyring struct {
+	ciphers map[string]cipher.AEAD
+	last    string
+}
+
+// loadKeyring reads a keyfile. Each line gives a key ID and a base64 encoded
+// AES key of 16, 24 or 32 bytes, separated by a colon. The empty lines and
+// the lines starting with # are ignored.
+func loadKeyring(fname string) (*keyring, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	k := &keyring{ciphers: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected 'id:base64 key'", fname, lineno)
+		}
+		id := strings.TrimSpace(kv[0])
+		if _, ok := k.ciphers[id]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key ID '%s'", fname, lineno, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fname, lineno, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", fname, lineno, err)
+		}
+		k.ciphers[id], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.last = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.ciphers) == 0 {
+		return nil, fmt.Errorf("no key found in '%s'", fname)
+	}
+	return k, nil
+}
+
+func (k *keyring) encrypt(id string, plaintext string) (string, error) {
+	aead := k.ciphers[id]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encPrefix + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt returns the plaintext of an encrypted value. The escaped values
+// are unescaped, and the values that are not encrypted are returned as is.
+func (k *keyring) decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encPrefix) {
+		return value, nil
+	}
+	if strings.HasPrefix(value, escPrefix) {
+		return value[len(escPrefix):], nil
+	}
+	parts := strings.SplitN(value[len(encPrefix):], ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("invalid encrypted value")
+	}
+	aead, ok := k.ciphers[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown key ID: '%s'", parts[0])
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted value")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("decryption failed with key '%s': %s", parts[0], err)
+	}
+	return string(plaintext), nil
+}
+
+// encryptStage replaces the values of the selected fields with their
+// encrypted form. The encrypted fields become strings. Like the privacy
+// transformations, encrypting a header group encrypts its header fields, and
+// the fields derived from an encrypted field are encrypted too.
+type encryptStage struct {
+	names map[string]bool
+	keys  *keyring
+	keyID string
+}
+
+func newEncryptStage(fields []string, keyFile string, keyID string) (*encryptStage, error) {
+	if keyFile == "" {
+		return nil, errors.New("encryption needs keys: specify --encrypt-keyfile")
+	}
+	keys, err := loadKeyring(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if keyID == "" {
+		keyID = keys.last
+	}
+	if _, ok := keys.ciphers[keyID]; !ok {
+		return nil, fmt.Errorf("key ID '%s' not found in '%s'", keyID, keyFile)
+	}
+	return &encryptStage{names: toSet(fields), keys: keys, keyID: keyID}, nil
+}
+
+func (s *encryptStage) Fields(names []string) (added []string, removed []string) {
+	return nil, nil
+}
+
+func (s *encryptStage) Kind(name string) (parser.Kind, bool) {
+	if name == parser.RequestHeaders || name == parser.ResponseHeaders {
+		// the header fields are encrypted, the group stays a map
+		return parser.Invalid, false
+	}
+	if s.encrypted(name) || s.names[parser.HeaderGroup(name)] {
+		return parser.String, true
+	}
+	for source, derived := range privacyDerived {
+		if !s.encrypted(source) {
+			continue
+		}
+		for _, d := range derived {
+			if d == name {
+				return parser.String, true
+			}
+		}
+	}
+	return parser.Invalid, false
+}
+
+// encrypted returns true if the given field is selected, directly or through
+// its header group.
+func (s *encryptStage) encrypted(name string) bool {
+	return s.names[name] || s.names[parser.HeaderGroup(name)]
+}
+
+func (s *encryptStage) Process(l *parser.Line) (bool, error) {
+	encrypted := targets(l, s.names)
+	selected := toSet(encrypted)
+	// the plaintexts that look encrypted are escaped, including the values of
+	// the header fields that are exported in a header group
+	names := append(l.Names(), l.HeaderFields(parser.RequestHeaders)...)
+	names = append(names, l.HeaderFields(parser.ResponseHeaders)...)
+	for _, name := range names {
+		if selected[name] {
+			continue
+		}
+		if v, ok := l.Get(name).(string); ok && strings.HasPrefix(v, encPrefix) {
+			l.Set(name, escPrefix+v)
+			selected[name] = true
+		}
+	}
+	for _, name := range encrypted {
+		var plaintext string
+		switch v := l.Get(name).(type) {
+		case nil:
+			continue
+		case string:
+			if v == "" {
+				continue
+			}
+			plaintext = v
+		case map[string]interface{}, map[string]string, map[string][]string:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return false, err
+			}
+			plaintext = string(b)
+		default:
+			plaintext = l.GetAsString(name)
+		}
+		ciphertext, err := s.keys.encrypt(s.keyID, plaintext)
+		if err != nil {
+			return false, err
+		}
+		l.Set(name, ciphertext)
+	}
+	return true, nil
+}
@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+const encryptTestLog = `#Fields: date time c-ip cs-username cs(user-agent) cs(cookie) cs-uri-query
+2024-03-01 00:00:01 10.0.0.5 enc:alice Mozilla/5.0 sid=abc q=enc:x
+`
+
+const encryptTestKeys = `# test keys
+k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=
+k2:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=
+`
+
+func encryptTestLine(t *testing.T, group bool) *parser.Line {
+	p := parser.NewFileParser(strings.NewReader(encryptTestLog))
+	p.SetCookies(&parser.KeyFilter{}).SetGroupHeaders(group)
+	p.SetTrustedProxies([]*net.IPNet{})
+	err := p.ParseHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := p.Next()
+	if err != nil || l == nil {
+		t.Fatalf("got %v %v", l, err)
+	}
+	return l
+}
+
+func writeTestKeys(t *testing.T) (string, func()) {
+	dir, clean := tempDir(t)
+	keyFile := filepath.Join(dir, "keys")
+	err := ioutil.WriteFile(keyFile, []byte(encryptTestKeys), 0600)
+	if err != nil {
+		clean()
+		t.Fatal(err)
+	}
+	return keyFile, clean
+}
+
+// exportJSON returns the JSON export of a line, decoded.
+func exportJSON(t *testing.T, b []byte) map[string]interface{} {
+	fields := make(map[string]interface{})
+	err := json.Unmarshal(b, &fields)
+	if err != nil {
+		t.Fatalf("%s: %s", b, err)
+	}
+	return fields
+}
+
+func TestKeyring(t *testing.T) {
+	keyFile, clean := writeTestKeys(t)
+	defer clean()
+	keys, err := loadKeyring(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.last != "k2" {
+		t.Errorf("last key: got '%s'", keys.last)
+	}
+	for _, plaintext := range []string{"alice", "enc:alice", "", "{\"a\":1}"} {
+		ciphertext, err := keys.encrypt("k1", plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(ciphertext, "enc:k1:") {
+			t.Errorf("got '%s'", ciphertext)
+		}
+		got, err := keys.decrypt(ciphertext)
+		if err != nil || got != plaintext {
+			t.Errorf("got '%s' %v, want '%s'", got, err, plaintext)
+		}
+	}
+	tests := map[string]string{
+		"alice":        "alice",
+		"enc::enc:bob": "enc:bob",
+		"enc::":        "",
+	}
+	for value, want := range tests {
+		if got, err := keys.decrypt(value); err != nil || got != want {
+			t.Errorf("'%s': got '%s' %v, want '%s'", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"enc:k3:AAAA", "enc:k1", "enc:k1:!!", "enc:k1:AAAA"} {
+		if _, err := keys.decrypt(value); err == nil {
+			t.Errorf("'%s': expected an error", value)
+		}
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	keyFile, clean := writeTestKeys(t)
+	defer clean()
+	keys, err := loadKeyring(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		group     bool
+		fields    []string
+		encrypted []string
+		escaped   []string
+	}{
+		{false, []string{"cs(user-agent)", "c-ip"}, []string{"cs(user-agent)", "c-ip", parser.ClientIP}, []string{"cs-username"}},
+		{false, []string{"cs(cookie)", "cs-username"}, []string{"cs(cookie)", parser.RequestCookies, "cs-username"}, nil},
+		// the header fields of the group are encrypted
+		{true, []string{parser.RequestHeaders}, []string{parser.RequestCookies}, []string{"cs-username"}},
+	}
+	for _, test := range tests {
+		plain, err := json.Marshal(encryptTestLine(t, test.group))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := newEncryptStage(test.fields, keyFile, "k1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := encryptTestLine(t, test.group)
+		keep, err := s.Process(l)
+		if !keep || err != nil {
+			t.Fatalf("got %v %v", keep, err)
+		}
+		b, err := json.Marshal(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported := exportJSON(t, b)
+		for _, name := range test.encrypted {
+			if v, _ := exported[name].(string); !strings.HasPrefix(v, "enc:k1:") {
+				t.Errorf("%v: %s is not encrypted: %v", test.fields, name, exported[name])
+			}
+		}
+		for _, name := range test.escaped {
+			if v, _ := exported[name].(string); !strings.HasPrefix(v, escPrefix) {
+				t.Errorf("%v: %s is not escaped: %v", test.fields, name, exported[name])
+			}
+		}
+		if test.group {
+			headers, _ := exported[parser.RequestHeaders].(map[string]interface{})
+			if len(headers) != 2 {
+				t.Errorf("got headers %v", headers)
+			}
+			for name, v := range headers {
+				if s, _ := v.(string); !strings.HasPrefix(s, "enc:k1:") {
+					t.Errorf("header %s is not encrypted: %v", name, v)
+				}
+			}
+		}
+
+		var out bytes.Buffer
+		err = decryptJSON(keys, bytes.NewReader(b), &out, func(string) bool { return true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := exportJSON(t, out.Bytes()), exportJSON(t, plain); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", test.fields, got, want)
+		}
+	}
+}
+
+func TestEncryptKinds(t *testing.T) {
+	keyFile, clean := writeTestKeys(t)
+	defer clean()
+	s, err := newEncryptStage([]string{"c-ip", parser.RequestHeaders}, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.keyID != "k2" {
+		t.Errorf("got key '%s'", s.keyID)
+	}
+	kinds := map[string]parser.Kind{
+		"c-ip":                parser.String,
+		parser.ClientIP:       parser.String,
+		"cs(user-agent)":      parser.String,
+		parser.RequestCookies: parser.String,
+		parser.RequestHeaders: parser.Invalid,
+		"sc-status":           parser.Invalid,
+	}
+	for name, want := range kinds {
+		if got, _ := s.Kind(name); got != want {
+			t.Errorf("kind of %s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestDecryptCSV(t *testing.T) {
+	keyFile, clean := writeTestKeys(t)
+	defer clean()
+	keys, err := loadKeyring(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newEncryptStage([]string{parser.RequestHeaders}, keyFile, "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := func(l *parser.Line) string {
+		var b bytes.Buffer
+		b.WriteString(strings.Join(foreach(l.Names(), sanitize), ",") + "\n")
+		if err := l.WriteTo(&b, false); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+	plain := export(encryptTestLine(t, true))
+	l := encryptTestLine(t, true)
+	_, err = s.Process(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := export(l)
+	if !strings.Contains(encrypted, "enc:k1:") || !strings.Contains(encrypted, "enc::enc:alice") {
+		t.Errorf("got %s", encrypted)
+	}
+	var out bytes.Buffer
+	err = decryptCSV(keys, strings.NewReader(encrypted), &out, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != plain {
+		t.Errorf("got %s, want %s", out.String(), plain)
+	}
+}
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+// enrichers chains the enrichers selected on the command line. They add
+// derived fields to the parsed log lines.
+var enrichers = parser.NewPipeline()
+
+// outputStages chains the stages that transform the values for the output,
+// like the privacy stage. The filters see the values before these
+// transformations.
+var outputStages = parser.NewPipeline()
+
+func addEnrichFlags(cmd *cobra.Command) {
+	addUAFlags(cmd)
+	addGeoFlags(cmd)
+	addNetTagFlags(cmd)
+	addLookupFlags(cmd)
+	addIISFlags(cmd)
+	addRDNSFlags(cmd)
+	addPrivacyFlags(cmd)
+	addEncryptFlags(cmd)
+	addDeriveFlags(cmd)
+}
+
+// enrichedIPFields returns the IP fields to enrich. The client.ip field is
+// added when it is derived from the trusted proxies.
+func enrichedIPFields(fields []string) []string {
+	if len(trustedProxies) == 0 {
+		return fields
+	}
+	for _, name := range fields {
+		if name == parser.ClientIP {
+			return fields
+		}
+	}
+	return append(fields[:len(fields):len(fields)], parser.ClientIP)
+}
+
+// buildEnrichers builds the enrichers selected on the command line.
+func buildEnrichers() error {
+	closeEnrichers()
+	if parseUA {
+		e, err := newUAEnricher(uaRulesFile, uaCacheSize)
+		if err != nil {
+			return err
+		}
+		enrichers.Append(e)
+	}
+	if geoipDB != "" || asnDB != "" {
+		e, err := newGeoEnricher(geoipDB, asnDB, enrichedIPFields(geoFields), geoLang, geoCacheSize)
+		if err != nil {
+			return err
+		}
+		enrichers.Append(e)
+	}
+	if netTagsFile != "" {
+		e, err := newNetTagEnricher(netTagsFile, enrichedIPFields(netTagFields), netTagDefault)
+		if err != nil {
+			return err
+		}
+		enrichers.Append(e)
+	}
+	if iisConfigFile != "" {
+		e, err := newIISSiteEnricher(iisConfigFile, iisSiteField)
+		if err != nil {
+			return err
+		}
+		enrichers.Append(e)
+	}
+	if len(rdnsFields) > 0 {
+		e, err := newRDNSEnricher(rdnsFields, rdnsResolver, rdnsWorkers, rdnsCacheFile, rdnsTTL, rdnsTimeout)
+		if err != nil {
+			return err
+		}
+		enrichers.Append(e)
+	}
+	for _, spec := range lookupSpecs {
+		e, err := newLookupEnricher(spec, lookupIgnoreCase, !lookupNoReload)
+		if err != nil {
+			return err
+		}
+		enrichers.Append(e)
+	}
+	if deriveConfig != "" {
+		e, err := newDeriveEnricher(deriveConfig)
+		if err != nil {
+			return err
+		}
+		enrichers.Append(e)
+	}
+	// the privacy and encryption stages come last, to transform the added
+	// fields too
+	if privacyEnabled() {
+		e, err := newPrivacyStage(truncateFields, truncateIPv4Bits, truncateIPv6Bits, pseudoFields, pseudoKeyFile, redactFields, scrubParams, privacyReport)
+		if err != nil {
+			return err
+		}
+		outputStages.Append(e)
+	}
+	if len(encryptFields) > 0 {
+		e, err := newEncryptStage(encryptFields, encryptKeyFile, encryptKeyID)
+		if err != nil {
+			return err
+		}
+		outputStages.Append(e)
+	}
+	return nil
+}
+
+// closeEnrichers releases the resources held by the enrichers, such as the
+// lookup file watchers, and saves their caches.
+func closeEnrichers() {
+	for _, stages := range []*parser.Pipeline{enrichers, outputStages} {
+		err := stages.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	enrichers = parser.NewPipeline()
+	outputStages = parser.NewPipeline()
+}
+
+// enrichedNames returns the field names of the lines returned by p, once they
+// have been enriched.
+func enrichedNames(p *parser.FileParser) []string {
+	return transformNames(p, parser.NewPipeline(enrichers, outputStages))
+}
+
+// transformNames returns the field names of the lines returned by p, once they
+// have been transformed by stages.
+func transformNames(p *parser.FileParser, stages parser.SchemaTransformer) (names []string) {
+	// the enrichers may use the header fields, even if they are grouped
+	added, removed := stages.Fields(append(p.FieldNames(), p.LineNames()...))
+	removedSet := toSet(removed)
+	for _, name := range p.LineNames() {
+		if !removedSet[name] {
+			names = append(names, name)
+		}
+	}
+	return append(names, added...)
+}
+
+// buildPipeline returns the processors applied to the lines returned by p:
+// the time range selection, the clearing of the cleared fields, the
+// enrichers, the --where filter and the output stages.
+func buildPipeline(p *parser.FileParser, cleared []string) (*parser.Pipeline, error) {
+	pipeline := parser.NewPipeline()
+	if !timeRange.IsZero() {
+		pipeline.Append(timeRange)
+	}
+	if len(cleared) > 0 {
+		pipeline.Append(parser.ProcessorFunc(func(l *parser.Line) (bool, error) {
+			for _, name := range cleared {
+				l.Clear(name)
+			}
+			return true, nil
+		}))
+	}
+	pipeline.Append(enrichers)
+	filter, err := compileWhere(transformNames(p, enrichers))
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		pipeline.Append(filter)
+	}
+	return pipeline.Append(outputStages), nil
+}
+
+// guessType returns the data type of a field, taking into account the fields
+// added by the enrichers.
+func guessType(name string) parser.Kind {
+	if k, ok := outputStages.Kind(name); ok {
+		return k
+	}
+	return enrichers.GuessType(name)
+}
+
+// filterType returns the data type of a field, as seen by the filters.
+func filterType(name string) parser.Kind {
+	return enrichers.GuessType(name)
+}
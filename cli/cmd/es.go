@@ -10,6 +10,8 @@ import (
 	parser "github.com/stephane-martin/w3c-extendedlog-parser"
 )
 
+var flattenedMaps bool
+
 type esOpts struct {
 	S esSettings `json:"settings"`
 	M esMappings `json:"mappings"`
@@ -81,10 +83,10 @@ FLoop:
 			fields[name] = newMulti()
 			continue FLoop
 		}
-		switch parser.GuessType(name) {
+		switch guessType(name) {
 		case parser.MyDate:
 			fields[name] = newDateField()
-		case parser.MyIP:
+		case parser.MyIP, parser.MyIPList:
 			fields[name] = newIPField()
 		case parser.MyTime:
 			fields[name] = newTimeField()
@@ -98,6 +100,14 @@ FLoop:
 			fields[name] = newLongField()
 		case parser.Bool:
 			fields[name] = newBoolField()
+		case parser.MyGeoPoint:
+			fields[name] = newGeoPointField()
+		case parser.Map:
+			if flattenedMaps {
+				fields[name] = newFlattenedField()
+			} else {
+				fields[name] = newObjectField()
+			}
 		case parser.String:
 			fields[name] = newKeyword(true)
 		default:
@@ -245,6 +255,38 @@ func newDatetimeField() datetimeEsField {
 	}
 }
 
+type objectEsField struct {
+	Typ string `json:"type"`
+}
+
+func newObjectField() objectEsField {
+	return objectEsField{
+		Typ: "object",
+	}
+}
+
+type flattenedEsField struct {
+	Typ string `json:"type"`
+}
+
+func newFlattenedField() flattenedEsField {
+	return flattenedEsField{
+		Typ: "flattened",
+	}
+}
+
+type geoPointEsField struct {
+	Typ   string `json:"type"`
+	Store bool   `json:"store"`
+}
+
+func newGeoPointField() geoPointEsField {
+	return geoPointEsField{
+		Typ:   "geo_point",
+		Store: true,
+	}
+}
+
 type longEsField struct {
 	Typ   string `json:"type"`
 	Store bool   `json:"store"`
@@ -62,6 +62,8 @@ var esschemaCmd = &cobra.Command{
 			fmt.Fprintln(os.Stderr, "field names not found")
 			os.Exit(-1)
 		}
+		fatal(buildEnrichers())
+		fieldsNames = enrichedNames(setupParser(new(parser.FileParser)).SetFieldNames(fieldsNames))
 		opts := newEsOpts(shards, replicas, check, time.Duration(refreshInterval)*time.Second, fieldsNames, excludes)
 		b, err := json.MarshalIndent(opts, "", "  ")
 		if err != nil {
@@ -81,4 +83,8 @@ func init() {
 	esschemaCmd.Flags().BoolVar(&check, "check", false, "whether to check the index on startup")
 	esschemaCmd.Flags().IntVar(&refreshInterval, "refresh", 1, "refresh interval in seconds")
 	esschemaCmd.Flags().StringArrayVar(&excludedFields, "exclude", []string{}, "exclude that field from collection (can be repeated)")
+	esschemaCmd.Flags().BoolVar(&groupHeaders, "headers", false, "group the HTTP header fields into request.headers and response.headers objects")
+	addMapFlags(esschemaCmd)
+	addEnrichFlags(esschemaCmd)
+	esschemaCmd.Flags().BoolVar(&flattenedMaps, "flattened", false, "map the headers, cookies and query fields with the flattened type (Elasticsearch >= 7.3)")
 }
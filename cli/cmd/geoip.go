@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"net"
+
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+var geoipDB string
+var asnDB string
+var geoFields []string
+var geoLang string
+var geoCacheSize int
+
+func addGeoFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&geoipDB, "geoip-db", "", "MaxMind DB file (GeoIP2/GeoLite2/DB-IP City or Country) used to add the geo.* fields")
+	cmd.Flags().StringVar(&asnDB, "asn-db", "", "MaxMind DB file (GeoIP2/GeoLite2/DB-IP ASN) used to add the as.* fields")
+	cmd.Flags().StringArrayVar(&geoFields, "geo-field", []string{"c-ip"}, "IP field to geolocate (can be repeated)")
+	cmd.Flags().StringVar(&geoLang, "geo-lang", "en", "language of the country and city names")
+	cmd.Flags().IntVar(&geoCacheSize, "geo-cache", 10000, "number of geolocated IPs to keep in cache")
+}
+
+// geoInfo stores the result of the geolocation of an IP.
+type geoInfo struct {
+	countryCode string
+	country     string
+	region      string
+	city        string
+	location    *parser.GeoPoint
+	asNumber    int64
+	asOrg       string
+}
+
+// geoEnricher adds the geo.<field>.* and as.<field>.* fields for each
+// configured IP field.
+type geoEnricher struct {
+	city     *mmdbReader
+	asn      *mmdbReader
+	ipFields []string
+	lang     string
+	kinds    map[string]parser.Kind
+	cache    *lruCache
+}
+
+func newGeoEnricher(cityFile string, asnFile string, ipFields []string, lang string, cacheSize int) (e *geoEnricher, err error) {
+	e = &geoEnricher{
+		ipFields: ipFields,
+		lang:     lang,
+		kinds:    make(map[string]parser.Kind),
+		cache:    newLRU(cacheSize),
+	}
+	if cityFile != "" {
+		e.city, err = openMMDB(cityFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if asnFile != "" {
+		e.asn, err = openMMDB(asnFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, ipField := range ipFields {
+		for _, name := range e.ipFieldNames(ipField) {
+			e.kinds[name] = parser.String
+		}
+		e.kinds["geo."+ipField+".location"] = parser.MyGeoPoint
+		e.kinds["as."+ipField+".number"] = parser.Int64
+	}
+	return e, nil
+}
+
+// ipFieldNames returns the names of the fields added for the given IP field.
+func (e *geoEnricher) ipFieldNames(ipField string) (names []string) {
+	if e.city != nil {
+		prefix := "geo." + ipField + "."
+		names = append(names, prefix+"country_code", prefix+"country", prefix+"region", prefix+"city", prefix+"location")
+	}
+	if e.asn != nil {
+		prefix := "as." + ipField + "."
+		names = append(names, prefix+"number", prefix+"organization")
+	}
+	return names
+}
+
+func (e *geoEnricher) Fields(names []string) (added []string, removed []string) {
+	for _, ipField := range e.ipFields {
+		for _, name := range names {
+			if name == ipField {
+				added = append(added, e.ipFieldNames(ipField)...)
+				break
+			}
+		}
+	}
+	return added, nil
+}
+
+func (e *geoEnricher) Kind(name string) (parser.Kind, bool) {
+	k, ok := e.kinds[name]
+	return k, ok
+}
+
+func (e *geoEnricher) Process(l *parser.Line) (bool, error) {
+	for _, ipField := range e.ipFields {
+		if !l.Has(ipField) {
+			continue
+		}
+		var info geoInfo
+		if ip, ok := l.Get(ipField).(net.IP); ok {
+			var err error
+			info, err = e.lookup(ip)
+			if err != nil {
+				return false, err
+			}
+		}
+		if e.city != nil {
+			prefix := "geo." + ipField + "."
+			l.Set(prefix+"country_code", nilIfEmpty(info.countryCode))
+			l.Set(prefix+"country", nilIfEmpty(info.country))
+			l.Set(prefix+"region", nilIfEmpty(info.region))
+			l.Set(prefix+"city", nilIfEmpty(info.city))
+			if info.location != nil {
+				l.Set(prefix+"location", *info.location)
+			} else {
+				l.Set(prefix+"location", nil)
+			}
+		}
+		if e.asn != nil {
+			prefix := "as." + ipField + "."
+			if info.asNumber != 0 {
+				l.Set(prefix+"number", info.asNumber)
+			} else {
+				l.Set(prefix+"number", nil)
+			}
+			l.Set(prefix+"organization", nilIfEmpty(info.asOrg))
+		}
+	}
+	return true, nil
+}
+
+func (e *geoEnricher) lookup(ip net.IP) (info geoInfo, err error) {
+	key := ip.String()
+	if cached, ok := e.cache.get(key); ok {
+		return cached.(geoInfo), nil
+	}
+	if e.city != nil {
+		record, err := e.city.lookup(ip)
+		if err != nil {
+			return info, err
+		}
+		info.countryCode, _ = mmdbGet(record, "country", "iso_code").(string)
+		info.country = e.name(record, "country")
+		info.region = e.name(record, "subdivisions", 0)
+		info.city = e.name(record, "city")
+		lat, okLat := mmdbGet(record, "location", "latitude").(float64)
+		lon, okLon := mmdbGet(record, "location", "longitude").(float64)
+		if okLat && okLon {
+			info.location = &parser.GeoPoint{Lat: lat, Lon: lon}
+		}
+	}
+	if e.asn != nil {
+		record, err := e.asn.lookup(ip)
+		if err != nil {
+			return info, err
+		}
+		if n, ok := mmdbGet(record, "autonomous_system_number").(uint64); ok {
+			info.asNumber = int64(n)
+		}
+		info.asOrg, _ = mmdbGet(record, "autonomous_system_organization").(string)
+	}
+	e.cache.add(key, info)
+	return info, nil
+}
+
+// name returns the localized name of a record entity, like a city or a
+// country, falling back to the english name.
+func (e *geoEnricher) name(record interface{}, path ...interface{}) string {
+	names := mmdbGet(record, append(path, "names")...)
+	if name, ok := mmdbGet(names, e.lang).(string); ok {
+		return name
+	}
+	name, _ := mmdbGet(names, "en").(string)
+	return name
+}
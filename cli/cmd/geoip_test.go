@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+func mmdbNames(m map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"names": m}
+}
+
+var geoTestCity = []mmdbNetwork{
+	{"2.0.0.0/8", map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": "FR",
+			"names":    map[string]interface{}{"en": "France", "de": "Frankreich"},
+		},
+		"subdivisions": []interface{}{mmdbNames(map[string]interface{}{"en": "Ile-de-France"})},
+		"city":         mmdbNames(map[string]interface{}{"en": "Paris", "de": "Paris"}),
+		"location":     map[string]interface{}{"latitude": 48.8566, "longitude": 2.3522},
+	}},
+	// a country without a city nor a location
+	{"2001:db8::/32", map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": "DE",
+			"names":    map[string]interface{}{"en": "Germany", "de": "Deutschland"},
+		},
+	}},
+}
+
+var geoTestASN = []mmdbNetwork{
+	{"2.0.0.0/8", map[string]interface{}{
+		"autonomous_system_number":       uint32(3215),
+		"autonomous_system_organization": "Orange",
+	}},
+}
+
+func newTestGeoEnricher(t *testing.T, dir string, lang string) *geoEnricher {
+	city := writeMMDB(t, dir, "city.mmdb", buildMMDB(t, 6, 28, geoTestCity))
+	asn := writeMMDB(t, dir, "asn.mmdb", buildMMDB(t, 6, 24, geoTestASN))
+	e, err := newGeoEnricher(city, asn, []string{"c-ip", "s-ip"}, lang, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestGeoEnricherFields(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	e := newTestGeoEnricher(t, dir, "en")
+	added, removed := e.Fields([]string{"date", "c-ip"})
+	want := []string{
+		"geo.c-ip.country_code", "geo.c-ip.country", "geo.c-ip.region", "geo.c-ip.city", "geo.c-ip.location",
+		"as.c-ip.number", "as.c-ip.organization",
+	}
+	if !reflect.DeepEqual(added, want) || removed != nil {
+		t.Errorf("got %v %v, want %v", added, removed, want)
+	}
+	kinds := map[string]parser.Kind{
+		"geo.c-ip.country":      parser.String,
+		"geo.c-ip.location":     parser.MyGeoPoint,
+		"as.s-ip.number":        parser.Int64,
+		"as.s-ip.organization":  parser.String,
+		"geo.cs-host.country":   parser.Invalid,
+		"geo.c-ip.country_code": parser.String,
+	}
+	for name, want := range kinds {
+		if got, _ := e.Kind(name); got != want {
+			t.Errorf("kind of %s: got %v, want %v", name, got, want)
+		}
+	}
+
+	// without the ASN database, the as.* fields are not added
+	city := writeMMDB(t, dir, "city.mmdb", buildMMDB(t, 6, 28, geoTestCity))
+	e, err := newGeoEnricher(city, "", []string{"c-ip"}, "en", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, _ = e.Fields([]string{"c-ip"})
+	if len(added) != 5 {
+		t.Errorf("got %v", added)
+	}
+}
+
+func TestGeoEnricherProcess(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	tests := []struct {
+		lang string
+		ip   interface{}
+		want map[string]interface{}
+	}{
+		{"en", net.ParseIP("2.3.4.5"), map[string]interface{}{
+			"geo.c-ip.country_code": "FR",
+			"geo.c-ip.country":      "France",
+			"geo.c-ip.region":       "Ile-de-France",
+			"geo.c-ip.city":         "Paris",
+			"geo.c-ip.location":     parser.GeoPoint{Lat: 48.8566, Lon: 2.3522},
+			"as.c-ip.number":        int64(3215),
+			"as.c-ip.organization":  "Orange",
+		}},
+		// the names fall back to english
+		{"de", net.ParseIP("2.3.4.5"), map[string]interface{}{
+			"geo.c-ip.country_code": "FR",
+			"geo.c-ip.country":      "Frankreich",
+			"geo.c-ip.region":       "Ile-de-France",
+			"geo.c-ip.city":         "Paris",
+			"geo.c-ip.location":     parser.GeoPoint{Lat: 48.8566, Lon: 2.3522},
+			"as.c-ip.number":        int64(3215),
+			"as.c-ip.organization":  "Orange",
+		}},
+		{"de", net.ParseIP("2001:db8::1"), map[string]interface{}{
+			"geo.c-ip.country_code": "DE",
+			"geo.c-ip.country":      "Deutschland",
+			"geo.c-ip.region":       nil,
+			"geo.c-ip.city":         nil,
+			"geo.c-ip.location":     nil,
+			"as.c-ip.number":        nil,
+			"as.c-ip.organization":  nil,
+		}},
+		// unknown IPs and missing values
+		{"en", net.ParseIP("192.0.2.1"), nil},
+		{"en", nil, nil},
+		{"en", "not an IP", nil},
+	}
+	for _, test := range tests {
+		e := newTestGeoEnricher(t, dir, test.lang)
+		l := parser.NewLine([]string{"c-ip"})
+		l.Set("c-ip", test.ip)
+		// twice, to use the cache
+		for i := 0; i < 2; i++ {
+			keep, err := e.Process(l)
+			if !keep || err != nil {
+				t.Fatalf("%v: got %v %v", test.ip, keep, err)
+			}
+			added, _ := e.Fields([]string{"c-ip"})
+			for _, name := range added {
+				if !l.Has(name) {
+					t.Errorf("%v: field %s is not set", test.ip, name)
+				}
+				if got := l.Get(name); !reflect.DeepEqual(got, test.want[name]) {
+					t.Errorf("%s %v: %s: got %#v, want %#v", test.lang, test.ip, name, got, test.want[name])
+				}
+			}
+		}
+		// the fields that are not in the line are ignored
+		if l.Has("geo.s-ip.country") {
+			t.Error("s-ip was enriched")
+		}
+	}
+}
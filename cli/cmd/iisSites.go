@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+var iisConfigFile string
+var iisSiteField string
+
+func addIISFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&iisConfigFile, "iis-config", "", "add the site names, bindings and paths from that IIS applicationHost.config file")
+	cmd.Flags().StringVar(&iisSiteField, "iis-site-field", "s-sitename", "field that holds the IIS site identifier (W3SVCn)")
+}
+
+const (
+	siteName     = "site.name"
+	siteBindings = "site.bindings"
+	sitePath     = "site.path"
+)
+
+// iisConfig is the part of applicationHost.config that describes the sites.
+type iisConfig struct {
+	Sites []struct {
+		Name         string `xml:"name,attr"`
+		ID           string `xml:"id,attr"`
+		Applications []struct {
+			Path        string `xml:"path,attr"`
+			Directories []struct {
+				Path         string `xml:"path,attr"`
+				PhysicalPath string `xml:"physicalPath,attr"`
+			} `xml:"virtualDirectory"`
+		} `xml:"application"`
+		Bindings []struct {
+			Protocol    string `xml:"protocol,attr"`
+			Information string `xml:"bindingInformation,attr"`
+		} `xml:"bindings>binding"`
+	} `xml:"system.applicationHost>sites>site"`
+}
+
+type iisSite struct {
+	name     string
+	bindings string
+	path     string
+}
+
+// loadIISSites reads the sites from an applicationHost.config file. The
+// sites are indexed by their log identifier, W3SVC followed by the site ID.
+func loadIISSites(fname string) (map[string]iisSite, error) {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var config iisConfig
+	err = xml.Unmarshal(content, &config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	sites := make(map[string]iisSite, len(config.Sites))
+	for _, s := range config.Sites {
+		id := strings.TrimSpace(s.ID)
+		if id == "" {
+			continue
+		}
+		site := iisSite{name: s.Name}
+		bindings := make([]string, 0, len(s.Bindings))
+		for _, b := range s.Bindings {
+			bindings = append(bindings, b.Protocol+" "+b.Information)
+		}
+		site.bindings = strings.Join(bindings, ", ")
+		// the site path is the physical path of the root application
+		for _, app := range s.Applications {
+			if app.Path != "/" {
+				continue
+			}
+			for _, dir := range app.Directories {
+				if dir.Path == "/" {
+					site.path = dir.PhysicalPath
+				}
+			}
+		}
+		sites["w3svc"+id] = site
+	}
+	if len(sites) == 0 {
+		return nil, fmt.Errorf("no site found in '%s'", fname)
+	}
+	return sites, nil
+}
+
+// iisSiteEnricher adds the name, bindings and physical path of the IIS site
+// that served the request.
+type iisSiteEnricher struct {
+	field string
+	sites map[string]iisSite
+}
+
+func newIISSiteEnricher(fname string, field string) (*iisSiteEnricher, error) {
+	sites, err := loadIISSites(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &iisSiteEnricher{field: strings.ToLower(field), sites: sites}, nil
+}
+
+func (e *iisSiteEnricher) Fields(names []string) (added []string, removed []string) {
+	for _, name := range names {
+		if name == e.field {
+			return []string{siteName, siteBindings, sitePath}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (e *iisSiteEnricher) Kind(name string) (parser.Kind, bool) {
+	switch name {
+	case siteName, siteBindings, sitePath:
+		return parser.String, true
+	default:
+		return parser.Invalid, false
+	}
+}
+
+func (e *iisSiteEnricher) Process(l *parser.Line) (bool, error) {
+	if !l.Has(e.field) {
+		return true, nil
+	}
+	site, ok := e.sites[strings.ToLower(strings.TrimSpace(l.GetAsString(e.field)))]
+	if !ok {
+		l.Set(siteName, nil)
+		l.Set(siteBindings, nil)
+		l.Set(sitePath, nil)
+		return true, nil
+	}
+	l.Set(siteName, nilIfEmpty(site.name))
+	l.Set(siteBindings, nilIfEmpty(site.bindings))
+	l.Set(sitePath, nilIfEmpty(site.path))
+	return true, nil
+}
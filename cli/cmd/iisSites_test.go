@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+const iisTestConfig = `<?xml version="1.0" encoding="UTF-8"?>
+<configuration>
+  <system.applicationHost>
+    <applicationPools>
+      <add name="DefaultAppPool" />
+    </applicationPools>
+    <sites>
+      <site name="Default Web Site" id="1">
+        <application path="/" applicationPool="DefaultAppPool">
+          <virtualDirectory path="/" physicalPath="%SystemDrive%\inetpub\wwwroot" />
+        </application>
+        <bindings>
+          <binding protocol="http" bindingInformation="*:80:" />
+          <binding protocol="https" bindingInformation="*:443:api.example.com" />
+        </bindings>
+      </site>
+      <site name="Intranet" id=" 12 " serverAutoStart="true">
+        <application path="/app" applicationPool="DefaultAppPool">
+          <virtualDirectory path="/" physicalPath="D:\sites\intranet\app" />
+        </application>
+        <application path="/" applicationPool="DefaultAppPool">
+          <virtualDirectory path="/images" physicalPath="E:\images" />
+          <virtualDirectory path="/" physicalPath="D:\sites\intranet" />
+        </application>
+        <bindings>
+          <binding protocol="http" bindingInformation="10.0.0.1:8080:intranet" />
+        </bindings>
+      </site>
+      <site name="No Bindings" id="3" />
+      <site name="No ID" id=" ">
+        <bindings>
+          <binding protocol="http" bindingInformation="*:81:" />
+        </bindings>
+      </site>
+      <siteDefaults>
+        <logFile directory="%SystemDrive%\inetpub\logs\LogFiles" />
+      </siteDefaults>
+    </sites>
+  </system.applicationHost>
+</configuration>
+`
+
+func writeIISConfig(t *testing.T, dir string, content string) string {
+	fname := filepath.Join(dir, "applicationHost.config")
+	err := ioutil.WriteFile(fname, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestLoadIISSites(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	sites, err := loadIISSites(writeIISConfig(t, dir, iisTestConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]iisSite{
+		"w3svc1": {
+			name:     "Default Web Site",
+			bindings: "http *:80:, https *:443:api.example.com",
+			path:     `%SystemDrive%\inetpub\wwwroot`,
+		},
+		// the path of the root directory of the root application
+		"w3svc12": {
+			name:     "Intranet",
+			bindings: "http 10.0.0.1:8080:intranet",
+			path:     `D:\sites\intranet`,
+		},
+		"w3svc3": {name: "No Bindings"},
+	}
+	if !reflect.DeepEqual(sites, want) {
+		t.Errorf("got %+v, want %+v", sites, want)
+	}
+
+	invalid := []string{
+		"<configuration><system.applicationHost><sites></sites></system.applicationHost></configuration>",
+		`<configuration><system.applicationHost><sites><site name="x"/></sites></system.applicationHost></configuration>`,
+		"<configuration><system.applicationHost>",
+		"",
+	}
+	for _, content := range invalid {
+		if _, err := loadIISSites(writeIISConfig(t, dir, content)); err == nil {
+			t.Errorf("'%s': expected an error", content)
+		}
+	}
+	if _, err := loadIISSites(filepath.Join(dir, "missing.config")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestIISSiteEnricher(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	e, err := newIISSiteEnricher(writeIISConfig(t, dir, iisTestConfig), "S-SiteName")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, _ := e.Fields([]string{"date", "s-sitename"}); !reflect.DeepEqual(added, []string{siteName, siteBindings, sitePath}) {
+		t.Errorf("got %v", added)
+	}
+	if added, _ := e.Fields([]string{"date"}); added != nil {
+		t.Errorf("got %v", added)
+	}
+	if kind, ok := e.Kind(sitePath); !ok || kind != parser.String {
+		t.Errorf("got %v %v", kind, ok)
+	}
+
+	tests := []struct {
+		site     interface{}
+		name     interface{}
+		bindings interface{}
+		path     interface{}
+	}{
+		{"W3SVC1", "Default Web Site", "http *:80:, https *:443:api.example.com", `%SystemDrive%\inetpub\wwwroot`},
+		{"w3svc12", "Intranet", "http 10.0.0.1:8080:intranet", `D:\sites\intranet`},
+		// the empty values are absent
+		{"W3SVC3", "No Bindings", nil, nil},
+		{"W3SVC4", nil, nil, nil},
+		{nil, nil, nil, nil},
+	}
+	l := parser.NewLine([]string{"s-sitename"})
+	for _, test := range tests {
+		l.Set("s-sitename", test.site)
+		keep, err := e.Process(l)
+		if !keep || err != nil {
+			t.Fatalf("got %v %v", keep, err)
+		}
+		got := []interface{}{l.Get(siteName), l.Get(siteBindings), l.Get(sitePath)}
+		if want := []interface{}{test.name, test.bindings, test.path}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", test.site, got, want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"net"
+)
+
+// ipTree is a binary radix tree that maps IPv4 and IPv6 networks to labels,
+// and finds the longest prefix match of an IP. IPv4 networks are stored as
+// IPv4-mapped IPv6 networks.
+type ipTree struct {
+	root ipTreeNode
+}
+
+type ipTreeNode struct {
+	children [2]*ipTreeNode
+	label    *string
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i>>3]>>(7-uint(i&7))) & 1
+}
+
+// insert maps the network to the label, replacing the previous label of the
+// same network.
+func (t *ipTree) insert(network *net.IPNet, label string) {
+	ones, bits := network.Mask.Size()
+	if bits == 8*net.IPv4len {
+		// an IPv4 mask: the network is stored as an IPv4-mapped network
+		ones += 8*net.IPv6len - bits
+	}
+	ip := network.IP.To16()
+	if ip == nil || ones > 8*net.IPv6len {
+		return
+	}
+	node := &t.root
+	for i := 0; i < ones; i++ {
+		bit := ipBit(ip, i)
+		if node.children[bit] == nil {
+			node.children[bit] = new(ipTreeNode)
+		}
+		node = node.children[bit]
+	}
+	node.label = &label
+}
+
+// lookup returns the label of the most specific network that contains ip.
+func (t *ipTree) lookup(ip net.IP) (label string, found bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return "", false
+	}
+	node := &t.root
+	for i := 0; node != nil; i++ {
+		if node.label != nil {
+			label, found = *node.label, true
+		}
+		if i == 128 {
+			break
+		}
+		node = node.children[ipBit(ip, i)]
+	}
+	return label, found
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPTreeLookup(t *testing.T) {
+	networks := []struct {
+		cidr  string
+		label string
+	}{
+		{"10.0.0.0/8", "10/8"},
+		{"10.1.0.0/16", "10.1/16"},
+		{"10.1.2.0/24", "10.1.2/24"},
+		{"10.1.2.3/32", "10.1.2.3"},
+		{"0.0.0.0/0", "any v4"},
+		{"::/0", "any"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"2001:db8:abcd::/48", "2001:db8:abcd::/48"},
+		{"2001:db8:abcd:12::/64", "2001:db8:abcd:12::/64"},
+		// an IPv4 network written as an IPv4-mapped IPv6 network
+		{"::ffff:192.168.0.0/112", "192.168/16"},
+		{"192.168.1.0/24", "192.168.1/24"},
+	}
+	tests := []struct {
+		ip    string
+		label string
+	}{
+		{"10.2.3.4", "10/8"},
+		{"10.1.3.4", "10.1/16"},
+		{"10.1.2.4", "10.1.2/24"},
+		{"10.1.2.3", "10.1.2.3"},
+		{"::ffff:10.1.2.3", "10.1.2.3"},
+		{"11.0.0.1", "any v4"},
+		{"192.168.2.1", "192.168/16"},
+		{"192.168.1.1", "192.168.1/24"},
+		{"2001:db8::1", "2001:db8::/32"},
+		{"2001:db8:abcd::1", "2001:db8:abcd::/48"},
+		{"2001:db8:abcd:12::1", "2001:db8:abcd:12::/64"},
+		{"2001:db8:abcd:13::1", "2001:db8:abcd::/48"},
+		{"2001:db9::1", "any"},
+		{"::1", "any"},
+		// an IPv4-compatible IPv6 address is not an IPv4 address
+		{"::10.1.2.3", "any"},
+	}
+	// the result does not depend on the insertion order
+	for _, reverse := range []bool{false, true} {
+		tree := new(ipTree)
+		for i := range networks {
+			n := networks[i]
+			if reverse {
+				n = networks[len(networks)-1-i]
+			}
+			_, network, err := net.ParseCIDR(n.cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree.insert(network, n.label)
+		}
+		for _, test := range tests {
+			label, found := tree.lookup(net.ParseIP(test.ip))
+			if !found || label != test.label {
+				t.Errorf("reverse=%v: %s: got '%s' %v, want '%s'", reverse, test.ip, label, found, test.label)
+			}
+		}
+	}
+}
+
+func TestIPTreeNotFound(t *testing.T) {
+	tree := new(ipTree)
+	for _, cidr := range []string{"10.0.0.0/8", "2001:db8::/32"} {
+		network, err := parseNetwork(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.insert(network, cidr)
+	}
+	for _, ip := range []net.IP{net.ParseIP("11.0.0.1"), net.ParseIP("2001:db9::1"), net.ParseIP("::ffff:0:0"), nil, net.IP{1, 2, 3}} {
+		if label, found := tree.lookup(ip); found {
+			t.Errorf("%v: got '%s'", ip, label)
+		}
+	}
+	if _, found := new(ipTree).lookup(net.ParseIP("10.0.0.1")); found {
+		t.Error("found an IP in an empty tree")
+	}
+}
+
+func TestIPTreeReplace(t *testing.T) {
+	tree := new(ipTree)
+	for _, label := range []string{"first", "second"} {
+		network, err := parseNetwork("10.0.0.0/8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.insert(network, label)
+	}
+	// a single IP is a /32 or /128 network
+	for _, s := range []string{"10.0.0.1", "2001:db8::1"} {
+		network, err := parseNetwork(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.insert(network, "host "+s)
+	}
+	tests := map[string]string{
+		"10.0.0.2":    "second",
+		"10.0.0.1":    "host 10.0.0.1",
+		"2001:db8::1": "host 2001:db8::1",
+	}
+	for ip, want := range tests {
+		if label, _ := tree.lookup(net.ParseIP(ip)); label != want {
+			t.Errorf("%s: got '%s', want '%s'", ip, label, want)
+		}
+	}
+	if _, found := tree.lookup(net.ParseIP("2001:db8::2")); found {
+		t.Error("2001:db8::2 should not be found")
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.0/8":       "10.0.0.0/8",
+		" 10.1.2.3/8 ":     "10.0.0.0/8",
+		"10.1.2.3":         "10.1.2.3/32",
+		"::ffff:10.1.2.3":  "10.1.2.3/32",
+		"2001:db8::1":      "2001:db8::1/128",
+		"2001:db8::1/32":   "2001:db8::/32",
+		"0.0.0.0/0":        "0.0.0.0/0",
+		"2001:db8:0:0::/0": "::/0",
+	}
+	for s, want := range tests {
+		network, err := parseNetwork(s)
+		if err != nil {
+			t.Errorf("'%s': %s", s, err)
+			continue
+		}
+		if network.String() != want {
+			t.Errorf("'%s': got %s, want %s", s, network, want)
+		}
+	}
+	for _, s := range []string{"", "10.0.0", "10.0.0.0/33", "2001:db8::/129", "host"} {
+		if _, err := parseNetwork(s); err == nil {
+			t.Errorf("'%s': expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/spf13/cobra"
+)
+
+// The statuses of the files in the ingestion ledger.
+const (
+	statusStarted = "started"
+	statusDone    = "done"
+	statusFailed  = "failed"
+)
+
+// The policies for the partially ingested files.
+const (
+	// partialResume restarts after the last committed batch.
+	partialResume = "resume"
+	// partialRedo ingests the whole file again.
+	partialRedo = "redo"
+	// partialSkip leaves the file alone.
+	partialSkip = "skip"
+)
+
+var ledgerTable string
+var ledgerFile string
+var partialPolicy string
+
+// errSkipped is returned for the files that the ledger skips.
+var errSkipped = errors.New("skipped by the ledger")
+
+// ingestLedger records the ingested files. It is nil when the ledger is
+// disabled.
+var ingestLedger ledger
+
+func addPGLedgerFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&ledgerTable, "ledger-table", "", "record the ingested files in that table, and skip them on the next runs")
+	addPartialFlag(cmd)
+}
+
+func addESLedgerFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&ledgerFile, "ledger-file", "", "record the ingested files in that local state file, and skip them on the next runs")
+	addPartialFlag(cmd)
+}
+
+func addPartialFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&partialPolicy, "partial", partialResume, "what to do with the partially ingested files: resume, redo or skip")
+}
+
+func checkPartialPolicy() error {
+	switch partialPolicy {
+	case partialResume, partialRedo, partialSkip:
+		return nil
+	default:
+		return fmt.Errorf("invalid --partial: '%s' (expected resume, redo or skip)", partialPolicy)
+	}
+}
+
+// ledgerEntry describes the ingestion of a file.
+type ledgerEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Checksum is the checksum of the first Offset bytes of a fully ingested
+	// file.
+	Checksum string `json:"checksum,omitempty"`
+	// Lines is the number of lines read from the file, up to the last
+	// committed batch.
+	Lines int `json:"lines"`
+	// Offset is the byte offset of the end of the last committed batch.
+	Offset  int64     `json:"offset"`
+	Status  string    `json:"status"`
+	Updated time.Time `json:"updated"`
+}
+
+// checkpoint is the position in a file after a committed batch.
+type checkpoint struct {
+	lines  int
+	offset int64
+}
+
+// ledger stores the ledger entries, indexed by the absolute path of the files.
+type ledger interface {
+	get(path string) (entry ledgerEntry, found bool, err error)
+	put(entry ledgerEntry) error
+}
+
+// openPGLedger enables the ledger when --ledger-table is set.
+func openPGLedger(pool *pgx.ConnPool) error {
+	if ledgerTable == "" {
+		return nil
+	}
+	l, err := newPGLedger(pool, ledgerTable)
+	if err != nil {
+		return err
+	}
+	ingestLedger = l
+	return nil
+}
+
+// openFileLedger enables the ledger when --ledger-file is set.
+func openFileLedger() error {
+	if ledgerFile == "" {
+		return nil
+	}
+	l, err := newFileLedger(ledgerFile)
+	if err != nil {
+		return err
+	}
+	ingestLedger = l
+	return nil
+}
+
+// pgLedger stores the ledger in a Postgres table.
+type pgLedger struct {
+	pool  *pgx.ConnPool
+	table string
+}
+
+// newPGLedger returns a ledger stored in the given table, that is created if
+// needed.
+func newPGLedger(pool *pgx.ConnPool, table string) (*pgLedger, error) {
+	if !validName(table) {
+		return nil, fmt.Errorf("invalid ledger table name: '%s'", table)
+	}
+	l := &pgLedger{pool: pool, table: table}
+	_, err := pool.Exec(buildLedgerStmt(table))
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func buildLedgerStmt(tName string) string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+    path TEXT PRIMARY KEY,
+    size BIGINT NOT NULL,
+    mtime TIMESTAMP WITH TIME ZONE NOT NULL,
+    checksum TEXT DEFAULT '' NOT NULL,
+    lines BIGINT DEFAULT 0 NOT NULL,
+    byte_offset BIGINT DEFAULT 0 NOT NULL,
+    status TEXT NOT NULL,
+    updated TIMESTAMP WITH TIME ZONE NOT NULL);`, tName)
+}
+
+func (l *pgLedger) get(path string) (entry ledgerEntry, found bool, err error) {
+	var lines int64
+	err = l.pool.QueryRow(
+		fmt.Sprintf("SELECT size, mtime, checksum, lines, byte_offset, status, updated FROM %s WHERE path = $1;", l.table),
+		path,
+	).Scan(&entry.Size, &entry.ModTime, &entry.Checksum, &lines, &entry.Offset, &entry.Status, &entry.Updated)
+	if err == pgx.ErrNoRows {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, err
+	}
+	entry.Path = path
+	entry.Lines = int(lines)
+	return entry, true, nil
+}
+
+func (l *pgLedger) put(entry ledgerEntry) error {
+	return l.putWith(l.pool, entry)
+}
+
+// putIn records the checkpoint of a file in the transaction of the committed
+// batch, so that the ledger and the table cannot disagree.
+func (l *pgLedger) putIn(txn *pgx.Tx, entry ledgerEntry, cp checkpoint) error {
+	entry.Status = statusStarted
+	entry.Lines = cp.lines
+	entry.Offset = cp.offset
+	entry.Updated = time.Now().UTC()
+	return l.putWith(txn, entry)
+}
+
+// execer is implemented by *pgx.ConnPool and *pgx.Tx.
+type execer interface {
+	Exec(sql string, arguments ...interface{}) (pgx.CommandTag, error)
+}
+
+func (l *pgLedger) putWith(db execer, entry ledgerEntry) error {
+	_, err := db.Exec(
+		fmt.Sprintf(
+			`INSERT INTO %s (path, size, mtime, checksum, lines, byte_offset, status, updated) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (path) DO UPDATE SET size = EXCLUDED.size, mtime = EXCLUDED.mtime, checksum = EXCLUDED.checksum,
+lines = EXCLUDED.lines, byte_offset = EXCLUDED.byte_offset, status = EXCLUDED.status, updated = EXCLUDED.updated;`,
+			l.table,
+		),
+		entry.Path, entry.Size, entry.ModTime, entry.Checksum, int64(entry.Lines), entry.Offset, entry.Status, entry.Updated,
+	)
+	return err
+}
+
+// fileLedger stores the ledger in a local JSON file.
+type fileLedger struct {
+	mu      sync.Mutex
+	fname   string
+	entries map[string]ledgerEntry
+}
+
+// newFileLedger returns a ledger stored in the given file. The file is created
+// when the first entry is recorded.
+func newFileLedger(fname string) (*fileLedger, error) {
+	l := &fileLedger{fname: fname, entries: make(map[string]ledgerEntry)}
+	content, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &l.entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	return l, nil
+}
+
+func (l *fileLedger) get(path string) (entry ledgerEntry, found bool, err error) {
+	l.mu.Lock()
+	entry, found = l.entries[path]
+	l.mu.Unlock()
+	return entry, found, nil
+}
+
+func (l *fileLedger) put(entry ledgerEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[entry.Path] = entry
+	content, err := json.MarshalIndent(l.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(l.fname, content)
+}
+
+// prefixChecksum returns the SHA-256 checksum of the first size bytes of a
+// file.
+func prefixChecksum(fname string, size int64) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.CopyN(h, f, size)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readChecksum computes the checksum of a file while it is read from the
+// start.
+type readChecksum struct {
+	hash.Hash
+	n int64
+}
+
+func newReadChecksum() *readChecksum {
+	return &readChecksum{Hash: sha256.New()}
+}
+
+func (c *readChecksum) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return c.Hash.Write(p)
+}
+
+// sum returns the checksum of the first size bytes of the file. The file is
+// read again when it was resumed, or when more bytes were read.
+func (c *readChecksum) sum(fname string, size int64) string {
+	if c.n == size {
+		return hex.EncodeToString(c.Sum(nil))
+	}
+	sum, _ := prefixChecksum(fname, size)
+	return sum
+}
+
+// ledgerStart decides whether a file must be ingested, according to the
+// ledger and to the partial policy. The unchanged files that were fully
+// ingested are skipped, and the ingestion of the files that were appended to
+// resumes after the ingested lines. When the file must be ingested, it is
+// recorded as started, and resume is the position where the ingestion must
+// start.
+func ledgerStart(fname string) (entry ledgerEntry, ingest bool, resume checkpoint, err error) {
+	path, err := filepath.Abs(fname)
+	if err != nil {
+		return entry, false, resume, err
+	}
+	infos, err := os.Stat(fname)
+	if err != nil {
+		return entry, false, resume, err
+	}
+	entry = ledgerEntry{Path: path, Size: infos.Size(), ModTime: infos.ModTime().UTC()}
+	prev, found, err := ingestLedger.get(path)
+	if err != nil {
+		return entry, false, resume, err
+	}
+	unchanged := found && prev.Size == entry.Size && prev.ModTime.Equal(entry.ModTime)
+	appended := false
+	if found && !unchanged && prev.Checksum != "" && entry.Size >= prev.Size && prev.Offset <= entry.Size {
+		// the file may have been touched, copied, or a live log may have
+		// been appended to
+		checksum, err := prefixChecksum(fname, prev.Offset)
+		if err != nil {
+			return entry, false, resume, err
+		}
+		if checksum == prev.Checksum {
+			unchanged = entry.Size == prev.Size
+			appended = entry.Size > prev.Size
+		}
+	}
+	switch {
+	case !found:
+	case appended:
+		resume = checkpoint{lines: prev.Lines, offset: prev.Offset}
+		fmt.Fprintf(os.Stderr, "Resuming '%s' after line %d (byte %d): lines were appended\n", fname, resume.lines, resume.offset)
+	case !unchanged && prev.Checksum != "":
+		fmt.Fprintf(os.Stderr, "'%s' was rewritten since its ingestion: ingesting it again\n", fname)
+	case !unchanged && !deterministicIDs() && partialPolicy != partialRedo:
+		// the ingested lines cannot be told apart from the new ones, and
+		// they would be stored again with new random IDs
+		fmt.Fprintf(os.Stderr, "Skipping '%s': changed since its partial ingestion (%d lines), use --partial redo to ingest it again\n", fname, prev.Lines)
+		return prev, false, resume, nil
+	case !unchanged:
+	case prev.Status == statusDone:
+		fmt.Fprintf(os.Stderr, "Skipping '%s': already ingested\n", fname)
+		if !prev.ModTime.Equal(entry.ModTime) {
+			prev.ModTime = entry.ModTime
+			err = ingestLedger.put(prev)
+		}
+		return prev, false, resume, err
+	case partialPolicy == partialSkip:
+		fmt.Fprintf(os.Stderr, "Skipping '%s': partially ingested (%d lines)\n", fname, prev.Lines)
+		return prev, false, resume, nil
+	case partialPolicy == partialResume:
+		if prev.Offset > 0 {
+			resume = checkpoint{lines: prev.Lines, offset: prev.Offset}
+			fmt.Fprintf(os.Stderr, "Resuming '%s' after line %d (byte %d)\n", fname, resume.lines, resume.offset)
+		}
+	}
+	entry.Status = statusStarted
+	entry.Lines = resume.lines
+	entry.Offset = resume.offset
+	entry.Updated = time.Now().UTC()
+	err = ingestLedger.put(entry)
+	if err != nil {
+		return entry, false, resume, err
+	}
+	return entry, true, resume, nil
+}
+
+// ledgerRecord updates the ledger entry of a file. The errors are printed, as
+// they do not invalidate the ingestion itself.
+func ledgerRecord(entry ledgerEntry, status string, cp checkpoint, checksum string) {
+	entry.Status = status
+	entry.Lines = cp.lines
+	entry.Offset = cp.offset
+	entry.Checksum = checksum
+	entry.Updated = time.Now().UTC()
+	err := ingestLedger.put(entry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating the ledger for '%s': %s\n", entry.Path, err)
+	}
+}
@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+var lookupSpecs []string
+var lookupIgnoreCase bool
+var lookupNoReload bool
+
+func addLookupFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&lookupSpecs, "lookup", []string{}, "field=file: add the columns of the CSV or JSON lookup file for the value of field (can be repeated)")
+	cmd.Flags().BoolVar(&lookupIgnoreCase, "lookup-ignore-case", false, "match the lookup keys case-insensitively")
+	cmd.Flags().BoolVar(&lookupNoReload, "lookup-no-reload", false, "do not reload the lookup files when they change")
+}
+
+// lookupDefaultKey is the key of the lookup table row that provides the
+// default values.
+const lookupDefaultKey = "*"
+
+// lookupTable maps the values of a field to the values of the columns to add.
+type lookupTable struct {
+	columns []string
+	index   map[string]int
+	rows    map[string][]string
+}
+
+// loadLookupTable reads a lookup table from a CSV file, whose first line
+// gives the column names and whose first column is the key, or from a JSON
+// file that maps keys to objects.
+func loadLookupTable(fname string, ignoreCase bool) (*lookupTable, error) {
+	t := &lookupTable{index: make(map[string]int), rows: make(map[string][]string)}
+	key := func(k string) string {
+		k = strings.TrimSpace(k)
+		if ignoreCase {
+			return strings.ToLower(k)
+		}
+		return k
+	}
+	if strings.ToLower(filepath.Ext(fname)) == ".json" {
+		content, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		objects := make(map[string]map[string]interface{})
+		err = json.Unmarshal(content, &objects)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fname, err)
+		}
+		columns := make(map[string]bool)
+		for _, obj := range objects {
+			for column := range obj {
+				columns[column] = true
+			}
+		}
+		for column := range columns {
+			t.columns = append(t.columns, column)
+		}
+		sort.Strings(t.columns)
+		for i, column := range t.columns {
+			t.index[column] = i
+		}
+		for k, obj := range objects {
+			row := make([]string, 0, len(t.columns))
+			for _, column := range t.columns {
+				if v, ok := obj[column]; ok && v != nil {
+					row = append(row, fmt.Sprint(v))
+				} else {
+					row = append(row, "")
+				}
+			}
+			t.rows[key(k)] = row
+		}
+		return t, nil
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	if len(records) == 0 || len(records[0]) < 2 {
+		return nil, fmt.Errorf("%s: the first line should give the key and column names", fname)
+	}
+	for i, column := range records[0][1:] {
+		t.columns = append(t.columns, strings.TrimSpace(column))
+		t.index[t.columns[i]] = i
+	}
+	for _, record := range records[1:] {
+		if len(record) == 0 {
+			continue
+		}
+		t.rows[key(record[0])] = record[1:]
+	}
+	return t, nil
+}
+
+// lookupEnricher adds the columns of a lookup table to the lines, using the
+// value of the key field. The table is reloaded when the file changes.
+type lookupEnricher struct {
+	field      string
+	fname      string
+	prefix     string
+	ignoreCase bool
+	columns    []string
+	kinds      map[string]parser.Kind
+	mu         sync.RWMutex
+	table      *lookupTable
+	watcher    *fsnotify.Watcher
+}
+
+// newLookupEnricher builds a lookupEnricher from a field=file specification.
+// The added fields are named after the file: users.csv with a department
+// column gives the users.department field.
+func newLookupEnricher(spec string, ignoreCase bool, reload bool) (*lookupEnricher, error) {
+	kv := strings.SplitN(spec, "=", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+		return nil, fmt.Errorf("invalid lookup specification: '%s' (expected field=file)", spec)
+	}
+	fname, err := filepath.Abs(strings.TrimSpace(kv[1]))
+	if err != nil {
+		return nil, err
+	}
+	e := &lookupEnricher{
+		field:      strings.ToLower(strings.TrimSpace(kv[0])),
+		fname:      fname,
+		prefix:     strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname)),
+		ignoreCase: ignoreCase,
+		kinds:      make(map[string]parser.Kind),
+	}
+	e.table, err = loadLookupTable(fname, ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range e.table.columns {
+		name := e.prefix + "." + column
+		e.columns = append(e.columns, name)
+		e.kinds[name] = parser.String
+	}
+	if reload {
+		err = e.watch()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// watch reloads the lookup table when the file changes. The directory is
+// watched, so that files replaced by a rename are also reloaded.
+func (e *lookupEnricher) watch() (err error) {
+	e.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	err = e.watcher.Add(filepath.Dir(e.fname))
+	if err != nil {
+		e.watcher.Close()
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-e.watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Name != e.fname || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				table, err := loadLookupTable(e.fname, e.ignoreCase)
+				if err != nil {
+					// keep the previous table
+					fmt.Fprintf(os.Stderr, "Error reloading '%s': %s\n", e.fname, err)
+					continue
+				}
+				e.mu.Lock()
+				e.table = table
+				e.mu.Unlock()
+				fmt.Fprintf(os.Stderr, "Reloaded '%s'\n", e.fname)
+			case err, ok := <-e.watcher.Errors:
+				if !ok {
+					return
+				}
+				fmt.Fprintf(os.Stderr, "Error watching '%s': %s\n", e.fname, err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (e *lookupEnricher) Close() error {
+	if e.watcher == nil {
+		return nil
+	}
+	return e.watcher.Close()
+}
+
+func (e *lookupEnricher) Fields(names []string) (added []string, removed []string) {
+	for _, name := range names {
+		if name == e.field {
+			return e.columns, nil
+		}
+	}
+	return nil, nil
+}
+
+func (e *lookupEnricher) Kind(name string) (parser.Kind, bool) {
+	k, ok := e.kinds[name]
+	return k, ok
+}
+
+func (e *lookupEnricher) Process(l *parser.Line) (bool, error) {
+	if !l.Has(e.field) {
+		return true, nil
+	}
+	key := strings.TrimSpace(l.GetAsString(e.field))
+	if e.ignoreCase {
+		key = strings.ToLower(key)
+	}
+	e.mu.RLock()
+	table := e.table
+	e.mu.RUnlock()
+	row, ok := table.rows[key]
+	if !ok {
+		row = table.rows[lookupDefaultKey]
+	}
+	for _, name := range e.columns {
+		// a reloaded table may lack some of the initial columns
+		var value interface{}
+		if i, ok := table.index[name[len(e.prefix)+1:]]; ok && i < len(row) {
+			value = nilIfEmpty(row[i])
+		}
+		l.Set(name, value)
+	}
+	return true, nil
+}
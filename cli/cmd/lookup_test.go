@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+const lookupTestCSV = `user,department,manager
+alice,Finance,carol
+Bob,IT,
+*,Unknown,
+`
+
+const lookupTestJSON = `{
+	"alice": {"department": "Finance", "manager": "carol", "level": 3},
+	"Bob": {"department": "IT", "manager": null}
+}`
+
+func writeLookupFile(t *testing.T, dir string, name string, content string) string {
+	fname := filepath.Join(dir, name)
+	err := ioutil.WriteFile(fname, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestLoadLookupTable(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	tests := []struct {
+		name       string
+		content    string
+		ignoreCase bool
+		columns    []string
+		rows       map[string][]string
+	}{
+		{"users.csv", lookupTestCSV, false, []string{"department", "manager"}, map[string][]string{
+			"alice": {"Finance", "carol"},
+			"Bob":   {"IT", ""},
+			"*":     {"Unknown", ""},
+		}},
+		{"users.csv", lookupTestCSV, true, []string{"department", "manager"}, map[string][]string{
+			"alice": {"Finance", "carol"},
+			"bob":   {"IT", ""},
+			"*":     {"Unknown", ""},
+		}},
+		// the JSON columns are sorted
+		{"users.json", lookupTestJSON, false, []string{"department", "level", "manager"}, map[string][]string{
+			"alice": {"Finance", "3", "carol"},
+			"Bob":   {"IT", "", ""},
+		}},
+	}
+	for _, test := range tests {
+		fname := writeLookupFile(t, dir, test.name, test.content)
+		table, err := loadLookupTable(fname, test.ignoreCase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(table.columns, test.columns) {
+			t.Errorf("%s: got columns %v, want %v", test.name, table.columns, test.columns)
+		}
+		for i, column := range test.columns {
+			if table.index[column] != i {
+				t.Errorf("%s: column %s is at %d", test.name, column, table.index[column])
+			}
+		}
+		if !reflect.DeepEqual(table.rows, test.rows) {
+			t.Errorf("%s: got rows %v, want %v", test.name, table.rows, test.rows)
+		}
+	}
+
+	invalid := map[string]string{
+		"empty.csv":  "",
+		"nokey.csv":  "user\nalice\n",
+		"quote.csv":  "user,department\n\"alice,Finance\n",
+		"array.json": `["alice"]`,
+	}
+	for name, content := range invalid {
+		if _, err := loadLookupTable(writeLookupFile(t, dir, name, content), false); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := loadLookupTable(filepath.Join(dir, "missing.csv"), false); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestLookupEnricher(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	fname := writeLookupFile(t, dir, "users.csv", lookupTestCSV)
+	for _, spec := range []string{"cs-username", "=" + fname, "cs-username="} {
+		if _, err := newLookupEnricher(spec, false, false); err == nil {
+			t.Errorf("'%s': expected an error", spec)
+		}
+	}
+	e, err := newLookupEnricher("CS-Username = "+fname, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if added, _ := e.Fields([]string{"date", "cs-username"}); !reflect.DeepEqual(added, []string{"users.department", "users.manager"}) {
+		t.Errorf("got %v", added)
+	}
+	if kind, ok := e.Kind("users.manager"); !ok || kind != parser.String {
+		t.Errorf("got %v %v", kind, ok)
+	}
+
+	tests := []struct {
+		user       interface{}
+		department interface{}
+		manager    interface{}
+	}{
+		{"alice", "Finance", "carol"},
+		{"BOB", "IT", nil},
+		// the default row
+		{"dave", "Unknown", nil},
+		{nil, "Unknown", nil},
+	}
+	l := parser.NewLine([]string{"cs-username"})
+	for _, test := range tests {
+		l.Set("cs-username", test.user)
+		keep, err := e.Process(l)
+		if !keep || err != nil {
+			t.Fatalf("got %v %v", keep, err)
+		}
+		if l.Get("users.department") != test.department || l.Get("users.manager") != test.manager {
+			t.Errorf("%v: got %v %v", test.user, l.Get("users.department"), l.Get("users.manager"))
+		}
+	}
+}
+
+// waitLookup waits until the enricher gives the department of alice.
+func waitLookup(t *testing.T, e *lookupEnricher, want interface{}) {
+	l := parser.NewLine([]string{"cs-username"})
+	l.Set("cs-username", "alice")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		e.Process(l)
+		if l.Get("users.department") == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v, want %v", l.Get("users.department"), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLookupReload(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	fname := writeLookupFile(t, dir, "users.csv", lookupTestCSV)
+	e, err := newLookupEnricher("cs-username="+fname, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	waitLookup(t, e, "Finance")
+
+	// the file is written in place
+	writeLookupFile(t, dir, "users.csv", "user,department,manager\nalice,Sales,erin\n")
+	waitLookup(t, e, "Sales")
+
+	// the file is replaced by a rename, with a column less
+	tmp := writeLookupFile(t, dir, "users.tmp", "user,department\nalice,Legal\n")
+	err = os.Rename(tmp, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitLookup(t, e, "Legal")
+	l := parser.NewLine([]string{"cs-username"})
+	l.Set("cs-username", "alice")
+	e.Process(l)
+	if v := l.Get("users.manager"); v != nil {
+		t.Errorf("got %v", v)
+	}
+
+	// an invalid file does not replace the table, and the other files of
+	// the directory are ignored
+	writeLookupFile(t, dir, "users.csv", "user\n")
+	writeLookupFile(t, dir, "other.csv", "user,department\nalice,Other\n")
+	time.Sleep(100 * time.Millisecond)
+	waitLookup(t, e, "Legal")
+}
@@ -0,0 +1,352 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+// mmdbMarker separates the search tree and data section of a MaxMind DB file
+// from its metadata.
+var mmdbMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// mmdbReader reads the MaxMind DB file format, as used by the GeoIP2,
+// GeoLite2 and DB-IP databases.
+type mmdbReader struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dbType     string
+	ipv4Start  uint
+}
+
+func openMMDB(fname string) (*mmdbReader, error) {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	idx := bytes.LastIndex(buf, mmdbMarker)
+	if idx == -1 {
+		return nil, fmt.Errorf("'%s' is not a MaxMind DB file", fname)
+	}
+	metaDecoder := mmdbDecoder{buf: buf[idx+len(mmdbMarker):]}
+	meta, _, err := metaDecoder.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata in '%s': %s", fname, err)
+	}
+	metaMap, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata in '%s'", fname)
+	}
+	r := &mmdbReader{
+		nodeCount:  mmdbUint(metaMap["node_count"]),
+		recordSize: mmdbUint(metaMap["record_size"]),
+		ipVersion:  mmdbUint(metaMap["ip_version"]),
+	}
+	r.dbType, _ = metaMap["database_type"].(string)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size in '%s': %d", fname, r.recordSize)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(idx) {
+		return nil, fmt.Errorf("invalid search tree size in '%s'", fname)
+	}
+	r.tree = buf[:treeSize]
+	r.data = mmdbDecoder{buf: buf[treeSize+16 : idx]}
+	if r.ipVersion == 6 {
+		// IPv4 addresses are stored in the ::/96 subnet
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start = r.readNode(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+func (r *mmdbReader) readNode(node uint, bit uint) uint {
+	b := r.tree
+	switch r.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return (uint(b[off+3])&0xF0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return (uint(b[off+3])&0x0F)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(b[off : off+4]))
+	}
+}
+
+// lookup returns the record associated with ip, or nil if there is none.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bitCount := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bitCount = 32
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	} else {
+		ip = ip.To16()
+	}
+	if ip == nil {
+		return nil, nil
+	}
+	for i := 0; i < bitCount && node < r.nodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		node = r.readNode(node, bit)
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, errors.New("invalid node in the MaxMind DB search tree")
+	}
+	value, _, err := r.data.decode(node - r.nodeCount - 16)
+	return value, err
+}
+
+// mmdbDecoder decodes the values of a MaxMind DB data section.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+const (
+	mmdbExtended uint = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+var errMMDBOutOfBounds = errors.New("unexpected end of MaxMind DB data")
+
+func (d *mmdbDecoder) bytes(offset uint, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) {
+		return nil, errMMDBOutOfBounds
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// decode decodes the value at offset. It returns the value and the offset of
+// the next value.
+func (d *mmdbDecoder) decode(offset uint) (value interface{}, next uint, err error) {
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		pointer, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err = d.decode(pointer)
+		return value, next, err
+	}
+	if typ == mmdbExtended {
+		b, err = d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		b, err = d.bytes(offset, size-28)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += size - 28
+		n := uint(0)
+		for _, c := range b {
+			n = n<<8 | uint(c)
+		}
+		switch size {
+		case 29:
+			size = 29 + n
+		case 30:
+			size = 285 + n
+		default:
+			size = 65821 + n
+		}
+	}
+
+	switch typ {
+	case mmdbString:
+		b, err = d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return string(b), offset + size, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid size for a MaxMind DB double")
+		}
+		b, err = d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset + size, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid size for a MaxMind DB float")
+		}
+		b, err = d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset + size, nil
+	case mmdbBytes:
+		b, err = d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return append([]byte(nil), b...), offset + size, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, errors.New("invalid size for a MaxMind DB unsigned integer")
+		}
+		b, err = d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset + size, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errors.New("invalid size for a MaxMind DB int32")
+		}
+		b, err = d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset + size, nil
+	case mmdbUint128:
+		if size > 16 {
+			return nil, 0, errors.New("invalid size for a MaxMind DB uint128")
+		}
+		b, err = d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		return new(big.Int).SetBytes(b), offset + size, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			k, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("invalid key in a MaxMind DB map")
+			}
+			v, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			v, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, offset, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported MaxMind DB data type: %d", typ)
+	}
+}
+
+// pointer decodes a pointer, and returns the offset it points to and the
+// offset of the next value.
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint) (pointer uint, next uint, err error) {
+	ss := uint(ctrl>>3) & 0x3
+	vvv := uint(ctrl & 0x7)
+	b, err := d.bytes(offset, ss+1)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch ss {
+	case 0:
+		pointer = vvv<<8 | uint(b[0])
+	case 1:
+		pointer = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 2:
+		pointer = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	default:
+		pointer = uint(binary.BigEndian.Uint32(b))
+	}
+	return pointer, offset + ss + 1, nil
+}
+
+// mmdbGet returns the value found in a decoded record by following the given
+// map keys and array indices.
+func mmdbGet(value interface{}, path ...interface{}) interface{} {
+	for _, elt := range path {
+		switch key := elt.(type) {
+		case string:
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			value = m[key]
+		case int:
+			a, ok := value.([]interface{})
+			if !ok || key >= len(a) {
+				return nil
+			}
+			value = a[key]
+		}
+	}
+	return value
+}
+
+func mmdbUint(value interface{}) uint {
+	if n, ok := value.(uint64); ok {
+		return uint(n)
+	}
+	return 0
+}
@@ -0,0 +1,431 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// mmdbEncode encodes a value in the MaxMind DB data format.
+func mmdbEncode(value interface{}) []byte {
+	var buf bytes.Buffer
+	ctrl := func(typ uint, size int) {
+		var ext []byte
+		switch {
+		case size >= 65821:
+			n := size - 65821
+			ext = []byte{byte(n >> 16), byte(n >> 8), byte(n)}
+			size = 31
+		case size >= 285:
+			n := size - 285
+			ext = []byte{byte(n >> 8), byte(n)}
+			size = 30
+		case size >= 29:
+			ext = []byte{byte(size - 29)}
+			size = 29
+		}
+		if typ > 7 {
+			buf.WriteByte(byte(size))
+			buf.WriteByte(byte(typ - 7))
+		} else {
+			buf.WriteByte(byte(typ<<5) | byte(size))
+		}
+		buf.Write(ext)
+	}
+	switch v := value.(type) {
+	case string:
+		ctrl(mmdbString, len(v))
+		buf.WriteString(v)
+	case float64:
+		ctrl(mmdbDouble, 8)
+		binary.Write(&buf, binary.BigEndian, math.Float64bits(v))
+	case float32:
+		ctrl(mmdbFloat, 4)
+		binary.Write(&buf, binary.BigEndian, math.Float32bits(v))
+	case []byte:
+		ctrl(mmdbBytes, len(v))
+		buf.Write(v)
+	case uint16, uint32, uint64:
+		typ := map[reflect.Kind]uint{reflect.Uint16: mmdbUint16, reflect.Uint32: mmdbUint32, reflect.Uint64: mmdbUint64}[reflect.TypeOf(v).Kind()]
+		n := reflect.ValueOf(v).Uint()
+		var b []byte
+		for ; n > 0; n >>= 8 {
+			b = append([]byte{byte(n)}, b...)
+		}
+		ctrl(typ, len(b))
+		buf.Write(b)
+	case int32:
+		ctrl(mmdbInt32, 4)
+		binary.Write(&buf, binary.BigEndian, v)
+	case *big.Int:
+		b := v.Bytes()
+		ctrl(mmdbUint128, len(b))
+		buf.Write(b)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		ctrl(mmdbBool, size)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ctrl(mmdbMap, len(v))
+		for _, k := range keys {
+			buf.Write(mmdbEncode(k))
+			buf.Write(mmdbEncode(v[k]))
+		}
+	case []interface{}:
+		ctrl(mmdbArray, len(v))
+		for _, elt := range v {
+			buf.Write(mmdbEncode(elt))
+		}
+	default:
+		panic("unsupported type")
+	}
+	return buf.Bytes()
+}
+
+// mmdbNetwork is a network of a test database, and its record.
+type mmdbNetwork struct {
+	cidr   string
+	record interface{}
+}
+
+// buildMMDB returns a MaxMind DB file. The networks must be given from the
+// least specific to the most specific.
+func buildMMDB(t *testing.T, ipVersion int, recordSize int, networks []mmdbNetwork) []byte {
+	// a node record is a node index, -1 when empty, or -2-i for the data i
+	nodes := [][2]int{{-1, -1}}
+	for i, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := ipNet.IP.To16()
+		ones, _ := ipNet.Mask.Size()
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			// the IPv4 networks are stored in ::/96
+			ip = append(make(net.IP, 12), ip4...)
+			ones += 96
+			if ipVersion == 4 {
+				ip = ip4
+				ones -= 96
+			}
+		}
+		node := 0
+		for bit := 0; bit < ones; bit++ {
+			b := int(ip[bit>>3]>>(7-uint(bit&7))) & 1
+			if bit == ones-1 {
+				nodes[node][b] = -2 - i
+				break
+			}
+			child := nodes[node][b]
+			if child < 0 {
+				// a new node, that inherits the less specific record
+				nodes = append(nodes, [2]int{child, child})
+				child = len(nodes) - 1
+				nodes[node][b] = child
+			}
+			node = child
+		}
+	}
+
+	var data bytes.Buffer
+	offsets := make([]int, len(networks))
+	for i, network := range networks {
+		offsets[i] = data.Len()
+		data.Write(mmdbEncode(network.record))
+	}
+	nodeCount := len(nodes)
+	value := func(record int) uint32 {
+		switch {
+		case record >= 0:
+			return uint32(record)
+		case record == -1:
+			return uint32(nodeCount)
+		default:
+			return uint32(nodeCount + 16 + offsets[-2-record])
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		left, right := value(node[0]), value(node[1])
+		switch recordSize {
+		case 24:
+			buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(left>>20)&0xF0 | byte(right>>24)&0x0F, byte(right >> 16), byte(right >> 8), byte(right)})
+		default:
+			binary.Write(&buf, binary.BigEndian, left)
+			binary.Write(&buf, binary.BigEndian, right)
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+	buf.Write(mmdbMarker)
+	buf.Write(mmdbEncode(map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test",
+	}))
+	return buf.Bytes()
+}
+
+// writeMMDB writes a test database in dir, and returns its path.
+func writeMMDB(t *testing.T, dir string, name string, content []byte) string {
+	fname := filepath.Join(dir, name)
+	err := ioutil.WriteFile(fname, content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+var mmdbTestNetworks = []mmdbNetwork{
+	{"1.0.0.0/8", "1/8"},
+	{"1.2.3.0/24", "1.2.3/24"},
+	{"1.2.3.128/25", "1.2.3.128/25"},
+	{"10.0.0.0/8", "10/8"},
+	{"2001:db8::/32", "2001:db8::/32"},
+	{"2001:db8:1::/48", "2001:db8:1::/48"},
+}
+
+func TestMMDBLookup(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	tests := []struct {
+		ip   string
+		want interface{}
+	}{
+		{"1.1.1.1", "1/8"},
+		{"1.2.3.4", "1.2.3/24"},
+		{"1.2.3.127", "1.2.3/24"},
+		{"1.2.3.128", "1.2.3.128/25"},
+		{"1.2.3.255", "1.2.3.128/25"},
+		{"1.2.4.0", "1/8"},
+		{"::ffff:1.2.3.200", "1.2.3.128/25"},
+		{"10.255.255.255", "10/8"},
+		{"11.0.0.1", nil},
+		{"0.0.0.0", nil},
+		{"2001:db8::1", "2001:db8::/32"},
+		{"2001:db8:1::1", "2001:db8:1::/48"},
+		{"2001:db8:2::1", "2001:db8::/32"},
+		{"2001:db9::1", nil},
+		{"::1", nil},
+	}
+	for _, recordSize := range []int{24, 28, 32} {
+		fname := writeMMDB(t, dir, "test.mmdb", buildMMDB(t, 6, recordSize, mmdbTestNetworks))
+		r, err := openMMDB(fname)
+		if err != nil {
+			t.Fatalf("record size %d: %s", recordSize, err)
+		}
+		if r.dbType != "Test" || r.ipVersion != 6 || r.recordSize != uint(recordSize) {
+			t.Errorf("record size %d: got metadata %s %d %d", recordSize, r.dbType, r.ipVersion, r.recordSize)
+		}
+		for _, test := range tests {
+			got, err := r.lookup(net.ParseIP(test.ip))
+			if err != nil {
+				t.Errorf("record size %d: %s: %s", recordSize, test.ip, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("record size %d: %s: got %v, want %v", recordSize, test.ip, got, test.want)
+			}
+		}
+	}
+}
+
+func TestMMDBLookupIPv4(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	fname := writeMMDB(t, dir, "v4.mmdb", buildMMDB(t, 4, 24, mmdbTestNetworks[:4]))
+	r, err := openMMDB(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]interface{}{
+		"1.2.3.200":   "1.2.3.128/25",
+		"1.9.9.9":     "1/8",
+		"9.9.9.9":     nil,
+		"2001:db8::1": nil,
+	} {
+		got, err := r.lookup(net.ParseIP(ip))
+		if err != nil {
+			t.Errorf("%s: %s", ip, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestOpenMMDBErrors(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	valid := buildMMDB(t, 6, 24, mmdbTestNetworks)
+	badSize := bytes.Replace(valid, mmdbEncode("record_size"), mmdbEncode("record_sizz"), 1)
+	tests := map[string][]byte{
+		"not a database":     []byte("hello"),
+		"truncated metadata": append(valid[:bytes.LastIndex(valid, mmdbMarker)+len(mmdbMarker)], 0xe1),
+		"no record size":     badSize,
+		"truncated tree":     valid[bytes.LastIndex(valid, mmdbMarker)-10:],
+	}
+	for name, content := range tests {
+		fname := writeMMDB(t, dir, "bad.mmdb", content)
+		if _, err := openMMDB(fname); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := openMMDB(filepath.Join(dir, "missing.mmdb")); err == nil {
+		t.Error("missing file: expected an error")
+	}
+}
+
+func TestMMDBDecode(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	huge := string(bytes.Repeat([]byte("y"), 70000))
+	values := []interface{}{
+		"",
+		"short",
+		string(bytes.Repeat([]byte("z"), 29)),
+		long,
+		huge,
+		3.25,
+		[]byte{1, 2, 3},
+		true,
+		false,
+		map[string]interface{}{"a": "b", "nested": map[string]interface{}{"n": []interface{}{"x", 1.5}}},
+		[]interface{}{},
+	}
+	for _, value := range values {
+		d := mmdbDecoder{buf: mmdbEncode(value)}
+		got, next, err := d.decode(0)
+		if err != nil {
+			t.Errorf("%.20v: %s", value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, value) {
+			t.Errorf("got %.20v, want %.20v", got, value)
+		}
+		if next != uint(len(d.buf)) {
+			t.Errorf("%.20v: got next %d, want %d", value, next, len(d.buf))
+		}
+	}
+	// the numbers are decoded to uint64, int64, float64 and *big.Int
+	numbers := []struct {
+		value interface{}
+		want  interface{}
+	}{
+		{uint16(0), uint64(0)},
+		{uint16(443), uint64(443)},
+		{uint32(3215), uint64(3215)},
+		{uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{int32(-42), int64(-42)},
+		{float32(1.5), 1.5},
+		{new(big.Int).Lsh(big.NewInt(1), 100), new(big.Int).Lsh(big.NewInt(1), 100)},
+	}
+	for _, test := range numbers {
+		d := mmdbDecoder{buf: mmdbEncode(test.value)}
+		got, _, err := d.decode(0)
+		if err != nil {
+			t.Errorf("%v: %s", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("got %#v, want %#v", got, test.want)
+		}
+	}
+}
+
+func TestMMDBDecodePointer(t *testing.T) {
+	// a map whose values point to strings stored before it
+	first := mmdbEncode("first")
+	buf := append([]byte(nil), first...)
+	second := len(buf)
+	buf = append(buf, mmdbEncode("second")...)
+	start := len(buf)
+	buf = append(buf, byte(mmdbMap<<5)|2)
+	buf = append(buf, mmdbEncode("a")...)
+	buf = append(buf, byte(mmdbPointer<<5), 0)
+	buf = append(buf, mmdbEncode("b")...)
+	buf = append(buf, byte(mmdbPointer<<5), byte(second))
+	d := mmdbDecoder{buf: buf}
+	got, next, err := d.decode(uint(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"a": "first", "b": "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if next != uint(len(buf)) {
+		t.Errorf("got next %d, want %d", next, len(buf))
+	}
+}
+
+func TestMMDBDecodeErrors(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":            {},
+		"truncated string": {byte(mmdbString<<5) | 5, 'a'},
+		"bad double size":  {byte(mmdbDouble<<5) | 4, 0, 0, 0, 0},
+		"bad map key":      {byte(mmdbMap<<5) | 1, byte(mmdbDouble<<5) | 8, 0, 0, 0, 0, 0, 0, 0, 0, byte(mmdbString << 5)},
+		"truncated map":    {byte(mmdbMap<<5) | 2, byte(mmdbString<<5) | 1, 'a'},
+		"bad pointer":      {byte(mmdbPointer<<5) | 1, 0xff},
+		"unknown type":     {0, 20},
+		"big uint":         {9, 2, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+	}
+	for name, buf := range tests {
+		d := mmdbDecoder{buf: buf}
+		if _, _, err := d.decode(0); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMMDBGet(t *testing.T) {
+	record := map[string]interface{}{
+		"country":      map[string]interface{}{"iso_code": "FR"},
+		"subdivisions": []interface{}{map[string]interface{}{"iso_code": "IDF"}},
+	}
+	tests := []struct {
+		path []interface{}
+		want interface{}
+	}{
+		{[]interface{}{"country", "iso_code"}, "FR"},
+		{[]interface{}{"subdivisions", 0, "iso_code"}, "IDF"},
+		{[]interface{}{"subdivisions", 1, "iso_code"}, nil},
+		{[]interface{}{"country", 0}, nil},
+		{[]interface{}{"city", "names"}, nil},
+		{[]interface{}{"country", "iso_code", "x"}, nil},
+	}
+	for _, test := range tests {
+		if got := mmdbGet(record, test.path...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.path, got, test.want)
+		}
+	}
+	if got := mmdbGet(nil, "country"); got != nil {
+		t.Errorf("nil record: got %v", got)
+	}
+}
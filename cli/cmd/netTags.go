@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var netTagsFile string
+var netTagFields []string
+var netTagDefault string
+
+func addNetTagFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&netTagsFile, "net-tags", "", "CSV (cidr,label) or YAML (label: [cidrs]) file used to add the net.* labels")
+	cmd.Flags().StringArrayVar(&netTagFields, "net-tag-field", []string{"c-ip"}, "IP field to label (can be repeated)")
+	cmd.Flags().StringVar(&netTagDefault, "net-tag-default", "", "label of the IPs that do not belong to any network")
+}
+
+// parseNetwork parses a CIDR, or a single IP as a host network.
+func parseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if strings.IndexByte(s, '/') == -1 {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP: '%s'", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// loadNetTags reads the network labels from a CSV or YAML file. A network
+// can only have one label: the labels of the networks inside a network take
+// precedence, whatever their order in the file.
+func loadNetTags(fname string) (*ipTree, error) {
+	tree := new(ipTree)
+	// labels stores the label of each network, to reject the duplicates
+	labels := make(map[string]string)
+	add := func(where string, s string, label string) error {
+		network, err := parseNetwork(s)
+		if err != nil {
+			return fmt.Errorf("%s: %s", where, err)
+		}
+		if previous, ok := labels[network.String()]; ok {
+			return fmt.Errorf("%s: network '%s' is labelled both '%s' and '%s'", where, network, previous, label)
+		}
+		labels[network.String()] = label
+		tree.insert(network, label)
+		return nil
+	}
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".yml", ".yaml":
+		content, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		// a MapSlice keeps the order of the file
+		var items yaml.MapSlice
+		err = yaml.Unmarshal(content, &items)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			label := fmt.Sprint(item.Key)
+			cidrs, ok := item.Value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: expected a list of networks for '%s'", fname, label)
+			}
+			for _, cidr := range cidrs {
+				err = add(fname, fmt.Sprint(cidr), label)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	default:
+		f, err := os.Open(fname)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = -1
+		r.Comment = '#'
+		for lineno := 1; ; lineno++ {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(record) < 2 {
+				return nil, fmt.Errorf("%s:%d: expected cidr,label", fname, lineno)
+			}
+			if _, err := parseNetwork(record[0]); err != nil && lineno == 1 {
+				// header line
+				continue
+			}
+			err = add(fmt.Sprintf("%s:%d", fname, lineno), record[0], strings.TrimSpace(record[1]))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tree, nil
+}
+
+// netTagEnricher adds the net.<field> label for each configured IP field,
+// according to the network the IP belongs to.
+type netTagEnricher struct {
+	tree     *ipTree
+	ipFields []string
+	dflt     string
+}
+
+func newNetTagEnricher(fname string, ipFields []string, dflt string) (*netTagEnricher, error) {
+	tree, err := loadNetTags(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &netTagEnricher{tree: tree, ipFields: ipFields, dflt: dflt}, nil
+}
+
+func (e *netTagEnricher) Fields(names []string) (added []string, removed []string) {
+	for _, ipField := range e.ipFields {
+		for _, name := range names {
+			if name == ipField {
+				added = append(added, "net."+ipField)
+				break
+			}
+		}
+	}
+	return added, nil
+}
+
+func (e *netTagEnricher) Kind(name string) (parser.Kind, bool) {
+	for _, ipField := range e.ipFields {
+		if name == "net."+ipField {
+			return parser.String, true
+		}
+	}
+	return parser.Invalid, false
+}
+
+func (e *netTagEnricher) Process(l *parser.Line) (bool, error) {
+	for _, ipField := range e.ipFields {
+		if !l.Has(ipField) {
+			continue
+		}
+		ip, ok := l.Get(ipField).(net.IP)
+		if !ok {
+			l.Set("net."+ipField, nil)
+			continue
+		}
+		label, found := e.tree.lookup(ip)
+		if !found {
+			label = e.dflt
+		}
+		l.Set("net."+ipField, nilIfEmpty(label))
+	}
+	return true, nil
+}
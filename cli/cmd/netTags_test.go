@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+func TestLoadNetTags(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	files := map[string]string{
+		"tags.csv": "cidr,label\n# the offices\n10.0.0.0/8,internal\n10.1.0.0/16, vpn\n2001:db8::/32,internal\n203.0.113.9,partner\n",
+		// the networks inside a network win, whatever their order
+		"tags.yaml": "vpn:\n  - 10.1.0.0/16\ninternal:\n  - 10.0.0.0/8\n  - 2001:db8::/32\npartner:\n  - 203.0.113.9\n",
+	}
+	tests := map[string]string{
+		"10.2.3.4":        "internal",
+		"10.1.2.3":        "vpn",
+		"2001:db8::1":     "internal",
+		"203.0.113.9":     "partner",
+		"203.0.113.10":    "",
+		"2001:db9::1":     "",
+		"::ffff:10.1.0.1": "vpn",
+	}
+	for name, content := range files {
+		fname := filepath.Join(dir, name)
+		err := ioutil.WriteFile(fname, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := loadNetTags(fname)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		for ip, want := range tests {
+			if label, _ := tree.lookup(net.ParseIP(ip)); label != want {
+				t.Errorf("%s: %s: got '%s', want '%s'", name, ip, label, want)
+			}
+		}
+	}
+}
+
+func TestLoadNetTagsErrors(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	files := map[string]string{
+		// the same network with two labels
+		"dup.yaml": "internal:\n  - 10.0.0.0/8\nvpn:\n  - 10.1.0.0/16\n  - 10.0.0.0/8\n",
+		// 10.1.2.3/8 is 10.0.0.0/8
+		"dup.csv":     "10.0.0.0/8,internal\n10.1.2.3/8,vpn\n",
+		"list.yaml":   "internal: 10.0.0.0/8\n",
+		"invalid.yml": "internal:\n  - 10.0.0.0/33\n",
+		"syntax.yaml": "internal: [10.0.0.0/8\n",
+		"short.csv":   "10.0.0.0/8\n",
+		"invalid.csv": "cidr,label\n10.0.0.0/8,internal\nlocalhost,local\n",
+	}
+	for name, content := range files {
+		fname := filepath.Join(dir, name)
+		err := ioutil.WriteFile(fname, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadNetTags(fname); err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if strings.HasPrefix(name, "dup") && !strings.Contains(err.Error(), "10.0.0.0/8") {
+			t.Errorf("%s: got %s", name, err)
+		}
+	}
+	if _, err := loadNetTags(filepath.Join(dir, "missing.csv")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestNetTagEnricher(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	fname := filepath.Join(dir, "tags.csv")
+	err := ioutil.WriteFile(fname, []byte("10.0.0.0/8,internal\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newNetTagEnricher(fname, []string{"c-ip", "s-ip"}, "external")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, _ := e.Fields([]string{"date", "c-ip"}); len(added) != 1 || added[0] != "net.c-ip" {
+		t.Errorf("got %v", added)
+	}
+	l := parser.NewLine([]string{"c-ip"})
+	tests := []struct {
+		ip   interface{}
+		want interface{}
+	}{
+		{net.ParseIP("10.0.0.5"), "internal"},
+		{net.ParseIP("203.0.113.9"), "external"},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		l.Set("c-ip", test.ip)
+		keep, err := e.Process(l)
+		if !keep || err != nil {
+			t.Fatalf("got %v %v", keep, err)
+		}
+		if got := l.Get("net.c-ip"); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.ip, got, test.want)
+		}
+		if l.Has("net.s-ip") {
+			t.Error("net.s-ip was added")
+		}
+	}
+}
@@ -15,6 +15,7 @@ var filenames = make([]string, 0)
 var jsonExport bool
 var csvExport bool
 var suffix bool
+var groupHeaders bool
 
 func foreach(sl []string, f func(string) string) (ret []string) {
 	ret = make([]string, 0, len(sl))
@@ -28,17 +29,20 @@ func sanitize(header string) (ret string) {
 	ret = strings.Replace(header, "(", "_", -1)
 	ret = strings.Replace(ret, ")", "_", -1)
 	ret = strings.Replace(ret, "-", "_", -1)
+	ret = strings.Replace(ret, ".", "_", -1)
 	ret = strings.Replace(ret, "__", "_", -1)
 	ret = strings.Trim(ret, "_")
 	return ret
 }
 
 func suffixHeaders(header string) (ret string) {
-	switch parser.GuessType(header) {
+	switch guessType(header) {
 	case parser.MyDate:
 		return header + "_date"
 	case parser.MyIP:
 		return header + "_ip"
+	case parser.MyIPList:
+		return header + "_ips"
 	case parser.MyTime:
 		return header + "_time"
 	case parser.MyTimestamp:
@@ -51,6 +55,10 @@ func suffixHeaders(header string) (ret string) {
 		return header + "_int"
 	case parser.Bool:
 		return header + "_bool"
+	case parser.Map:
+		return header + "_json"
+	case parser.MyGeoPoint:
+		return header + "_geo"
 	case parser.String:
 		return header + "_str"
 	}
@@ -70,6 +78,10 @@ var parseCmd = &cobra.Command{
 		if !jsonExport && !csvExport {
 			jsonExport = true
 		}
+		fatal(buildEnrichers())
+		fatal(buildTimeRange())
+		filenames = pruneFiles(filenames)
+		defer closeEnrichers()
 
 		for _, fname := range filenames {
 			fname = strings.TrimSpace(fname)
@@ -89,12 +101,16 @@ var parseCmd = &cobra.Command{
 }
 
 func doParse(in io.Reader, out io.Writer, doJSON bool, doCSV bool, printSuffix bool) error {
-	p := parser.NewFileParser(in)
+	p := setupParser(parser.NewFileParser(in))
 	err := p.ParseHeader()
 	if err != nil {
 		return err
 	}
-	fieldNames := p.FieldNames()
+	fieldNames := enrichedNames(p)
+	pipeline, err := buildPipeline(p, nil)
+	if err != nil {
+		return err
+	}
 	if doCSV {
 		// print header line
 		if printSuffix {
@@ -110,11 +126,19 @@ func doParse(in io.Reader, out io.Writer, doJSON bool, doCSV bool, printSuffix b
 		}
 	}
 	var l *parser.Line
+	var keep bool
 	for {
 		l, err = p.NextTo(l)
 		if l == nil || err != nil {
 			break
 		}
+		keep, err = pipeline.Process(l)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
 		err = l.WriteTo(out, doJSON)
 		if err != nil {
 			return err
@@ -132,4 +156,20 @@ func init() {
 	parseCmd.Flags().BoolVar(&jsonExport, "json", false, "print the logs as JSON")
 	parseCmd.Flags().BoolVar(&csvExport, "csv", false, "print the logs as CSV")
 	parseCmd.Flags().BoolVar(&suffix, "suffix", false, "when exporting to CSV, suffix the field names with data type")
+	parseCmd.Flags().BoolVar(&groupHeaders, "headers", false, "group the HTTP header fields into request.headers and response.headers")
+	addMapFlags(parseCmd)
+	addEnrichFlags(parseCmd)
+	addWhereFlag(parseCmd)
+	addTimeFlags(parseCmd)
+}
+
+// excludedHeaders returns the HTTP header fields of names that are excluded.
+// They must be cleared from the lines before the headers are grouped.
+func excludedHeaders(names []string, excludes map[string]bool) (ret []string) {
+	for _, name := range names {
+		if excludes[strings.ToLower(name)] && parser.IsHeaderField(name) {
+			ret = append(ret, name)
+		}
+	}
+	return ret
 }
@@ -28,6 +28,9 @@ var parseDirCmd = &cobra.Command{
 		if !jsonExport && !csvExport {
 			jsonExport = true
 		}
+		fatal(buildEnrichers())
+		fatal(buildTimeRange())
+		defer closeEnrichers()
 		curdir, err := os.Getwd()
 		fatal(err)
 		curdir, err = filepath.Abs(curdir)
@@ -50,6 +53,7 @@ var parseDirCmd = &cobra.Command{
 
 		inputFiles, err := findFiles(input, extension)
 		fatal(err)
+		inputFiles = pruneFiles(inputFiles)
 
 		if len(inputFiles) == 0 {
 			fmt.Fprintln(os.Stderr, "No file to process.")
@@ -129,6 +133,11 @@ func init() {
 	parseDirCmd.Flags().BoolVar(&jsonExport, "json", false, "print the logs as JSON")
 	parseDirCmd.Flags().BoolVar(&csvExport, "csv", false, "print the logs as CSV")
 	parseDirCmd.Flags().BoolVar(&suffix, "suffix", false, "when exporting to CSV, suffix the field names with data type")
+	parseDirCmd.Flags().BoolVar(&groupHeaders, "headers", false, "group the HTTP header fields into request.headers and response.headers")
+	addMapFlags(parseDirCmd)
+	addEnrichFlags(parseDirCmd)
+	addWhereFlag(parseDirCmd)
+	addTimeFlags(parseDirCmd)
 }
 
 func findFiles(inputDir string, extension string) (inputFiles []string, err error) {
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"net"
+
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+var parseCookies bool
+var parseQuery bool
+var cookieFilter parser.KeyFilter
+var queryFilter parser.KeyFilter
+var trustedProxies []string
+
+func addMapFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&parseCookies, "cookies", false, "parse the cs(cookie) field into request.cookies")
+	cmd.Flags().StringArrayVar(&cookieFilter.Allow, "cookie-allow", []string{}, "only keep that cookie in request.cookies (can be repeated)")
+	cmd.Flags().StringArrayVar(&cookieFilter.Deny, "cookie-deny", []string{}, "do not keep that cookie in request.cookies (can be repeated)")
+	cmd.Flags().BoolVar(&parseQuery, "query", false, "parse the query string into request.query")
+	cmd.Flags().StringArrayVar(&queryFilter.Allow, "query-allow", []string{}, "only keep that parameter in request.query (can be repeated)")
+	cmd.Flags().StringArrayVar(&queryFilter.Deny, "query-deny", []string{}, "do not keep that parameter in request.query (can be repeated)")
+	cmd.Flags().StringArrayVar(&trustedProxies, "trusted-proxy", []string{}, "IP or CIDR of a trusted proxy, used to compute client.ip from c-ip and X-Forwarded-For (can be repeated)")
+}
+
+// setupParser applies the parsing options given on the command line to p.
+func setupParser(p *parser.FileParser) *parser.FileParser {
+	p.SetGroupHeaders(groupHeaders)
+	if parseCookies || len(cookieFilter.Allow) > 0 || len(cookieFilter.Deny) > 0 {
+		p.SetCookies(&cookieFilter)
+	}
+	if parseQuery || len(queryFilter.Allow) > 0 || len(queryFilter.Deny) > 0 {
+		p.SetQuery(&queryFilter)
+	}
+	if len(trustedProxies) > 0 {
+		networks := make([]*net.IPNet, 0, len(trustedProxies))
+		for _, s := range trustedProxies {
+			network, err := parseNetwork(s)
+			fatal(err)
+			networks = append(networks, network)
+		}
+		p.SetTrustedProxies(networks)
+	}
+	return p
+}
@@ -0,0 +1,383 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/spf13/cobra"
+)
+
+// The periods of the automatic partitions.
+const (
+	periodDay   = "day"
+	periodWeek  = "week"
+	periodMonth = "month"
+)
+
+var autoPartition string
+
+// tablePartitioner creates the missing partitions of the target table. It is
+// nil when --auto-partition is not set.
+var tablePartitioner *partitioner
+
+func addPartitionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&autoPartition, "auto-partition", "", "if the table is partitioned by gmttime, create the missing child partitions: day, week or month")
+	cmd.Flags().BoolVar(&noFullTextIndex, "nofulltext", false, "if set, do not create a full text search index on user-agent field of the created partitions")
+}
+
+func checkAutoPartition() error {
+	switch autoPartition {
+	case "", periodDay, periodWeek, periodMonth:
+		return nil
+	default:
+		return fmt.Errorf("invalid --auto-partition: '%s' (expected day, week or month)", autoPartition)
+	}
+}
+
+// openPartitioner enables the automatic partitions when --auto-partition is
+// set and the table is partitioned.
+func openPartitioner(pool *pgx.ConnPool, excludes map[string]bool) error {
+	if autoPartition == "" {
+		return nil
+	}
+	p, err := newPartitioner(pool, tableName, autoPartition, excludes)
+	if err != nil {
+		return err
+	}
+	tablePartitioner = p
+	return nil
+}
+
+// partitioner creates the missing range partitions of a table partitioned by
+// gmttime. The rows copied into the parent table are then routed to the
+// partitions by Postgres.
+type partitioner struct {
+	mu       sync.Mutex
+	pool     *pgx.ConnPool
+	table    string
+	period   string
+	excludes map[string]bool
+	// existing stores the names of the child partitions
+	existing map[string]bool
+	// covered stores the names of the partitions that were not created,
+	// because their range is covered by partitions with other names
+	covered map[string]bool
+}
+
+// newPartitioner returns the partitioner of a table. It returns nil if the
+// table is not partitioned.
+func newPartitioner(pool *pgx.ConnPool, table string, period string, excludes map[string]bool) (*partitioner, error) {
+	var key string
+	err := pool.QueryRow(
+		`SELECT a.attname FROM pg_partitioned_table pt
+JOIN pg_attribute a ON a.attrelid = pt.partrelid AND a.attnum = pt.partattrs[0]
+WHERE pt.partrelid = $1::regclass AND pt.partstrat = 'r';`,
+		table,
+	).Scan(&key)
+	if err == pgx.ErrNoRows {
+		fmt.Fprintf(os.Stderr, "Table '%s' is not partitioned by range: --auto-partition is ignored\n", table)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key != "gmttime" {
+		return nil, fmt.Errorf("table '%s' is partitioned by '%s': --auto-partition needs a table partitioned by gmttime", table, key)
+	}
+	p := &partitioner{
+		pool:     pool,
+		table:    table,
+		period:   period,
+		excludes: excludes,
+		covered:  make(map[string]bool),
+	}
+	return p, p.loadExisting()
+}
+
+// loadExisting loads the names of the child partitions of the table, that
+// other processes may have created since the last load.
+func (p *partitioner) loadExisting() error {
+	rows, err := p.pool.Query(
+		"SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = $1::regclass;",
+		p.table,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+		existing[name] = true
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+	p.existing = existing
+	return nil
+}
+
+// rangeOf returns the range of the partition that stores the time t.
+func (p *partitioner) rangeOf(t time.Time) (start, end time.Time) {
+	t = t.UTC()
+	switch p.period {
+	case periodMonth:
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	case periodWeek:
+		// the weeks start on monday
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	default:
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// startOf returns the start of the range of the partition that stores the
+// time t, or a zero time for the default partition.
+func (p *partitioner) startOf(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	start, _ := p.rangeOf(t)
+	return start
+}
+
+func (p *partitioner) childName(start time.Time) string {
+	if p.period == periodMonth {
+		return p.table + "_" + start.Format("200601")
+	}
+	return p.table + "_" + start.Format("20060102")
+}
+
+func (p *partitioner) defaultName() string {
+	return p.table + "_default"
+}
+
+// has returns true if the partition exists, or if its range is covered by
+// other partitions.
+func (p *partitioner) has(name string) bool {
+	return p.existing[name] || p.covered[name]
+}
+
+// missing returns true if some of the partitions that start at the given
+// times, as returned by startOf, do not exist.
+func (p *partitioner) missing(starts map[time.Time]bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for start := range starts {
+		if start.IsZero() {
+			if !p.has(p.defaultName()) {
+				return true
+			}
+			continue
+		}
+		if !p.has(p.childName(start)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensure creates the partitions that start at the given times, as returned by
+// startOf. A zero time needs the default partition, that stores the rows
+// without gmttime. fNames are the fields of the rows, used to create the
+// indexes.
+func (p *partitioner) ensure(starts map[time.Time]bool, fNames []string) error {
+	needDefault := false
+	sorted := make([]time.Time, 0, len(starts))
+	for start := range starts {
+		if start.IsZero() {
+			needDefault = true
+			continue
+		}
+		sorted = append(sorted, start)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Before(sorted[j]) })
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loaded := false
+	for _, start := range sorted {
+		name := p.childName(start)
+		if p.has(name) {
+			continue
+		}
+		if !loaded {
+			// the partition may have been created by another process
+			err := p.loadExisting()
+			if err != nil {
+				return err
+			}
+			loaded = true
+			if p.has(name) {
+				continue
+			}
+		}
+		_, end := p.rangeOf(start)
+		err := p.create(name, buildCreateChildStmt(name, p.table, pgTimestamp(start), pgTimestamp(end)), start, end, fNames)
+		if err != nil {
+			return err
+		}
+	}
+	name := p.defaultName()
+	if !needDefault || p.has(name) {
+		return nil
+	}
+	if !loaded {
+		err := p.loadExisting()
+		if err != nil || p.has(name) {
+			return err
+		}
+	}
+	return p.create(name, fmt.Sprintf("CREATE TABLE %s PARTITION OF %s DEFAULT;", name, p.table), time.Time{}, time.Time{}, fNames)
+}
+
+// create creates a child partition and its indexes, in a transaction. start
+// and end are the range of the partition, or zero times for the default
+// partition.
+func (p *partitioner) create(name string, createStmt string, start, end time.Time, fNames []string) error {
+	txn, err := p.begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+	_, err = txn.Exec(createStmt)
+	if pgErr, ok := err.(pgx.PgError); ok {
+		switch pgErr.Code {
+		case "42P07":
+			// a table with that name exists: it must be a partition that
+			// has been created by another process
+			txn.Rollback()
+			err = p.loadExisting()
+			if err != nil {
+				return err
+			}
+			if !p.existing[name] {
+				return fmt.Errorf("cannot create partition '%s': a table with that name exists, but it is not a partition of '%s'", name, p.table)
+			}
+			return nil
+		case "42P17":
+			// the range is covered by partitions created by hand, or by
+			// another process with another period
+			p.covered[name] = true
+			return nil
+		case "23514":
+			// the default partition holds rows in the range
+			txn.Rollback()
+			return p.createFromDefault(name, createStmt, start, end, fNames)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = p.createIndexes(txn, name, fNames)
+	if err != nil {
+		return err
+	}
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Partition '%s' has been created\n", name)
+	p.existing[name] = true
+	return nil
+}
+
+// createFromDefault creates a child partition when the default partition holds
+// rows in its range: the default partition is detached, the child partition
+// is created, the rows are moved from the default partition to the child
+// partition, and the default partition is attached again, in a transaction.
+func (p *partitioner) createFromDefault(name string, createStmt string, start, end time.Time, fNames []string) error {
+	txn, err := p.begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+	var dflt string
+	err = txn.QueryRow(
+		"SELECT c.relname FROM pg_partitioned_table pt JOIN pg_class c ON c.oid = pt.partdefid WHERE pt.partrelid = $1::regclass;",
+		p.table,
+	).Scan(&dflt)
+	if err != nil {
+		return fmt.Errorf("cannot create partition '%s': finding the default partition of '%s': %s", name, p.table, err)
+	}
+	_, err = txn.Exec(fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s;", p.table, dflt))
+	if err != nil {
+		return fmt.Errorf("cannot create partition '%s': detaching the default partition '%s': %s", name, dflt, err)
+	}
+	_, err = txn.Exec(createStmt)
+	if err != nil {
+		return err
+	}
+	tag, err := txn.Exec(
+		fmt.Sprintf(
+			"WITH moved AS (DELETE FROM %s WHERE gmttime >= $1 AND gmttime < $2 RETURNING *) INSERT INTO %s SELECT * FROM moved;",
+			dflt, name,
+		),
+		start, end,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot create partition '%s': moving the rows of the default partition '%s': %s", name, dflt, err)
+	}
+	_, err = txn.Exec(fmt.Sprintf("ALTER TABLE %s ATTACH PARTITION %s DEFAULT;", p.table, dflt))
+	if err != nil {
+		return fmt.Errorf("cannot create partition '%s': attaching the default partition '%s' again: %s", name, dflt, err)
+	}
+	err = p.createIndexes(txn, name, fNames)
+	if err != nil {
+		return err
+	}
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Partition '%s' has been created, and %d rows have been moved from '%s'\n", name, tag.RowsAffected(), dflt)
+	p.existing[name] = true
+	return nil
+}
+
+// begin starts the transaction that creates a partition.
+func (p *partitioner) begin() (*pgx.Tx, error) {
+	txn, err := p.pool.BeginEx(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// the creation waits for the transactions that copy rows into the table:
+	// fail instead of waiting forever for a transaction that waits for us
+	_, err = txn.Exec("SET LOCAL lock_timeout = '5min';")
+	if err != nil {
+		txn.Rollback()
+		return nil, err
+	}
+	return txn, nil
+}
+
+func (p *partitioner) createIndexes(txn *pgx.Tx, name string, fNames []string) error {
+	for _, fName := range fNames {
+		indexStmt := buildIndexStmt(name, fName, p.excludes, true, noFullTextIndex)
+		if len(indexStmt) == 0 {
+			continue
+		}
+		_, err := txn.Exec(indexStmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pgTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05-07")
+}
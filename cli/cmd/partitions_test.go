@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPartitionRange(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		paris = time.FixedZone("CET", 3600)
+	}
+	tests := []struct {
+		period string
+		t      time.Time
+		start  time.Time
+		end    time.Time
+	}{
+		{periodDay, time.Date(2024, 3, 1, 13, 45, 0, 0, time.UTC), date(2024, 3, 1), date(2024, 3, 2)},
+		{periodDay, date(2024, 2, 29), date(2024, 2, 29), date(2024, 3, 1)},
+		{periodDay, time.Date(2024, 12, 31, 23, 59, 59, 999999999, time.UTC), date(2024, 12, 31), date(2025, 1, 1)},
+		// the times are converted to UTC
+		{periodDay, time.Date(2024, 3, 2, 0, 30, 0, 0, paris), date(2024, 3, 1), date(2024, 3, 2)},
+		{"", date(2024, 3, 1), date(2024, 3, 1), date(2024, 3, 2)},
+
+		// 2024-03-01 is a friday
+		{periodWeek, time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC), date(2024, 2, 26), date(2024, 3, 4)},
+		// monday starts a week
+		{periodWeek, date(2024, 3, 4), date(2024, 3, 4), date(2024, 3, 11)},
+		// sunday ends it
+		{periodWeek, time.Date(2024, 3, 10, 23, 59, 59, 0, time.UTC), date(2024, 3, 4), date(2024, 3, 11)},
+		{periodWeek, date(2025, 1, 1), date(2024, 12, 30), date(2025, 1, 6)},
+
+		{periodMonth, time.Date(2024, 3, 31, 23, 59, 59, 0, time.UTC), date(2024, 3, 1), date(2024, 4, 1)},
+		{periodMonth, date(2024, 2, 29), date(2024, 2, 1), date(2024, 3, 1)},
+		{periodMonth, date(2024, 12, 15), date(2024, 12, 1), date(2025, 1, 1)},
+		{periodMonth, time.Date(2024, 5, 1, 0, 30, 0, 0, paris), date(2024, 4, 1), date(2024, 5, 1)},
+	}
+	for _, test := range tests {
+		p := &partitioner{table: "accesslogs", period: test.period}
+		start, end := p.rangeOf(test.t)
+		if !start.Equal(test.start) || !end.Equal(test.end) || start.Location() != time.UTC {
+			t.Errorf("%s %v: got [%v, %v), want [%v, %v)", test.period, test.t, start, end, test.start, test.end)
+		}
+		if got := p.startOf(test.t); !got.Equal(test.start) {
+			t.Errorf("%s %v: got start %v", test.period, test.t, got)
+		}
+	}
+
+	// the rows without time go to the default partition
+	p := &partitioner{table: "accesslogs", period: periodWeek}
+	if start := p.startOf(time.Time{}); !start.IsZero() {
+		t.Errorf("got %v", start)
+	}
+}
+
+func TestPartitionChildName(t *testing.T) {
+	tests := []struct {
+		period string
+		start  time.Time
+		want   string
+	}{
+		{periodDay, date(2024, 3, 1), "accesslogs_20240301"},
+		{periodWeek, date(2024, 2, 26), "accesslogs_20240226"},
+		{periodMonth, date(2024, 3, 1), "accesslogs_202403"},
+		{periodMonth, date(2025, 1, 1), "accesslogs_202501"},
+	}
+	for _, test := range tests {
+		p := &partitioner{table: "accesslogs", period: test.period}
+		if got := p.childName(test.start); got != test.want {
+			t.Errorf("%s %v: got %s, want %s", test.period, test.start, got, test.want)
+		}
+	}
+	p := &partitioner{table: "accesslogs", period: periodDay}
+	if got := p.defaultName(); got != "accesslogs_default" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestPartitionMissing(t *testing.T) {
+	p := &partitioner{
+		table:    "accesslogs",
+		period:   periodDay,
+		existing: map[string]bool{"accesslogs_20240301": true},
+		covered:  map[string]bool{"accesslogs_20240302": true},
+	}
+	tests := []struct {
+		starts []time.Time
+		want   bool
+	}{
+		{[]time.Time{date(2024, 3, 1)}, false},
+		// covered by a partition with another name
+		{[]time.Time{date(2024, 3, 1), date(2024, 3, 2)}, false},
+		{[]time.Time{date(2024, 3, 1), date(2024, 3, 3)}, true},
+		{[]time.Time{{}}, true},
+	}
+	for _, test := range tests {
+		starts := make(map[time.Time]bool)
+		for _, start := range test.starts {
+			starts[start] = true
+		}
+		if got := p.missing(starts); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.starts, got, test.want)
+		}
+	}
+	p.existing[p.defaultName()] = true
+	if p.missing(map[time.Time]bool{{}: true}) {
+		t.Error("the default partition is missing")
+	}
+}
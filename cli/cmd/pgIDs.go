@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/jackc/pgx"
+	uuid "github.com/satori/go.uuid"
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+// The ID modes of the Postgres rows.
+const (
+	// idModeRandom gives every row a new time-based UUID.
+	idModeRandom = "random"
+	// idModeOffset derives the ID from the identity of the file and the byte
+	// offset of the line in the file.
+	idModeOffset = "offset"
+	// idModeContent derives the ID from the content of the line.
+	idModeContent = "content"
+)
+
+var idMode string
+
+// idNamespace is the UUID namespace of the deterministic row IDs.
+var idNamespace = uuid.NewV5(uuid.NamespaceURL, "https://github.com/stephane-martin/w3c-extendedlog-parser")
+
+func addIDModeFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&idMode, "id-mode", idModeRandom, "how the row IDs are computed: random, offset (file content and byte offset) or content (identical lines are stored once); offset and content make the ingestion idempotent")
+}
+
+func checkIDMode() error {
+	switch idMode {
+	case idModeRandom, idModeOffset, idModeContent:
+		return nil
+	default:
+		return fmt.Errorf("invalid --id-mode: '%s' (expected random, offset or content)", idMode)
+	}
+}
+
+// deterministicIDs returns true if the row IDs do not change when a file is
+// uploaded again.
+func deterministicIDs() bool {
+	return idMode == idModeOffset || idMode == idModeContent
+}
+
+// idBlockSize is the maximum size of the beginning of a file that identifies
+// the file.
+const idBlockSize = 4096
+
+// rowIDs computes the IDs of the rows of a log file. It also counts the lines
+// read from the file.
+type rowIDs struct {
+	source   string
+	identity string
+	lineNum  int
+}
+
+// newRowIDs returns the ID generator for the given file. The file is
+// identified by the checksum of its beginning in the offset mode, so that the
+// IDs do not depend on the path of the file.
+func newRowIDs(fname string) (*rowIDs, error) {
+	source, err := filepath.Abs(fname)
+	if err != nil {
+		source = fname
+	}
+	g := &rowIDs{source: source}
+	if idMode == idModeOffset {
+		g.identity, err = fileIdentity(fname)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// fileIdentity returns the checksum of the header and of the first log line
+// of a file, within its first idBlockSize bytes. It does not change when the
+// file is renamed or rotated, nor when lines are appended to it.
+func fileIdentity(fname string) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	block := make([]byte, idBlockSize)
+	n, err := io.ReadFull(f, block)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	block = block[:n]
+	// stop after the first line that is not a directive
+	for start := 0; start < len(block); {
+		end := bytes.IndexByte(block[start:], '\n')
+		if end == -1 {
+			break
+		}
+		end += start + 1
+		line := bytes.TrimSpace(block[start:end])
+		if len(line) > 0 && line[0] != '#' {
+			block = block[:end]
+			break
+		}
+		start = end
+	}
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// next returns the ID of the next line of the file, that is read from the
+// given byte offset. It must be called for every line, before the line is
+// transformed.
+func (g *rowIDs) next(l *parser.Line, offset int64) (uuid.UUID, error) {
+	g.lineNum++
+	switch idMode {
+	case idModeOffset:
+		return uuid.NewV5(idNamespace, g.identity+":"+strconv.FormatInt(offset, 10)), nil
+	case idModeContent:
+		content, err := l.MarshalJSON()
+		if err != nil {
+			return uuid.Nil, err
+		}
+		return uuid.NewV5(idNamespace, string(content)), nil
+	default:
+		return uuid.NewV1(), nil
+	}
+}
+
+// stagingTable returns the name of the temporary table that receives the
+// rows before they are merged into the target table.
+func stagingTable(tName string) string {
+	return tName + "_staging"
+}
+
+// buildStagingStmt returns the statement that creates the staging table of
+// the current transaction.
+func buildStagingStmt(tName string) string {
+	return fmt.Sprintf(
+		"CREATE TEMPORARY TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP;",
+		pgx.Identifier{stagingTable(tName)}.Sanitize(),
+		pgx.Identifier{tName}.Sanitize(),
+	)
+}
+
+// buildTruncateStagingStmt returns the statement that empties the staging
+// table, after its rows have been merged.
+func buildTruncateStagingStmt(tName string) string {
+	return fmt.Sprintf("TRUNCATE %s;", pgx.Identifier{stagingTable(tName)}.Sanitize())
+}
+
+// buildMergeStmt returns the statement that copies the rows of the staging
+// table into the target table, skipping the rows that are already there.
+func buildMergeStmt(tName string, columnNames []string) string {
+	columns := ""
+	for i, name := range columnNames {
+		if i > 0 {
+			columns += ", "
+		}
+		columns += pgx.Identifier{name}.Sanitize()
+	}
+	return fmt.Sprintf(
+		"INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT DO NOTHING;",
+		pgx.Identifier{tName}.Sanitize(),
+		columns,
+		columns,
+		pgx.Identifier{stagingTable(tName)}.Sanitize(),
+	)
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+const idTestLog = `#Software: Microsoft Internet Information Services 10.0
+#Fields: date time c-ip cs-uri-stem sc-status
+2024-03-01 00:00:01 10.0.0.5 /index.html 200
+2024-03-01 00:00:02 10.0.0.6 /about.html 404
+`
+
+// withIDMode sets --id-mode for the duration of a test.
+func withIDMode(mode string) func() {
+	previous := idMode
+	idMode = mode
+	return func() { idMode = previous }
+}
+
+func writeIDTestFiles(t *testing.T, dir string, contents map[string]string) {
+	for name, content := range contents {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRowIDsOffset(t *testing.T) {
+	defer withIDMode(idModeOffset)()
+	dir, clean := tempDir(t)
+	defer clean()
+	writeIDTestFiles(t, dir, map[string]string{
+		"u_ex240301.log": idTestLog,
+		// the same file, renamed
+		"u_ex240301.log.1": idTestLog,
+		// the same file, with more lines
+		"appended.log": idTestLog + "2024-03-01 00:00:03 10.0.0.7 /index.html 200\n",
+		// another file with the same header
+		"other.log": "#Software: Microsoft Internet Information Services 10.0\n#Fields: date time c-ip cs-uri-stem sc-status\n2024-03-02 00:00:01 10.0.0.5 /index.html 200\n",
+	})
+	ids := make(map[string]*rowIDs)
+	for _, name := range []string{"u_ex240301.log", "u_ex240301.log.1", "appended.log", "other.log"} {
+		g, err := newRowIDs(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.source != filepath.Join(dir, name) {
+			t.Errorf("got source '%s'", g.source)
+		}
+		ids[name] = g
+	}
+
+	l := parser.NewLine(nil)
+	first, _ := ids["u_ex240301.log"].next(l, 87)
+	second, _ := ids["u_ex240301.log"].next(l, 130)
+	if first == second {
+		t.Error("two offsets give the same ID")
+	}
+	if first.Version() != uuid.V5 {
+		t.Errorf("got version %d", first.Version())
+	}
+	if n := ids["u_ex240301.log"].lineNum; n != 2 {
+		t.Errorf("got %d lines, want 2", n)
+	}
+	for _, name := range []string{"u_ex240301.log.1", "appended.log"} {
+		if id, _ := ids[name].next(l, 87); id != first {
+			t.Errorf("%s: got %s, want %s", name, id, first)
+		}
+	}
+	if id, _ := ids["other.log"].next(l, 87); id == first {
+		t.Error("two files give the same ID")
+	}
+
+	// the IDs are stable between runs
+	g, err := newRowIDs(filepath.Join(dir, "u_ex240301.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := g.next(l, 87); id != first {
+		t.Errorf("got %s, want %s", id, first)
+	}
+
+	if _, err := newRowIDs(filepath.Join(dir, "missing.log")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestRowIDsContent(t *testing.T) {
+	defer withIDMode(idModeContent)()
+	g := &rowIDs{}
+	l := parser.NewLine([]string{"c-ip", "sc-status"})
+	l.Set("c-ip", "10.0.0.5")
+	l.Set("sc-status", int64(200))
+	first, err := g.next(l, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same line at another offset
+	second, _ := g.next(l, 4096)
+	if first != second {
+		t.Errorf("got %s and %s", first, second)
+	}
+	l.Set("sc-status", int64(404))
+	if third, _ := g.next(l, 0); third == first {
+		t.Error("two lines give the same ID")
+	}
+}
+
+func TestRowIDsRandom(t *testing.T) {
+	defer withIDMode(idModeRandom)()
+	if deterministicIDs() {
+		t.Error("random IDs are deterministic")
+	}
+	g := &rowIDs{}
+	l := parser.NewLine(nil)
+	first, _ := g.next(l, 0)
+	second, _ := g.next(l, 0)
+	if first == second || first.Version() != uuid.V1 {
+		t.Errorf("got %s and %s", first, second)
+	}
+}
+
+func TestStagingStmts(t *testing.T) {
+	tests := map[string]string{
+		buildStagingStmt("accesslogs"):                                    `CREATE TEMPORARY TABLE "accesslogs_staging" (LIKE "accesslogs" INCLUDING DEFAULTS) ON COMMIT DROP;`,
+		buildTruncateStagingStmt("accesslogs"):                            `TRUNCATE "accesslogs_staging";`,
+		buildMergeStmt("accesslogs", []string{"id", "c_ip", "sc_status"}): `INSERT INTO "accesslogs" ("id", "c_ip", "sc_status") SELECT "id", "c_ip", "sc_status" FROM "accesslogs_staging" ON CONFLICT DO NOTHING;`,
+	}
+	for got, want := range tests {
+		if got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
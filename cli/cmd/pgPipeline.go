@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx"
+	"github.com/spf13/cobra"
+)
+
+var copiers uint8
+var queueSize int
+
+// errAborted is returned for the batches that follow a failed batch.
+var errAborted = errors.New("aborted after the failure of a previous batch")
+
+func addPipelineFlags(cmd *cobra.Command) {
+	cmd.Flags().Uint8Var(&copiers, "copiers", 1, "number of concurrent COPY connections per file")
+	cmd.Flags().IntVar(&queueSize, "queue", 2, "number of parsed batches that can wait for a COPY connection")
+}
+
+func checkPipeline() {
+	if copiers == 0 {
+		copiers = 1
+	}
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+	if copiers > 1 && idMode == idModeContent {
+		// two batches with the same line would wait for each other
+		fmt.Fprintln(os.Stderr, "--id-mode content needs the batches to be copied one at a time: --copiers is set to 1")
+		copiers = 1
+	}
+}
+
+// pgBatch is a batch of rows of a file, queued for upload.
+type pgBatch struct {
+	seq  int
+	rows *Rows
+	// positions stores the position of the line of each row
+	positions []checkpoint
+	// end is the position after the last line of the batch
+	end checkpoint
+	// invalid stores the lines before end that could not be converted to
+	// rows, to be written to the dead-letter file with the batch.
+	invalid []deadRecord
+}
+
+func newPGBatch(seq int, rows *Rows, end checkpoint) *pgBatch {
+	return &pgBatch{seq: seq, rows: rows, positions: make([]checkpoint, 0, rows.maxSize), end: end}
+}
+
+// rowDataError returns true if err is caused by the content of a row:
+// data_exception (class 22) or integrity_constraint_violation (class 23).
+func rowDataError(err error) bool {
+	e, ok := err.(pgx.PgError)
+	return ok && (strings.HasPrefix(e.Code, "22") || strings.HasPrefix(e.Code, "23"))
+}
+
+// copyBisect copies the rows lo to hi in a savepoint. When the copy fails
+// because of the content of the rows, the rows are split in two halves that
+// are copied separately, until the failing rows are isolated and passed to
+// reject. Any other error fails the whole batch. It returns the number of
+// inserted rows.
+func copyBisect(txn execer, lo int, hi int, copyRows func(lo int, hi int) (int, error), reject func(i int, err error)) (int, error) {
+	_, err := txn.Exec("SAVEPOINT bisect;")
+	if err != nil {
+		return 0, err
+	}
+	inserted, err := copyRows(lo, hi)
+	if err == nil {
+		_, err = txn.Exec("RELEASE SAVEPOINT bisect;")
+		return inserted, err
+	}
+	if !rowDataError(err) {
+		return 0, err
+	}
+	_, rerr := txn.Exec("ROLLBACK TO SAVEPOINT bisect; RELEASE SAVEPOINT bisect;")
+	if rerr != nil {
+		return 0, rerr
+	}
+	if hi-lo == 1 {
+		reject(lo, err)
+		return 0, nil
+	}
+	mid := (lo + hi) / 2
+	first, err := copyBisect(txn, lo, mid, copyRows, reject)
+	if err != nil {
+		return 0, err
+	}
+	second, err := copyBisect(txn, mid, hi, copyRows, reject)
+	if err != nil {
+		return 0, err
+	}
+	return first + second, nil
+}
+
+// commitOrder makes the batches of a file commit in order, so that the
+// checkpoint saved with a batch never covers an uncommitted batch. After a
+// batch fails, the next batches are not committed.
+type commitOrder struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	next int
+	err  error
+}
+
+func newCommitOrder() *commitOrder {
+	o := &commitOrder{}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+// wait blocks until all the batches before seq have been committed. It
+// returns errAborted if a batch failed.
+func (o *commitOrder) wait(seq int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for o.err == nil && o.next != seq {
+		o.cond.Wait()
+	}
+	if o.err != nil {
+		return errAborted
+	}
+	return nil
+}
+
+// done records that the batch seq has been committed, or that it failed if
+// err is not nil.
+func (o *commitOrder) done(seq int, err error) {
+	o.mu.Lock()
+	if err != nil {
+		if o.err == nil {
+			o.err = err
+		}
+	} else {
+		o.next = seq + 1
+	}
+	o.cond.Broadcast()
+	o.mu.Unlock()
+}
+
+func (o *commitOrder) failed() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err
+}
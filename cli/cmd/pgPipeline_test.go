@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// fakeTx records the statements of copyBisect.
+type fakeTx struct {
+	stmts []string
+}
+
+func (tx *fakeTx) Exec(sql string, arguments ...interface{}) (pgx.CommandTag, error) {
+	tx.stmts = append(tx.stmts, sql)
+	return "", nil
+}
+
+// fakeCopy returns a copy function that fails with err when the rows contain
+// one of the bad rows.
+func fakeCopy(bad map[int]bool, err error, calls *int) func(lo int, hi int) (int, error) {
+	return func(lo int, hi int) (int, error) {
+		*calls++
+		for i := lo; i < hi; i++ {
+			if bad[i] {
+				return 0, err
+			}
+		}
+		return hi - lo, nil
+	}
+}
+
+func TestCopyBisect(t *testing.T) {
+	tests := []struct {
+		n        int
+		bad      []int
+		code     string
+		rejected []int
+	}{
+		{8, nil, "22P02", nil},
+		// invalid_text_representation
+		{8, []int{3}, "22P02", []int{3}},
+		// not_null_violation
+		{8, []int{0, 7}, "23502", []int{0, 7}},
+		{5, []int{0, 1, 2, 3, 4}, "23505", []int{0, 1, 2, 3, 4}},
+		{1, []int{0}, "22001", []int{0}},
+	}
+	for _, test := range tests {
+		bad := make(map[int]bool)
+		for _, i := range test.bad {
+			bad[i] = true
+		}
+		var calls int
+		var rejected []int
+		tx := &fakeTx{}
+		inserted, err := copyBisect(tx, 0, test.n, fakeCopy(bad, pgx.PgError{Code: test.code}, &calls), func(i int, err error) {
+			rejected = append(rejected, i)
+		})
+		if err != nil {
+			t.Errorf("%v: %s", test.bad, err)
+			continue
+		}
+		if inserted != test.n-len(test.bad) {
+			t.Errorf("%v: got %d inserted rows, want %d", test.bad, inserted, test.n-len(test.bad))
+		}
+		if !reflect.DeepEqual(rejected, test.rejected) {
+			t.Errorf("%v: got %v rejected rows", test.bad, rejected)
+		}
+		// each copy is in its savepoint
+		if len(tx.stmts) != 2*calls {
+			t.Errorf("%v: got %d statements for %d copies", test.bad, len(tx.stmts), calls)
+		}
+	}
+}
+
+func TestCopyBisectFails(t *testing.T) {
+	errs := []error{
+		// undefined_column
+		pgx.PgError{Code: "42703"},
+		// connection_failure
+		pgx.PgError{Code: "08006"},
+		// deadlock_detected
+		pgx.PgError{Code: "40P01"},
+		errors.New("conn closed"),
+	}
+	for _, copyErr := range errs {
+		var calls int
+		tx := &fakeTx{}
+		_, err := copyBisect(tx, 0, 8, fakeCopy(map[int]bool{3: true}, copyErr, &calls), func(i int, err error) {
+			t.Errorf("%v: row %d rejected", copyErr, i)
+		})
+		if err != copyErr {
+			t.Errorf("got %v, want %v", err, copyErr)
+		}
+		// the batch is not split
+		if calls != 1 {
+			t.Errorf("%v: got %d copies", copyErr, calls)
+		}
+	}
+}
+
+func TestCommitOrder(t *testing.T) {
+	o := newCommitOrder()
+	const n = 8
+	var mu sync.Mutex
+	var committed []int
+	var wg sync.WaitGroup
+	// the batches are ready in the reverse order
+	for seq := n - 1; seq >= 0; seq-- {
+		wg.Add(1)
+		go func(seq int) {
+			defer wg.Done()
+			err := o.wait(seq)
+			if err != nil {
+				t.Errorf("batch %d: %s", seq, err)
+				return
+			}
+			mu.Lock()
+			committed = append(committed, seq)
+			mu.Unlock()
+			o.done(seq, nil)
+		}(seq)
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	for i, seq := range committed {
+		if seq != i {
+			t.Fatalf("got commit order %v", committed)
+		}
+	}
+	if len(committed) != n || o.failed() != nil {
+		t.Errorf("got %v %v", committed, o.failed())
+	}
+}
+
+func TestCommitOrderFailed(t *testing.T) {
+	o := newCommitOrder()
+	batchErr := errors.New("batch 1 failed")
+	results := make(chan error, 3)
+	// the batches after the failed one are waiting
+	for _, seq := range []int{2, 3} {
+		go func(seq int) {
+			results <- o.wait(seq)
+		}(seq)
+	}
+	if err := o.wait(0); err != nil {
+		t.Fatal(err)
+	}
+	o.done(0, nil)
+	if err := o.wait(1); err != nil {
+		t.Fatal(err)
+	}
+	o.done(1, batchErr)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err != errAborted {
+				t.Errorf("got %v, want errAborted", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the waiting batches were not stopped")
+		}
+	}
+	// the next batches do not wait, and the first error is kept
+	if err := o.wait(4); err != errAborted {
+		t.Errorf("got %v, want errAborted", err)
+	}
+	o.done(4, errors.New("another error"))
+	if err := o.failed(); err != batchErr {
+		t.Errorf("got %v, want %v", err, batchErr)
+	}
+}
@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/spf13/cobra"
+)
+
+var maxAge string
+var dryRun bool
+var detachOnly bool
+var archiveDir string
+
+var pgRetentionCmd = &cobra.Command{
+	Use:   "pg-retention",
+	Short: "Detach and drop the partitions of a postgres table that are older than a given age",
+	Long: `Detach and drop the child partitions of a table created by create-table --partition.
+A partition is expired when the end of its range is older than --max-age. The
+default partition and the partitions without an upper bound are always kept.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dbURI = strings.TrimSpace(dbURI)
+		tableName = strings.TrimSpace(tableName)
+		if len(dbURI) == 0 || len(tableName) == 0 {
+			fatal(errors.New("Empty uri or tablename"))
+		}
+		if !validName(tableName) {
+			fatal(errors.New("invalid table name"))
+		}
+		age, err := parseAge(maxAge)
+		fatal(err)
+		if len(archiveDir) > 0 {
+			infos, err := os.Stat(archiveDir)
+			fatal(err)
+			if !infos.IsDir() {
+				fatal(fmt.Errorf("'%s' is not a directory", archiveDir))
+			}
+		}
+
+		config, err := pgx.ParseConnectionString(dbURI)
+		fatal(err)
+		conn, err := pgx.Connect(config)
+		fatal(err)
+		defer conn.Close()
+
+		parts, err := listPartitions(conn, tableName)
+		fatal(err)
+		if len(parts) == 0 {
+			fmt.Fprintf(os.Stderr, "table '%s' has no partitions\n", tableName)
+			return
+		}
+		limit := time.Now().UTC().Add(-age)
+		for _, part := range parts {
+			expired := part.expired(limit)
+			if dryRun {
+				action := "keep"
+				if expired {
+					action = "drop"
+					if detachOnly {
+						action = "detach"
+					}
+				}
+				fmt.Printf("%s\t%s\t%s\n", part.name, part.bounds, action)
+				continue
+			}
+			if !expired {
+				continue
+			}
+			fatal(retirePartition(conn, tableName, part))
+		}
+	},
+}
+
+// partition is a child partition of a table.
+type partition struct {
+	name   string
+	bounds string
+	// end is the upper bound of the range. It is zero for the default
+	// partition and for the ranges that end at MAXVALUE.
+	end time.Time
+}
+
+func (p partition) expired(limit time.Time) bool {
+	return !p.end.IsZero() && !p.end.After(limit)
+}
+
+var rangeEndRe = regexp.MustCompile(`TO \('([^']+)'\)`)
+
+// listPartitions returns the child partitions of a table, ordered by name.
+func listPartitions(conn *pgx.Conn, table string) ([]partition, error) {
+	// the bounds are printed in the session time zone
+	_, err := conn.Exec("SET TIME ZONE 'UTC';")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(
+		`SELECT c.relname, pg_get_expr(c.relpartbound, c.oid) FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = $1::regclass ORDER BY c.relname;`,
+		table,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var parts []partition
+	for rows.Next() {
+		var part partition
+		err = rows.Scan(&part.name, &part.bounds)
+		if err != nil {
+			return nil, err
+		}
+		if m := rangeEndRe.FindStringSubmatch(part.bounds); m != nil {
+			part.end, err = parseBound(m[1])
+			if err != nil {
+				return nil, fmt.Errorf("partition '%s': %s", part.name, err)
+			}
+		}
+		parts = append(parts, part)
+	}
+	return parts, rows.Err()
+}
+
+func parseBound(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05-07", "2006-01-02 15:04:05.999999-07", "2006-01-02 15:04:05", "2006-01-02"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unsupported range bound: '%s'", s)
+}
+
+// retirePartition detaches the partition, so that no row is inserted into it
+// anymore, then archives the detached table if --archive-dir is set, and
+// drops it unless --detach-only is set. A partition that could not be
+// archived is left detached.
+func retirePartition(conn *pgx.Conn, parent string, part partition) error {
+	_, err := conn.Exec(fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s;", parent, part.name))
+	if err != nil {
+		return err
+	}
+	if len(archiveDir) > 0 {
+		err = archivePartition(conn, part.name)
+		if err != nil {
+			return fmt.Errorf("partition '%s' has been detached, but not archived: %s", part.name, err)
+		}
+	}
+	if detachOnly {
+		fmt.Fprintf(os.Stderr, "partition '%s' has been detached\n", part.name)
+		return nil
+	}
+	_, err = conn.Exec(fmt.Sprintf("DROP TABLE %s;", part.name))
+	if err != nil {
+		return fmt.Errorf("partition '%s' has been detached, but not dropped: %s", part.name, err)
+	}
+	fmt.Fprintf(os.Stderr, "partition '%s' has been dropped\n", part.name)
+	return nil
+}
+
+// archivePartition exports the rows of the partition to a CSV file in
+// --archive-dir. The file is renamed when the export is complete, so that a
+// failed export does not leave a truncated archive.
+func archivePartition(conn *pgx.Conn, name string) error {
+	fname := filepath.Join(archiveDir, name+".csv")
+	tmpName := fname + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	_, err = conn.CopyToWriter(f, fmt.Sprintf("COPY %s TO STDOUT WITH (FORMAT csv, HEADER true);", name))
+	if err != nil {
+		f.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	err = os.Rename(tmpName, fname)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "partition '%s' has been archived to '%s'\n", name, fname)
+	return nil
+}
+
+// parseAge parses an age such as 90d, 12w or 36h.
+func parseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return 0, errors.New("--max-age is required")
+	}
+	var age time.Duration
+	switch s[len(s)-1] {
+	case 'd', 'w':
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid --max-age: '%s'", s)
+		}
+		age = time.Duration(n) * 24 * time.Hour
+		if s[len(s)-1] == 'w' {
+			age *= 7
+		}
+	default:
+		var err error
+		age, err = time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid --max-age: '%s'", s)
+		}
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("invalid --max-age: '%s'", s)
+	}
+	return age, nil
+}
+
+func init() {
+	rootCmd.AddCommand(pgRetentionCmd)
+	pgRetentionCmd.Flags().StringVar(&tableName, "tablename", "accesslogs", "name of the partitioned table")
+	pgRetentionCmd.Flags().StringVar(&dbURI, "uri", "", "the URI of the postgresql server to connect to")
+	pgRetentionCmd.Flags().StringVar(&maxAge, "max-age", "", "the partitions whose range ends before that age are expired (for example 90d, 12w or 36h)")
+	pgRetentionCmd.Flags().BoolVar(&dryRun, "dry-run", false, "list the partitions and what would be done, without changing anything")
+	pgRetentionCmd.Flags().BoolVar(&detachOnly, "detach-only", false, "detach the expired partitions, but do not drop them")
+	pgRetentionCmd.Flags().StringVar(&archiveDir, "archive-dir", "", "export the expired partitions to CSV files in that directory, once detached and before they are dropped")
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := map[string]time.Duration{
+		"90d":   90 * 24 * time.Hour,
+		" 1d ":  24 * time.Hour,
+		"12w":   12 * 7 * 24 * time.Hour,
+		"36h":   36 * time.Hour,
+		"1h30m": 90 * time.Minute,
+	}
+	for s, want := range tests {
+		got, err := parseAge(s)
+		if err != nil || got != want {
+			t.Errorf("'%s': got %v %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "d", "0d", "-2d", "10", "1.5d", "3y", "0h"} {
+		if got, err := parseAge(s); err == nil {
+			t.Errorf("'%s': got %v, expected an error", s, got)
+		}
+	}
+}
+
+func TestParseBound(t *testing.T) {
+	tests := map[string]time.Time{
+		"2024-03-01 00:00:00+00":        time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		"2024-03-01 02:00:00+02":        time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		"2024-03-01 00:00:00.5-01":      time.Date(2024, 3, 1, 1, 0, 0, 500000000, time.UTC),
+		"2024-03-01 12:30:00":           time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		"2024-03-01":                    time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		"2024-12-31 23:59:59.999999+00": time.Date(2024, 12, 31, 23, 59, 59, 999999000, time.UTC),
+	}
+	for s, want := range tests {
+		got, err := parseBound(s)
+		if err != nil || !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("'%s': got %v %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "MAXVALUE", "01/03/2024", "2024-03-01T00:00:00Z"} {
+		if _, err := parseBound(s); err == nil {
+			t.Errorf("'%s': expected an error", s)
+		}
+	}
+
+	// the bounds are read from the partition expression
+	m := rangeEndRe.FindStringSubmatch("FOR VALUES FROM ('2024-02-01 00:00:00+00') TO ('2024-03-01 00:00:00+00')")
+	if m == nil || m[1] != "2024-03-01 00:00:00+00" {
+		t.Errorf("got %v", m)
+	}
+	if m := rangeEndRe.FindStringSubmatch("FOR VALUES FROM ('2024-02-01 00:00:00+00') TO (MAXVALUE)"); m != nil {
+		t.Errorf("got %v", m)
+	}
+}
+
+func TestPartitionExpired(t *testing.T) {
+	limit := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		end  time.Time
+		want bool
+	}{
+		{time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), true},
+		// the range ends at the limit
+		{limit, true},
+		{limit.Add(time.Second), false},
+		// the default partition, or a range up to MAXVALUE
+		{time.Time{}, false},
+	}
+	for _, test := range tests {
+		part := partition{name: "accesslogs_p", end: test.end}
+		if got := part.expired(limit); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.end, got, test.want)
+		}
+	}
+}
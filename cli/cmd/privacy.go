@@ -0,0 +1,410 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+var truncateFields []string
+var truncateIPv4Bits int
+var truncateIPv6Bits int
+var pseudoFields []string
+var pseudoKeyFile string
+var redactFields []string
+var scrubParams []string
+var privacyReport string
+
+func addPrivacyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&truncateFields, "truncate-ip", []string{}, "IP field to truncate to its network (can be repeated)")
+	cmd.Flags().IntVar(&truncateIPv4Bits, "truncate-ipv4-bits", 24, "prefix length kept when truncating IPv4 addresses")
+	cmd.Flags().IntVar(&truncateIPv6Bits, "truncate-ipv6-bits", 48, "prefix length kept when truncating IPv6 addresses")
+	cmd.Flags().StringArrayVar(&pseudoFields, "pseudonymize", []string{}, "field to replace with a keyed HMAC-SHA256 pseudonym (can be repeated)")
+	cmd.Flags().StringVar(&pseudoKeyFile, "pseudonym-key-file", "", "file that holds the secret key of the pseudonyms")
+	cmd.Flags().StringArrayVar(&redactFields, "redact", []string{}, "field to remove from the output (can be repeated)")
+	cmd.Flags().StringArrayVar(&scrubParams, "scrub-param", []string{}, "query string parameter whose value is removed from the output (can be repeated)")
+	cmd.Flags().StringVar(&privacyReport, "privacy-report", "", "file where the report of the privacy transformations is written (default: stderr)")
+}
+
+func privacyEnabled() bool {
+	return len(truncateFields) > 0 || len(pseudoFields) > 0 || len(redactFields) > 0 || len(scrubParams) > 0
+}
+
+// scrubbedValue replaces the values of the scrubbed query parameters.
+const scrubbedValue = "REDACTED"
+
+// The privacy transformations, as written in the report.
+const (
+	actionTruncate = "truncated"
+	actionPseudo   = "pseudonymized"
+	actionRedact   = "redacted"
+	actionScrub    = "scrubbed"
+)
+
+// privacyStage removes the personal data from the lines. It runs after the
+// other enrichers, so that they can still use the original values, like the
+// geolocation of c-ip. It counts the transformed values of each field.
+type privacyStage struct {
+	truncate   map[string]bool
+	v4Mask     net.IPMask
+	v6Mask     net.IPMask
+	pseudo     map[string]bool
+	key        []byte
+	redact     map[string]bool
+	scrub      map[string]bool
+	reportFile string
+	mu         sync.Mutex
+	counts     map[string]map[string]int
+}
+
+func newPrivacyStage(truncate []string, v4Bits int, v6Bits int, pseudo []string, keyFile string, redact []string, scrub []string, reportFile string) (*privacyStage, error) {
+	if v4Bits < 0 || v4Bits > 32 {
+		return nil, fmt.Errorf("invalid IPv4 prefix length: %d", v4Bits)
+	}
+	if v6Bits < 0 || v6Bits > 128 {
+		return nil, fmt.Errorf("invalid IPv6 prefix length: %d", v6Bits)
+	}
+	s := &privacyStage{
+		truncate:   toSet(truncate),
+		v4Mask:     net.CIDRMask(v4Bits, 32),
+		v6Mask:     net.CIDRMask(v6Bits, 128),
+		pseudo:     toSet(pseudo),
+		redact:     toSet(redact),
+		scrub:      make(map[string]bool, len(scrub)),
+		reportFile: reportFile,
+		counts:     make(map[string]map[string]int),
+	}
+	for _, param := range scrub {
+		s.scrub[param] = true
+	}
+	for name := range s.pseudo {
+		switch parser.GuessType(name) {
+		case parser.MyDate, parser.MyTime, parser.MyTimestamp:
+			// the lines need the time fields to compute their timestamp
+			return nil, fmt.Errorf("the time field '%s' cannot be pseudonymized: redact it instead", name)
+		}
+	}
+	if len(pseudo) > 0 {
+		if keyFile == "" {
+			return nil, errors.New("pseudonymization needs a key: specify --pseudonym-key-file")
+		}
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.key = []byte(strings.TrimSpace(string(key)))
+		if len(s.key) < 16 {
+			return nil, fmt.Errorf("the pseudonym key in '%s' is too short (at least 16 bytes)", keyFile)
+		}
+	}
+	return s, nil
+}
+
+// toSet returns the lowercased field names as a set.
+func toSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	return set
+}
+
+func (s *privacyStage) Fields(names []string) (added []string, removed []string) {
+	return nil, nil
+}
+
+// Kind returns String for the pseudonymized fields whose type cannot hold a
+// pseudonym, like the numbers. The type of the fields added by the enrichers
+// is taken into account.
+func (s *privacyStage) Kind(name string) (parser.Kind, bool) {
+	if !s.pseudo[name] && !s.pseudo[parser.HeaderGroup(name)] {
+		return parser.Invalid, false
+	}
+	switch filterType(name) {
+	case parser.MyIP, parser.MyIPList, parser.Map, parser.String, parser.MyURI:
+		return parser.Invalid, false
+	default:
+		return parser.String, true
+	}
+}
+
+// privacyDerived stores the fields that the parser derives from a field: they
+// get the transformations of the field, so that they do not reveal the
+// original values.
+var privacyDerived = map[string][]string{
+	"cs(cookie)":          {parser.RequestCookies},
+	"cs-uri-query":        {parser.RequestQuery},
+	"cs-uri":              {parser.RequestQuery},
+	"c-ip":                {parser.ClientIP},
+	"cs(x-forwarded-for)": {parser.ClientIP},
+	"x-forwarded-for":     {parser.ClientIP},
+}
+
+// targets returns the fields of the line that get a transformation of the
+// given fields: the fields themselves, or the header fields of a header group
+// like request.headers, and the fields derived from them.
+func targets(l *parser.Line, names map[string]bool) []string {
+	var sources []string
+	for name := range names {
+		if name == parser.RequestHeaders || name == parser.ResponseHeaders {
+			sources = append(sources, l.HeaderFields(name)...)
+		} else {
+			sources = append(sources, name)
+		}
+	}
+	seen := make(map[string]bool, len(sources))
+	ret := make([]string, 0, len(sources))
+	for _, source := range sources {
+		for _, name := range append([]string{source}, privacyDerived[source]...) {
+			if !seen[name] && l.Has(name) {
+				seen[name] = true
+				ret = append(ret, name)
+			}
+		}
+	}
+	return ret
+}
+
+func (s *privacyStage) Process(l *parser.Line) (bool, error) {
+	for _, name := range targets(l, s.redact) {
+		if l.Get(name) != nil {
+			l.Set(name, nil)
+			s.count(name, actionRedact)
+		}
+	}
+	if len(s.scrub) > 0 {
+		s.scrubQuery(l)
+	}
+	for _, name := range targets(l, s.truncate) {
+		switch v := l.Get(name).(type) {
+		case net.IP:
+			l.Set(name, s.truncateIP(v))
+			s.count(name, actionTruncate)
+		case []net.IP:
+			ips := make([]net.IP, 0, len(v))
+			for _, ip := range v {
+				ips = append(ips, s.truncateIP(ip))
+			}
+			l.Set(name, ips)
+			s.count(name, actionTruncate)
+		}
+	}
+	for _, name := range targets(l, s.pseudo) {
+		v := l.Get(name)
+		if v == nil {
+			continue
+		}
+		l.Set(name, s.pseudonymize(name, v))
+		s.count(name, actionPseudo)
+	}
+	return true, nil
+}
+
+func (s *privacyStage) count(name string, action string) {
+	s.mu.Lock()
+	if s.counts[name] == nil {
+		s.counts[name] = make(map[string]int)
+	}
+	s.counts[name][action]++
+	s.mu.Unlock()
+}
+
+func (s *privacyStage) truncateIP(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(s.v4Mask)
+	}
+	return ip.Mask(s.v6Mask)
+}
+
+func (s *privacyStage) hmac(value string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// pseudonymizeIP maps ip to an address of the fd00::/8 unique local range,
+// so that the pseudonym still fits in an IP column.
+func (s *privacyStage) pseudonymizeIP(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	sum := s.hmac(ip.String())
+	pseudo := make(net.IP, net.IPv6len)
+	pseudo[0] = 0xfd
+	copy(pseudo[1:], sum)
+	return pseudo
+}
+
+func (s *privacyStage) pseudonymizeStr(value string) string {
+	return hex.EncodeToString(s.hmac(value)[:16])
+}
+
+// pseudonymize returns the pseudonym of a field value. The cookies keep their
+// names, only their values are replaced.
+func (s *privacyStage) pseudonymize(name string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case net.IP:
+		return s.pseudonymizeIP(v)
+	case []net.IP:
+		ips := make([]net.IP, 0, len(v))
+		for _, ip := range v {
+			ips = append(ips, s.pseudonymizeIP(ip))
+		}
+		return ips
+	case map[string]string:
+		m := make(map[string]string, len(v))
+		for k, val := range v {
+			m[k] = s.pseudonymizeStr(val)
+		}
+		return m
+	case map[string][]string:
+		m := make(map[string][]string, len(v))
+		for k, vals := range v {
+			pseudos := make([]string, 0, len(vals))
+			for _, val := range vals {
+				pseudos = append(pseudos, s.pseudonymizeStr(val))
+			}
+			m[k] = pseudos
+		}
+		return m
+	case string:
+		if name == "cs(cookie)" {
+			return s.pseudonymizeCookies(v)
+		}
+		return s.pseudonymizeStr(v)
+	default:
+		return s.pseudonymizeStr(fmt.Sprintf("%v", v))
+	}
+}
+
+func (s *privacyStage) pseudonymizeCookies(cookies string) string {
+	parts := strings.Split(cookies, ";")
+	for i, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			parts[i] = kv[0] + "=" + s.pseudonymizeStr(kv[1])
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// scrubQuery replaces the values of the scrubbed parameters in the query
+// string fields.
+func (s *privacyStage) scrubQuery(l *parser.Line) {
+	for _, name := range []string{"cs-uri-query", "cs-uri", "cs(referer)"} {
+		if !l.Has(name) {
+			continue
+		}
+		value, ok := l.Get(name).(string)
+		if !ok || value == "" {
+			continue
+		}
+		query := value
+		prefix := ""
+		if name != "cs-uri-query" {
+			idx := strings.IndexByte(value, '?')
+			if idx == -1 {
+				continue
+			}
+			prefix, query = value[:idx+1], value[idx+1:]
+		}
+		scrubbed, changed := s.scrubQueryString(query)
+		if changed {
+			l.Set(name, prefix+scrubbed)
+			s.count(name, actionScrub)
+		}
+	}
+	if q, ok := l.Get(parser.RequestQuery).(map[string][]string); ok {
+		changed := false
+		for param, values := range q {
+			if !s.scrub[decodeParam(param)] {
+				continue
+			}
+			for i := range values {
+				values[i] = scrubbedValue
+			}
+			changed = true
+		}
+		if changed {
+			s.count(parser.RequestQuery, actionScrub)
+		}
+	}
+}
+
+func (s *privacyStage) scrubQueryString(query string) (string, bool) {
+	changed := false
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 && s.scrub[decodeParam(kv[0])] {
+			params[i] = kv[0] + "=" + scrubbedValue
+			changed = true
+		}
+	}
+	return strings.Join(params, "&"), changed
+}
+
+// decodeParam returns the decoded name of a query string parameter, so that
+// the encoded names like user%5Fid are scrubbed too.
+func decodeParam(name string) string {
+	decoded, err := url.QueryUnescape(name)
+	if err != nil {
+		return name
+	}
+	return decoded
+}
+
+// Close writes the report of the privacy transformations.
+func (s *privacyStage) Close() (err error) {
+	var w io.Writer = os.Stderr
+	if s.reportFile != "" {
+		f, err := os.Create(s.reportFile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if e := f.Close(); err == nil {
+				err = e
+			}
+		}()
+		w = f
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.counts))
+	for name := range s.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Privacy report:")
+	if len(names) == 0 {
+		fmt.Fprintln(w, "- no field was transformed")
+	}
+	for _, name := range names {
+		for _, action := range []string{actionRedact, actionScrub, actionTruncate, actionPseudo} {
+			if n := s.counts[name][action]; n > 0 {
+				_, err = fmt.Fprintf(w, "- %s: %d values %s\n", name, n, action)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
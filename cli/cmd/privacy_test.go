@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+const privacyTestLog = `#Fields: date time c-ip cs-username cs-uri-stem cs-uri-query cs(cookie) cs(user-agent) cs(x-forwarded-for) sc-status
+2024-03-01 00:00:01 10.0.0.5 alice /p user%5Fid=42&q=x&sid=abc sid=abc;+theme=dark Mozilla/5.0 203.0.113.9,+10.1.2.3 200
+`
+
+// privacyTestLine returns the parsed line of privacyTestLog, with the maps and
+// the client IP.
+func privacyTestLine(t *testing.T, group bool) *parser.Line {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	p := parser.NewFileParser(strings.NewReader(privacyTestLog))
+	p.SetCookies(&parser.KeyFilter{}).SetQuery(&parser.KeyFilter{}).SetGroupHeaders(group)
+	p.SetTrustedProxies([]*net.IPNet{trusted})
+	err := p.ParseHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := p.Next()
+	if err != nil || l == nil {
+		t.Fatalf("got %v %v", l, err)
+	}
+	return l
+}
+
+func newTestPrivacyStage(t *testing.T, truncate, pseudo, redact, scrub []string) *privacyStage {
+	dir, clean := tempDir(t)
+	defer clean()
+	keyFile := filepath.Join(dir, "key")
+	err := ioutil.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newPrivacyStage(truncate, 24, 48, pseudo, keyFile, redact, scrub, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func processPrivacy(t *testing.T, s *privacyStage, l *parser.Line) {
+	keep, err := s.Process(l)
+	if !keep || err != nil {
+		t.Fatalf("got %v %v", keep, err)
+	}
+}
+
+func TestPrivacyRedact(t *testing.T) {
+	s := newTestPrivacyStage(t, nil, nil, []string{"cs(cookie)", "cs-uri-query", "cs-username"}, nil)
+	l := privacyTestLine(t, false)
+	processPrivacy(t, s, l)
+	for _, name := range []string{"cs(cookie)", parser.RequestCookies, "cs-uri-query", parser.RequestQuery, "cs-username"} {
+		if v := l.Get(name); v != nil {
+			t.Errorf("%s: got %#v", name, v)
+		}
+	}
+	if l.Get("cs(user-agent)") == nil {
+		t.Error("cs(user-agent) was redacted")
+	}
+	want := map[string]map[string]int{
+		"cs(cookie)":          {actionRedact: 1},
+		parser.RequestCookies: {actionRedact: 1},
+		"cs-uri-query":        {actionRedact: 1},
+		parser.RequestQuery:   {actionRedact: 1},
+		"cs-username":         {actionRedact: 1},
+	}
+	if !reflect.DeepEqual(s.counts, want) {
+		t.Errorf("counts: got %v, want %v", s.counts, want)
+	}
+}
+
+func TestPrivacyRedactHeaders(t *testing.T) {
+	s := newTestPrivacyStage(t, nil, nil, []string{parser.RequestHeaders}, nil)
+	l := privacyTestLine(t, true)
+	processPrivacy(t, s, l)
+	if h := l.Get(parser.RequestHeaders); h != nil {
+		t.Errorf("request.headers: got %v", h)
+	}
+	if _, ok := l.GetAll()[parser.RequestHeaders]; ok {
+		t.Error("request.headers is exported")
+	}
+	// the fields derived from the header fields are redacted too
+	for _, name := range []string{parser.RequestCookies, parser.ClientIP} {
+		if v := l.Get(name); v != nil {
+			t.Errorf("%s: got %v", name, v)
+		}
+	}
+	if l.Get("c-ip") == nil || l.Get("sc-status") == nil {
+		t.Error("other fields were redacted")
+	}
+}
+
+func TestPrivacyTruncate(t *testing.T) {
+	s := newTestPrivacyStage(t, []string{"c-ip", "cs(x-forwarded-for)", "cs-username"}, nil, nil, nil)
+	l := privacyTestLine(t, false)
+	processPrivacy(t, s, l)
+	tests := map[string]interface{}{
+		"c-ip":                net.ParseIP("10.0.0.0").To4(),
+		"cs(x-forwarded-for)": []net.IP{net.ParseIP("203.0.113.0").To4(), net.ParseIP("10.1.2.0").To4()},
+		parser.ClientIP:       net.ParseIP("203.0.113.0").To4(),
+		// not an IP
+		"cs-username": "alice",
+	}
+	for name, want := range tests {
+		if got := l.Get(name); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, want %#v", name, got, want)
+		}
+	}
+	// the client IP is truncated once, and the strings are not counted
+	want := map[string]map[string]int{
+		"c-ip":                {actionTruncate: 1},
+		"cs(x-forwarded-for)": {actionTruncate: 1},
+		parser.ClientIP:       {actionTruncate: 1},
+	}
+	if !reflect.DeepEqual(s.counts, want) {
+		t.Errorf("counts: got %v, want %v", s.counts, want)
+	}
+
+	// the invalid hops stay invalid
+	l.Set("cs(x-forwarded-for)", []net.IP{nil, net.ParseIP("2001:db8:1:2::1")})
+	processPrivacy(t, s, l)
+	if got, want := l.Get("cs(x-forwarded-for)"), []net.IP{nil, net.ParseIP("2001:db8:1::")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestPrivacyPseudonymize(t *testing.T) {
+	s := newTestPrivacyStage(t, nil, []string{"c-ip", "cs-username", "cs(cookie)", "sc-status"}, nil, nil)
+	l := privacyTestLine(t, false)
+	processPrivacy(t, s, l)
+
+	ip, ok := l.Get("c-ip").(net.IP)
+	if !ok || ip[0] != 0xfd || ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("c-ip: got %#v", l.Get("c-ip"))
+	}
+	if client, ok := l.Get(parser.ClientIP).(net.IP); !ok || client[0] != 0xfd {
+		t.Errorf("client.ip: got %#v", l.Get(parser.ClientIP))
+	}
+	user, _ := l.Get("cs-username").(string)
+	if len(user) != 32 || user == "alice" {
+		t.Errorf("cs-username: got '%s'", user)
+	}
+	// the pseudonyms are stable
+	if user != s.pseudonymizeStr("alice") {
+		t.Errorf("cs-username: got '%s', want '%s'", user, s.pseudonymizeStr("alice"))
+	}
+	cookie, _ := l.Get("cs(cookie)").(string)
+	if want := "sid=" + s.pseudonymizeStr("abc") + ";+theme=" + s.pseudonymizeStr("dark"); cookie != want {
+		t.Errorf("cs(cookie): got '%s', want '%s'", cookie, want)
+	}
+	cookies := l.Get(parser.RequestCookies)
+	if want := map[string]string{"sid": s.pseudonymizeStr("abc"), "theme": s.pseudonymizeStr("dark")}; !reflect.DeepEqual(cookies, want) {
+		t.Errorf("request.cookies: got %v, want %v", cookies, want)
+	}
+	if status, ok := l.Get("sc-status").(string); !ok || status != s.pseudonymizeStr("200") {
+		t.Errorf("sc-status: got %#v", l.Get("sc-status"))
+	}
+	// the numbers become strings, the IPs stay IPs
+	kinds := map[string]parser.Kind{
+		"sc-status":   parser.String,
+		"c-ip":        parser.Invalid,
+		"cs-username": parser.Invalid,
+		"cs-uri-stem": parser.Invalid,
+	}
+	for name, want := range kinds {
+		if got, _ := s.Kind(name); got != want {
+			t.Errorf("kind of %s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestPrivacyScrub(t *testing.T) {
+	s := newTestPrivacyStage(t, nil, nil, nil, []string{"user_id", "sid"})
+	l := privacyTestLine(t, false)
+	processPrivacy(t, s, l)
+	if got, want := l.Get("cs-uri-query"), "user_id=REDACTED&q=x&sid=REDACTED"; got != want {
+		t.Errorf("cs-uri-query: got %v, want %v", got, want)
+	}
+	want := map[string][]string{"user_id": {scrubbedValue}, "q": {"x"}, "sid": {scrubbedValue}}
+	if got := l.Get(parser.RequestQuery); !reflect.DeepEqual(got, want) {
+		t.Errorf("request.query: got %v, want %v", got, want)
+	}
+}
+
+func TestPrivacyTimeFields(t *testing.T) {
+	for _, name := range []string{"date", "time", "gmttime"} {
+		if _, err := newPrivacyStage(nil, 24, 48, []string{name}, "unused", nil, nil, ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	// the time fields can be redacted
+	s := newTestPrivacyStage(t, nil, nil, []string{"date", "time"}, nil)
+	l := privacyTestLine(t, false)
+	processPrivacy(t, s, l)
+	if !l.GetTime().IsZero() {
+		t.Errorf("got %v", l.GetTime())
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -26,6 +27,11 @@ var push2esCmd = &cobra.Command{
 		if len(filenames) == 0 {
 			fatal(errors.New("specify the files to be parsed"))
 		}
+		fatal(checkPartialPolicy())
+		fatal(buildEnrichers())
+		fatal(buildTimeRange())
+		filenames = pruneFiles(filenames)
+		defer closeEnrichers()
 
 		logger := log15.New()
 		logger.SetHandler(log15.StderrHandler)
@@ -33,6 +39,9 @@ var push2esCmd = &cobra.Command{
 
 		_, err := getESClient(params, logger)
 		fatal(err)
+		fatal(openFileLedger())
+		fatal(openDeadLetter())
+		defer closeDeadLetter()
 
 		excludes := make(map[string]bool)
 		for _, fName := range excludedFields {
@@ -42,11 +51,10 @@ var push2esCmd = &cobra.Command{
 		excludes["time"] = true
 
 		for report := range uploadFilesES(params, filenames, batchsize, excludes, time.Month(onlyMonth), int(parallel), logger) {
-			if report.err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to upload '%s': %s\n", report.filename, report.err.Error())
-			} else {
-				fmt.Fprintf(os.Stderr, "Uploaded '%s': %d lines\n", report.filename, report.nbLines)
+			if report.err == errSkipped {
+				continue
 			}
+			report.print()
 		}
 	},
 }
@@ -57,77 +65,250 @@ type esParams struct {
 	password string
 }
 
+// esRetryStatuses are the statuses of the bulk items that may be indexed if
+// they are sent again: 429 when the write queue of a node is full, 502 to 504
+// when a node or the primary shard is not available, and 408 when the shard
+// did not answer in time. The other statuses, 500 included, are caused by the
+// document or the mapping and would fail again.
+var esRetryStatuses = map[int]bool{408: true, 429: true, 502: true, 503: true, 504: true}
+
+// esDoc is a document sent to Elasticsearch, with the position of its line.
+type esDoc struct {
+	fields map[string]interface{}
+	pos    checkpoint
+}
+
+// esRetry is a bulk item to send again.
+type esRetry struct {
+	request elastic.BulkableRequest
+	reason  string
+}
+
 type processor struct {
 	*elastic.BulkProcessor
-	lines      []map[string]interface{}
+	source     string
 	fieldNames []string
+	mu         sync.Mutex
+	// docs stores the documents that have not been indexed yet
+	docs map[elastic.BulkableRequest]esDoc
+	// err is the error of the last failed commit, after the retries
+	err     error
+	retries []esRetry
+	failed  []deadRecord
+	indexed int
 }
 
-func newProcessor(client *elastic.Client, fieldNames []string, size int) (*processor, error) {
+func newProcessor(client *elastic.Client, source string, fieldNames []string, size int) (*processor, error) {
+	p := &processor{
+		source:     source,
+		fieldNames: fieldNames,
+		docs:       make(map[elastic.BulkableRequest]esDoc, size),
+	}
+	// the items are retried by flush: when the bulk processor retries them
+	// itself, the response items do not match the requests anymore
 	proc, err := client.BulkProcessor().
 		Name("push2esWorker").
 		Workers(http.DefaultMaxIdleConnsPerHost).
 		BulkActions(-1).
 		BulkSize(-1).
-		Backoff(elastic.StopBackoff{}).
+		Backoff(retryBackoff{}).
+		RetryItemStatusCodes().
+		After(p.after).
 		Do(context.Background())
 	if err != nil {
 		return nil, err
 	}
-	p := &processor{
-		BulkProcessor: proc,
-		lines:         make([]map[string]interface{}, 0, size),
-		fieldNames:    fieldNames,
-	}
+	p.BulkProcessor = proc
 	return p, nil
 }
 
-func (p *processor) flush() (nbLines int, err error) {
-	nbLines = len(p.lines)
-	if nbLines == 0 {
-		return 0, nil
-	}
-	err = p.Flush()
+// after is called by the bulk processor after each commit, with the response
+// items in the order of the requests. BulkProcessor.Flush does not return the
+// errors of the commits.
+func (p *processor) after(executionID int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if err != nil {
-		return 0, err
+		p.err = err
+		return
+	}
+	if response == nil {
+		return
+	}
+	for i, item := range response.Items {
+		if i >= len(requests) {
+			break
+		}
+		for _, result := range item {
+			switch {
+			case result.Status >= 200 && result.Status < 300:
+				p.indexed++
+				delete(p.docs, requests[i])
+			case esRetryStatuses[result.Status]:
+				p.retries = append(p.retries, esRetry{request: requests[i], reason: itemError(result)})
+			default:
+				p.fail(requests[i], itemError(result))
+			}
+		}
 	}
-	p.lines = p.lines[:0]
-	return nbLines, nil
 }
 
-func (p *processor) add(line map[string]interface{}) {
-	p.lines = append(p.lines, line)
-	p.Add(elastic.NewBulkIndexRequest().Doc(line).Index(indexName).Type("accesslogs"))
+// fail records a document that could not be indexed. p.mu must be held.
+func (p *processor) fail(request elastic.BulkableRequest, reason string) {
+	doc, ok := p.docs[request]
+	if !ok {
+		return
+	}
+	delete(p.docs, request)
+	p.failed = append(p.failed, deadRecord{
+		Source: p.source,
+		Line:   doc.pos.lines,
+		Offset: doc.pos.offset,
+		Error:  reason,
+		Fields: doc.fields,
+		Time:   time.Now().UTC(),
+	})
 }
 
-func (p *processor) len() int {
-	return len(p.lines)
+func itemError(result *elastic.BulkResponseItem) string {
+	if result.Error == nil {
+		return fmt.Sprintf("status %d", result.Status)
+	}
+	return fmt.Sprintf("status %d: %s: %s", result.Status, result.Error.Type, result.Error.Reason)
 }
 
-func uploadES(f io.Reader, client *elastic.Client, size int, excludes map[string]bool, month time.Month) (nbLines int, err error) {
+// flush sends the pending documents, and sends again the documents rejected
+// with a retryable status. It returns the number of indexed documents, and
+// the number of documents that could not be indexed. The latter are written
+// to the dead-letter file.
+func (p *processor) flush() (indexed int, failed int, err error) {
+	if p.len() == 0 {
+		return 0, 0, nil
+	}
+	for retry := 1; ; retry++ {
+		err = p.Flush()
+		if err != nil {
+			return 0, 0, err
+		}
+		p.mu.Lock()
+		err, p.err = p.err, nil
+		retries := p.retries
+		p.retries = nil
+		p.mu.Unlock()
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(retries) == 0 {
+			break
+		}
+		wait, ok := retryBackoff{}.Next(retry)
+		if !ok {
+			p.mu.Lock()
+			for _, r := range retries {
+				p.fail(r.request, r.reason)
+			}
+			p.mu.Unlock()
+			break
+		}
+		fmt.Fprintf(os.Stderr, "%d documents of '%s' were rejected, retrying in %s: %s\n", len(retries), p.source, wait, retries[0].reason)
+		time.Sleep(wait)
+		for _, r := range retries {
+			p.Add(r.request)
+		}
+	}
 
-	p := parser.NewFileParser(f)
+	p.mu.Lock()
+	for request := range p.docs {
+		p.fail(request, "no response from Elasticsearch")
+	}
+	indexed, records := p.indexed, p.failed
+	p.indexed, p.failed = 0, nil
+	p.mu.Unlock()
+
+	if len(records) > 0 {
+		if deadLetters != nil {
+			err = deadLetters.write(records)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing the dead-letter file: %s\n", err)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "%d documents of '%s' were not indexed: %s\n", len(records), p.source, records[0].Error)
+		}
+	}
+	return indexed, len(records), nil
+}
+
+// add sends a document, read from the line at the given position.
+func (p *processor) add(doc map[string]interface{}, pos checkpoint) {
+	request := elastic.NewBulkIndexRequest().Doc(doc).Index(indexName).Type("accesslogs")
+	p.mu.Lock()
+	p.docs[request] = esDoc{fields: doc, pos: pos}
+	p.mu.Unlock()
+	p.Add(request)
+}
+
+func (p *processor) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.docs)
+}
+
+// uploadES uploads the lines of a log file to Elasticsearch. The upload
+// starts at the resume position, which needs f to be seekable. progress, if
+// not nil, is called with the position after each flushed batch. last is the
+// position after the last flushed batch, or the end of the file. nbLines is
+// the number of indexed lines, and nbFailed the number of lines rejected by
+// Elasticsearch.
+func uploadES(f io.Reader, source string, client *elastic.Client, size int, excludes map[string]bool, month time.Month, resume checkpoint, progress func(cp checkpoint)) (nbLines int, nbFailed int, last checkpoint, err error) {
+	last = resume
+	p := setupParser(parser.NewFileParser(f))
 	err = p.ParseHeader()
 	if err != nil {
-		return 0, err
+		return 0, 0, last, err
+	}
+	if resume.offset > 0 {
+		err = p.SeekTo(resume.offset)
+		if err != nil {
+			return 0, 0, last, err
+		}
 	}
 	fieldNames := p.FieldNames()
+	clearedNames := excludedHeaders(fieldNames, excludes)
+	pipeline, err := buildPipeline(p, clearedNames)
+	if err != nil {
+		return 0, 0, last, err
+	}
 
-	proc, err := newProcessor(client, fieldNames, size)
+	proc, err := newProcessor(client, source, fieldNames, size)
 	if err != nil {
-		return 0, err
+		return 0, 0, last, err
 	}
+	// the documents are flushed before: Close stops the workers
+	defer proc.Close()
 
 	var l *parser.Line
+	var keep bool
+	nbRead := resume.lines
+	// batchEnd is the position after the last line of the current batch
+	batchEnd := resume
 
 	for {
+		start := p.Offset()
 		l, err = p.NextTo(l)
 		if l == nil || err != nil {
 			break
 		}
+		nbRead++
 		if month > 0 && month < 13 && l.GetDate().Month != month {
 			continue
 		}
+		keep, err = pipeline.Process(l)
+		if err != nil {
+			return 0, 0, last, err
+		}
+		if !keep {
+			continue
+		}
 		// TODO: avoid map allocation
 		props := l.GetAll()
 		for field := range props {
@@ -135,48 +316,100 @@ func uploadES(f io.Reader, client *elastic.Client, size int, excludes map[string
 				delete(props, field)
 			}
 		}
-		proc.add(props)
+		proc.add(props, checkpoint{lines: nbRead, offset: start})
+		batchEnd = checkpoint{lines: nbRead, offset: p.Offset()}
 		if proc.len() >= size {
-			nb, err := proc.flush()
+			nb, failed, err := proc.flush()
 			if err != nil {
-				return 0, err
+				return 0, 0, last, err
 			}
 			nbLines = nbLines + nb
+			nbFailed = nbFailed + failed
+			last = batchEnd
+			if progress != nil {
+				progress(last)
+			}
 		}
 	}
 	if proc.len() > 0 {
-		nb, err := proc.flush()
+		nb, failed, err := proc.flush()
 		if err != nil {
-			return 0, err
+			return 0, 0, last, err
 		}
 		nbLines = nbLines + nb
+		nbFailed = nbFailed + failed
 	}
-	return nbLines, nil
+	return nbLines, nbFailed, checkpoint{lines: nbRead, offset: p.Offset()}, nil
 
 }
 
-func uploadFileES(params esParams, fname string, size int, excludes map[string]bool, month time.Month, logger log15.Logger) (nbLines int, err error) {
+func uploadFileES(params esParams, fname string, size int, excludes map[string]bool, month time.Month, logger log15.Logger) (nbLines int, nbFailed int, err error) {
+	fname = strings.TrimSpace(fname)
+	var entry ledgerEntry
+	var resume checkpoint
+	var progress func(cp checkpoint)
+	if ingestLedger != nil {
+		var ingest bool
+		entry, ingest, resume, err = ledgerStart(fname)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !ingest {
+			return 0, 0, errSkipped
+		}
+		progress = func(cp checkpoint) {
+			ledgerRecord(entry, statusStarted, cp, "")
+		}
+	}
 	client, err := getESClient(params, logger)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
-	fname = strings.TrimSpace(fname)
 	f, err := os.Open(fname)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+	source, err := filepath.Abs(fname)
+	if err != nil {
+		source = fname
 	}
 	defer f.Close()
-	nbLines, err = uploadES(f, client, size, excludes, month)
+	// the checksum is computed while reading, unless the file is resumed
+	checksum := newReadChecksum()
+	var r io.Reader = f
+	if resume.offset == 0 {
+		r = io.TeeReader(f, checksum)
+	}
+	nbLines, nbFailed, last, err := uploadES(r, source, client, size, excludes, month, resume, progress)
+	if ingestLedger != nil {
+		if err == nil {
+			ledgerRecord(entry, statusDone, last, checksum.sum(fname, last.offset))
+		} else {
+			ledgerRecord(entry, statusFailed, last, "")
+		}
+	}
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
-	return nbLines, nil
+	return nbLines, nbFailed, nil
 }
 
 type uploadReport struct {
 	filename string
 	err      error
 	nbLines  int
+	nbFailed int
+}
+
+func (r uploadReport) print() {
+	switch {
+	case r.err != nil:
+		fmt.Fprintf(os.Stderr, "Failed to upload '%s': %s\n", r.filename, r.err.Error())
+	case r.nbFailed > 0:
+		fmt.Fprintf(os.Stderr, "Uploaded '%s': %d lines, %d lines rejected\n", r.filename, r.nbLines, r.nbFailed)
+	default:
+		fmt.Fprintf(os.Stderr, "Uploaded '%s': %d lines\n", r.filename, r.nbLines)
+	}
 }
 
 func uploadFilesES(params esParams, fnames []string, size int, excludes map[string]bool, month time.Month, workers int, logger log15.Logger) chan uploadReport {
@@ -195,8 +428,8 @@ func uploadFilesES(params esParams, fnames []string, size int, excludes map[stri
 				if !ok {
 					return
 				}
-				nbLines, err := uploadFileES(params, fname, size, excludes, month, logger)
-				c <- uploadReport{filename: fname, err: err, nbLines: nbLines}
+				nbLines, nbFailed, err := uploadFileES(params, fname, size, excludes, month, logger)
+				c <- uploadReport{filename: fname, err: err, nbLines: nbLines, nbFailed: nbFailed}
 			}
 		}()
 	}
@@ -247,4 +480,12 @@ func init() {
 	push2esCmd.Flags().StringArrayVar(&excludedFields, "exclude", []string{}, "exclude that field from collection (can be repeated)")
 	push2esCmd.Flags().IntVar(&onlyMonth, "month", 0, "Only upload logs from that month")
 	push2esCmd.Flags().Uint8Var(&parallel, "parallel", 1, "number of parallel injectors")
+	push2esCmd.Flags().BoolVar(&groupHeaders, "headers", false, "group the HTTP header fields into request.headers and response.headers objects")
+	addMapFlags(push2esCmd)
+	addEnrichFlags(push2esCmd)
+	addWhereFlag(push2esCmd)
+	addRetryFlags(push2esCmd)
+	addDeadLetterFlag(push2esCmd)
+	addTimeFlags(push2esCmd)
+	addESLedgerFlags(push2esCmd)
 }
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/olivere/elastic"
+)
+
+func TestProcessorAfter(t *testing.T) {
+	p := &processor{source: "u_ex240301.log", docs: make(map[elastic.BulkableRequest]esDoc)}
+	statuses := []int{201, 200, 429, 503, 400, 500, 409}
+	requests := make([]elastic.BulkableRequest, 0, len(statuses))
+	for i := range statuses {
+		doc := map[string]interface{}{"sc-status": int64(i)}
+		request := elastic.NewBulkIndexRequest().Doc(doc)
+		p.docs[request] = esDoc{fields: doc, pos: checkpoint{lines: i + 1, offset: int64(100 * i)}}
+		requests = append(requests, request)
+	}
+	response := &elastic.BulkResponse{Errors: true}
+	for _, status := range statuses {
+		item := &elastic.BulkResponseItem{Status: status}
+		if status >= 300 {
+			item.Error = &elastic.ErrorDetails{Type: "some_exception", Reason: "rejected"}
+		}
+		response.Items = append(response.Items, map[string]*elastic.BulkResponseItem{"index": item})
+	}
+	p.after(1, requests, response, nil)
+
+	if p.indexed != 2 {
+		t.Errorf("got %d indexed documents, want 2", p.indexed)
+	}
+	if len(p.retries) != 2 || p.retries[0].request != requests[2] || p.retries[1].request != requests[3] {
+		t.Errorf("got retries %v", p.retries)
+	}
+	if p.retries[0].reason != "status 429: some_exception: rejected" {
+		t.Errorf("got reason '%s'", p.retries[0].reason)
+	}
+	if len(p.failed) != 3 {
+		t.Fatalf("got %d failed documents, want 3", len(p.failed))
+	}
+	for i, rec := range p.failed {
+		if rec.Line != i+5 || rec.Offset != int64(100*(i+4)) || rec.Source != p.source || rec.Fields["sc-status"] != int64(i+4) {
+			t.Errorf("got %+v", rec)
+		}
+	}
+	// the documents that are retried stay pending
+	if p.len() != 2 {
+		t.Errorf("got %d pending documents, want 2", p.len())
+	}
+
+	// a missing response item leaves the document pending
+	p.after(2, requests[2:4], &elastic.BulkResponse{Items: response.Items[:1]}, nil)
+	if p.indexed != 3 || p.len() != 1 {
+		t.Errorf("got %d indexed and %d pending documents", p.indexed, p.len())
+	}
+
+	// the error of a commit is kept for flush
+	commitErr := errors.New("connection refused")
+	p.after(3, requests[3:4], nil, commitErr)
+	if p.err != commitErr {
+		t.Errorf("got %v", p.err)
+	}
+}
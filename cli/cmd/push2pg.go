@@ -49,6 +49,17 @@ var push2pgCmd = &cobra.Command{
 		if len(filenames) == 0 {
 			fatal(errors.New("specify the files to be parsed"))
 		}
+		fatal(checkIDMode())
+		fatal(checkPartialPolicy())
+		fatal(checkAutoPartition())
+		fatal(checkSchemaPolicy())
+		checkPipeline()
+		fatal(openDeadLetter())
+		defer closeDeadLetter()
+		fatal(buildEnrichers())
+		fatal(buildTimeRange())
+		filenames = pruneFiles(filenames)
+		defer closeEnrichers()
 		dbURI = strings.TrimSpace(dbURI)
 		if len(dbURI) == 0 {
 			fatal(errors.New("Empty uri"))
@@ -57,16 +68,19 @@ var push2pgCmd = &cobra.Command{
 		fatal(err)
 		pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
 			ConnConfig:     config,
-			MaxConnections: int(parallel),
+			MaxConnections: int(parallel)*int(copiers) + 1, // one more for the ledger and the partitions
 		})
 		fatal(err)
 		defer pool.Close()
+		fatal(openPGLedger(pool))
 		excludes := make(map[string]bool)
 		for _, fName := range excludedFields {
 			excludes[strings.ToLower(fName)] = true
 		}
 		excludes["date"] = true
 		excludes["time"] = true
+		fatal(openPartitioner(pool, excludes))
+		fatal(openSchema(pool))
 		uploadFilesPG(filenames, excludes, pool, uint(parallel), batchsize)
 	},
 }
@@ -98,18 +112,66 @@ func uploadFilesPG(files []string, excludes map[string]bool, pool *pgx.ConnPool,
 
 func uploadFilePG(file string, excludes map[string]bool, pool *pgx.ConnPool, bsize int) {
 	file = strings.TrimSpace(file)
+	var entry ledgerEntry
+	var resume checkpoint
+	var save func(txn *pgx.Tx, cp checkpoint) error
+	if ingestLedger != nil {
+		var ingest bool
+		var err error
+		entry, ingest, resume, err = ledgerStart(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error checking the ledger for '%s': %s\n", file, err)
+			return
+		}
+		if !ingest {
+			return
+		}
+		if l, ok := ingestLedger.(*pgLedger); ok {
+			save = func(txn *pgx.Tx, cp checkpoint) error {
+				return l.putIn(txn, entry, cp)
+			}
+		}
+	}
 	f, err := os.Open(file)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error opening '%s': %s\n", file, err)
 		return
 	}
+	ids, err := newRowIDs(file)
+	if err != nil {
+		f.Close()
+		fmt.Fprintf(os.Stderr, "Error reading '%s': %s\n", file, err)
+		return
+	}
 
 	fmt.Fprintf(os.Stderr, "-> Uploading: %s\n", file)
 	start := time.Now()
-	nbLines, err := uploadPG(f, excludes, pool, bsize)
+	// the checksum is computed while reading, unless the file is resumed
+	checksum := newReadChecksum()
+	var r io.Reader = f
+	if resume.offset == 0 {
+		r = io.TeeReader(f, checksum)
+	}
+	nbLines, nbSkipped, nbRejected, last, err := uploadPG(r, ids, excludes, pool, bsize, resume, save)
 	duration := time.Now().Sub(start).Seconds()
 	f.Close()
-	if err == nil {
+	if ingestLedger != nil {
+		if err == nil {
+			ledgerRecord(entry, statusDone, last, checksum.sum(file, last.offset))
+		} else {
+			ledgerRecord(entry, statusFailed, last, "")
+		}
+	}
+	if err == nil && nbRejected > 0 {
+		fmt.Fprintf(os.Stderr, "<- Rejected:  %s (%d lines written to '%s')\n", file, nbRejected, deadLetterFile)
+	}
+	if err == nil && deterministicIDs() {
+		fmt.Fprintf(
+			os.Stderr,
+			"<- Uploaded:  %s (%d lines, %d already present, %f secs, %d lines/sec)\n",
+			file, nbLines, nbSkipped, duration, int(float64(nbLines)/duration),
+		)
+	} else if err == nil {
 		fmt.Fprintf(
 			os.Stderr,
 			"<- Uploaded:  %s (%d lines, %f secs, %d lines/sec)\n",
@@ -138,19 +200,52 @@ type Rows struct {
 }
 
 func RowFactory(maxSize int, nbFields int) *Rows {
+	return newRows(maxSize, nbFields, newRowPool(nbFields))
+}
+
+func newRowPool(nbFields int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return Row(make([]interface{}, 0, nbFields))
+		},
+	}
+}
+
+func newRows(maxSize int, nbFields int, pool *sync.Pool) *Rows {
 	r := Rows{
 		maxSize:  maxSize,
 		nbFields: nbFields,
-		pool: &sync.Pool{
-			New: func() interface{} {
-				return Row(make([]interface{}, 0, nbFields))
-			},
-		},
-		rows: make([]*Row, 0, maxSize),
+		pool:     pool,
+		rows:     make([]*Row, 0, maxSize),
 	}
 	return &r
 }
 
+// BatchPool recycles a fixed number of batches of rows. The batches share
+// their rows, so that the rows of an uploaded batch are reused by the batch
+// being filled. GetBatch blocks while all the batches are in use.
+type BatchPool struct {
+	free chan *Rows
+}
+
+func NewBatchPool(nbBatches int, maxSize int, nbFields int) *BatchPool {
+	b := BatchPool{free: make(chan *Rows, nbBatches)}
+	pool := newRowPool(nbFields)
+	for i := 0; i < nbBatches; i++ {
+		b.free <- newRows(maxSize, nbFields, pool)
+	}
+	return &b
+}
+
+func (b *BatchPool) GetBatch() *Rows {
+	return <-b.free
+}
+
+func (b *BatchPool) PutBatch(r *Rows) {
+	r.Clear()
+	b.free <- r
+}
+
 func (r *Rows) GetRow() (*Row, bool) {
 	if len(r.rows) < r.maxSize {
 		row := r.pool.Get().(Row)
@@ -167,7 +262,7 @@ func (r *Rows) GetSource() (s *Source, err error) {
 			return nil, fmt.Errorf("wrong number of fields (for line %d, expected %d, got %d)", i, r.nbFields, len(*row))
 		}
 	}
-	return &Source{r: r}, nil
+	return newSource(r.rows), nil
 }
 
 func (r *Rows) String() string {
@@ -194,31 +289,62 @@ func (r *Rows) Len() int {
 }
 
 type Source struct {
-	r   *Rows
-	idx int
+	rows []*Row
+	idx  int
+}
+
+func newSource(rows []*Row) *Source {
+	// Next is called before the first row
+	return &Source{rows: rows, idx: -1}
 }
 
 func (s *Source) Next() bool {
 	s.idx++
-	return s.idx < s.r.Len()
+	return s.idx < len(s.rows)
 }
 
 func (s *Source) Values() ([]interface{}, error) {
-	return ([]interface{})(*(s.r.rows[s.idx])), nil
+	return ([]interface{})(*(s.rows[s.idx])), nil
 }
 
 func (s *Source) Err() error {
 	return nil
 }
 
-func uploadPG(f io.Reader, excludes map[string]bool, connPool *pgx.ConnPool, bsize int) (nbLines int, err error) {
-	p := parser.NewFileParser(f)
+// uploadPG uploads the lines of a log file to the database. When the IDs are
+// deterministic, the rows are copied into a staging table first, and then
+// merged into the target table: nbSkipped is the number of lines that were
+// already stored.
+//
+// The lines are parsed into batches while the previous batches are uploaded
+// by --copiers connections. The batches are committed in order.
+//
+// The upload starts at the resume position, which needs f to be seekable.
+// save, if not nil, records the position after each batch, in the transaction
+// of the batch. last is the position after the last committed batch, or the
+// end of the file.
+//
+// The batches that fail with a transient error are retried. When the dead
+// letter file is enabled, the rows rejected by the database are isolated by
+// bisection of their batch, and written to the dead-letter file: nbRejected
+// is the number of rejected rows.
+func uploadPG(f io.Reader, ids *rowIDs, excludes map[string]bool, connPool *pgx.ConnPool, bsize int, resume checkpoint, save func(txn *pgx.Tx, cp checkpoint) error) (nbLines int, nbSkipped int, nbRejected int, last checkpoint, err error) {
+	last = resume
+	p := setupParser(parser.NewFileParser(f))
 	err = p.ParseHeader()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error building parser:", err)
-		return 0, err
+		return 0, 0, 0, last, err
 	}
-	rawFnames := p.FieldNames()
+	if resume.offset > 0 {
+		err = p.SeekTo(resume.offset)
+		if err != nil {
+			return 0, 0, 0, last, err
+		}
+		ids.lineNum = resume.lines
+	}
+	rawFnames := enrichedNames(p)
+	clearedFnames := excludedHeaders(p.FieldNames(), excludes)
 	fNames := make([]string, 0, len(rawFnames))
 	fNames = append(fNames, "id")
 	if !p.HasGmtTime() {
@@ -230,7 +356,24 @@ func uploadPG(f io.Reader, excludes map[string]bool, connPool *pgx.ConnPool, bsi
 		}
 		fNames = append(fNames, fName)
 	}
+	// extras are the fields stored in the extra column
+	fNames, extras := splitColumns(fNames)
+	if targetSchema != nil {
+		var missing []string
+		fNames, missing, err = targetSchema.evolve(fNames)
+		if err != nil {
+			return 0, 0, 0, last, err
+		}
+		extras = append(extras, missing...)
+	}
+	if len(extras) > 0 {
+		fNames = append(fNames, extraColumn)
+	}
 	nbFields := len(fNames)
+	pipeline, err := buildPipeline(p, clearedFnames)
+	if err != nil {
+		return 0, 0, 0, last, err
+	}
 
 	columnNames := make([]string, 0, nbFields)
 	types := make(map[string]parser.Kind, nbFields)
@@ -238,83 +381,302 @@ func uploadPG(f io.Reader, excludes map[string]bool, connPool *pgx.ConnPool, bsi
 		// make sure column names are PG compatible
 		columnNames = append(columnNames, pgKey(fName))
 		// store the data type for each column
-		types[fName] = parser.GuessType(fName)
+		types[fName] = guessType(fName)
 	}
 
-	factory := RowFactory(bsize, nbFields)
 	txnOpts := &pgx.TxOptions{
 		IsoLevel: pgx.ReadCommitted,
 	}
 
-	uploadRows := func() error {
-		if factory.Len() == 0 {
-			return nil
+	// the parser fills a batch while the copiers upload the queued batches
+	batches := NewBatchPool(queueSize+int(copiers)+1, bsize, nbFields)
+	queue := make(chan *pgBatch, queueSize)
+	order := newCommitOrder()
+
+	// copyRows copies the rows lo to hi of a batch, and returns the number of
+	// inserted rows.
+	copyRows := func(txn *pgx.Tx, b *pgBatch, lo int, hi int) (int, error) {
+		s := newSource(b.rows.rows[lo:hi])
+		if !deterministicIDs() {
+			return txn.CopyFrom(pgx.Identifier{tableName}, columnNames, s)
 		}
-		s, err := factory.GetSource()
+		_, err := txn.CopyFrom(pgx.Identifier{stagingTable(tableName)}, columnNames, s)
 		if err != nil {
-			return err
+			return 0, err
+		}
+		tag, err := txn.Exec(buildMergeStmt(tableName, columnNames))
+		if err != nil {
+			return 0, err
+		}
+		_, err = txn.Exec(buildTruncateStagingStmt(tableName))
+		if err != nil {
+			return 0, err
+		}
+		return int(tag.RowsAffected()), nil
+	}
+
+	// rejectRow returns the dead-letter record of a row of a batch.
+	rejectRow := func(b *pgBatch, i int, err error) deadRecord {
+		row := *b.rows.rows[i]
+		fields := make(map[string]interface{}, len(row))
+		for j, value := range row {
+			if fNames[j] == "id" {
+				if id, err := uuid.FromBytes(value.([]byte)); err == nil {
+					fields["id"] = id.String()
+				}
+				continue
+			}
+			fields[columnNames[j]] = deadValue(value)
+		}
+		return deadRecord{
+			Source: ids.source,
+			Line:   b.positions[i].lines,
+			Offset: b.positions[i].offset,
+			Error:  err.Error(),
+			Fields: fields,
+			Time:   time.Now().UTC(),
+		}
+	}
+
+	uploadBatch := func(b *pgBatch) (skipped int, rejected []deadRecord, err error) {
+		_, err = b.rows.GetSource()
+		if err != nil {
+			return 0, nil, err
 		}
 		txn, err := connPool.BeginEx(context.Background(), txnOpts)
 		if err != nil {
-			return err
+			return 0, nil, err
 		}
 		defer txn.Rollback()
-		_, err = txn.CopyFrom(pgx.Identifier{tableName}, columnNames, s)
+		if deterministicIDs() {
+			_, err = txn.Exec(buildStagingStmt(tableName))
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		var inserted int
+		if deadLetters == nil {
+			inserted, err = copyRows(txn, b, 0, b.rows.Len())
+		} else {
+			inserted, err = copyBisect(txn, 0, b.rows.Len(), func(lo int, hi int) (int, error) {
+				return copyRows(txn, b, lo, hi)
+			}, func(i int, err error) {
+				rejected = append(rejected, rejectRow(b, i, err))
+			})
+		}
 		if err != nil {
-			return err
+			return 0, nil, err
+		}
+		if deterministicIDs() {
+			skipped = b.rows.Len() - len(rejected) - inserted
+		}
+		err = order.wait(b.seq)
+		if err != nil {
+			return 0, nil, err
+		}
+		if save != nil {
+			err = save(txn, b.end)
+			if err != nil {
+				return 0, nil, err
+			}
 		}
 		err = txn.Commit()
+		if err != nil {
+			return 0, nil, err
+		}
+		return skipped, rejected, nil
+	}
+
+	uploadRetry := func(b *pgBatch) error {
+		var skipped int
+		var rejected []deadRecord
+		err := withRetry(fmt.Sprintf("Upload of '%s' (line %d)", ids.source, b.positions[0].lines), func() (err error) {
+			skipped, rejected, err = uploadBatch(b)
+			return err
+		})
 		if err != nil {
 			return err
 		}
-		factory.Clear()
+		// the batches are committed one at a time
+		rejected = append(b.invalid, rejected...)
+		nbSkipped += skipped
+		nbRejected += len(rejected)
+		last = b.end
+		if len(rejected) > 0 {
+			err = deadLetters.write(rejected)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing the dead-letter file: %s\n", err)
+			}
+		}
 		return nil
 	}
 
-	var full bool
-	var row *Row
-	var line *parser.Line
+	var wg sync.WaitGroup
+	for i := uint8(0); i < copiers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range queue {
+				if order.failed() == nil {
+					order.done(b.seq, uploadRetry(b))
+				}
+				batches.PutBatch(b.rows)
+			}
+		}()
+	}
 
-	for {
-		line, err = p.NextTo(line)
-		if line == nil || err != nil {
-			break
-		}
+	batch := newPGBatch(0, batches.GetBatch(), resume)
+	// partitions stores the partitions needed by the current batch
+	partitions := make(map[time.Time]bool)
 
-		row, full = factory.GetRow()
-		if full {
-			// we have batchsize lines, let's flush
-			err = uploadRows()
+	sendBatch := func() error {
+		err := order.failed()
+		if err != nil {
+			return err
+		}
+		if tablePartitioner != nil {
+			if tablePartitioner.missing(partitions) {
+				// the uploading batches lock the table
+				err = order.wait(batch.seq)
+				if err != nil {
+					return err
+				}
+			}
+			err = tablePartitioner.ensure(partitions, fNames)
 			if err != nil {
-				return 0, err
+				return err
 			}
-			row, _ = factory.GetRow()
+			partitions = make(map[time.Time]bool)
 		}
+		queue <- batch
+		batch = newPGBatch(batch.seq+1, batches.GetBatch(), batch.end)
+		return nil
+	}
 
-		nbLines++
-		for _, fName := range fNames {
-			if fName == "id" {
-				uuid := uuid.NewV1()
-				err := row.AddField(uuid.Bytes())
-				if err != nil {
-					return 0, err
-				}
+	// invalidLine returns the dead-letter record of a line with a value that
+	// does not match the type of its column.
+	invalidLine := func(line *parser.Line, id uuid.UUID, start int64, err error) deadRecord {
+		fields := make(map[string]interface{}, len(fNames))
+		for j, fName := range fNames {
+			switch fName {
+			case "id":
+				fields["id"] = id.String()
+			case extraColumn:
+			default:
+				fields[columnNames[j]] = line.Get(fName)
+			}
+		}
+		return deadRecord{
+			Source: ids.source,
+			Line:   ids.lineNum,
+			Offset: start,
+			Error:  err.Error(),
+			Fields: fields,
+			Time:   time.Now().UTC(),
+		}
+	}
+
+	// values stores the converted values of the current line
+	values := make([]interface{}, len(fNames))
+
+	parse := func() error {
+		var full bool
+		var row *Row
+		var line *parser.Line
+		var keep bool
+		var id uuid.UUID
+		var err error
+
+		for {
+			start := p.Offset()
+			line, err = p.NextTo(line)
+			if line == nil || err != nil {
+				break
+			}
+			// the ID is computed from the line as it was parsed
+			id, err = ids.next(line, start)
+			if err != nil {
+				return err
+			}
+			keep, err = pipeline.Process(line)
+			if err != nil {
+				return err
+			}
+			if !keep {
 				continue
 			}
-			// append converted type
-			err = row.AddField(pgConvert(types[fName], line.Get(fName)))
+
+			err = convertLine(line, fNames, types, values)
 			if err != nil {
-				return 0, err
+				if deadLetters == nil {
+					return fmt.Errorf("line %d: %s", ids.lineNum, err)
+				}
+				// the line is rejected with the next batch, so that it is
+				// written to the dead-letter file once the lines before it
+				// are committed
+				batch.invalid = append(batch.invalid, invalidLine(line, id, start, err))
+				batch.end = checkpoint{lines: ids.lineNum, offset: p.Offset()}
+				continue
+			}
+
+			row, full = batch.rows.GetRow()
+			if full {
+				// we have batchsize lines, let's flush
+				err = sendBatch()
+				if err != nil {
+					return err
+				}
+				row, _ = batch.rows.GetRow()
+			}
+
+			nbLines++
+			batch.positions = append(batch.positions, checkpoint{lines: ids.lineNum, offset: start})
+			batch.end = checkpoint{lines: ids.lineNum, offset: p.Offset()}
+			if tablePartitioner != nil {
+				partitions[tablePartitioner.startOf(line.GetTime())] = true
 			}
+			for j, fName := range fNames {
+				switch fName {
+				case "id":
+					err = row.AddField(id.Bytes())
+				case extraColumn:
+					err = row.AddField(extraValue(line, extras))
+				default:
+					err = row.AddField(values[j])
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// push remaining lines
+		if batch.rows.Len() > 0 {
+			return sendBatch()
 		}
+		batches.PutBatch(batch.rows)
+		return nil
 	}
 
-	// push remaining lines
-	err = uploadRows()
+	err = parse()
+	close(queue)
+	wg.Wait()
+	if err == nil || err == errAborted {
+		// report the error of the failed batch
+		err = order.failed()
+	}
 	if err != nil {
-		return 0, err
+		return 0, 0, 0, last, err
 	}
-	return nbLines, nil
+	if batch.rows.Len() == 0 && len(batch.invalid) > 0 {
+		// the invalid lines after the last batch
+		nbRejected += len(batch.invalid)
+		err = deadLetters.write(batch.invalid)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing the dead-letter file: %s\n", err)
+		}
+	}
+	return nbLines, nbSkipped, nbRejected, checkpoint{lines: ids.lineNum, offset: p.Offset()}, nil
 }
 
 // MyMyTime encapsulates parser.Time so that it can be serialized to PG.
@@ -342,6 +704,8 @@ func pgDefaultVal(t parser.Kind) interface{} {
 		return &pgtype.Date{Status: pgtype.Null}
 	case parser.MyIP:
 		return &pgtype.Inet{Status: pgtype.Null}
+	case parser.MyIPList:
+		return &pgtype.InetArray{Status: pgtype.Null}
 	case parser.MyTime:
 		var timePtr *MyMyTime
 		return timePtr
@@ -355,51 +719,133 @@ func pgDefaultVal(t parser.Kind) interface{} {
 		return &pgtype.Int8{Status: pgtype.Null}
 	case parser.Bool:
 		return &pgtype.Bool{Status: pgtype.Null}
+	case parser.Map:
+		return &pgtype.JSONB{Status: pgtype.Null}
+	case parser.MyGeoPoint:
+		return &pgtype.Point{Status: pgtype.Null}
 	case parser.String:
 		return ""
 	}
 	return ""
 }
 
-func pgConvert(t parser.Kind, value interface{}) interface{} {
+// convertLine converts the values of the given fields of a line to the types
+// of their columns. The id and the extra column are not converted.
+func convertLine(line *parser.Line, fNames []string, types map[string]parser.Kind, values []interface{}) (err error) {
+	for j, fName := range fNames {
+		if fName == "id" || fName == extraColumn {
+			continue
+		}
+		values[j], err = pgConvert(types[fName], line.Get(fName))
+		if err != nil {
+			return fmt.Errorf("field '%s': %s (%T)", fName, err, line.Get(fName))
+		}
+	}
+	return nil
+}
+
+// errKindMismatch is returned by pgConvert for a value that does not have the
+// type of its column, like a string transformed by a stage that does not
+// declare its kind.
+var errKindMismatch = errors.New("the value does not have the type of the column")
+
+// pgConvert converts a field value to the type of its column. It returns
+// errKindMismatch if the value does not have the expected type.
+func pgConvert(t parser.Kind, value interface{}) (interface{}, error) {
 	if value == nil {
-		return pgDefaultVal(t)
+		return pgDefaultVal(t), nil
 	}
 	switch t {
 	case parser.MyDate:
-		v := value.(parser.Date)
+		v, ok := value.(parser.Date)
+		if !ok {
+			return nil, errKindMismatch
+		}
 		if v.IsZero() {
-			return pgDefaultVal(t)
+			return pgDefaultVal(t), nil
 		}
-		return time.Date(v.Year, v.Month, v.Day, 0, 0, 0, 0, time.UTC)
+		return time.Date(v.Year, v.Month, v.Day, 0, 0, 0, 0, time.UTC), nil
 	case parser.MyIP:
+		v, ok := value.(net.IP)
+		if !ok {
+			return nil, errKindMismatch
+		}
 		inet := &pgtype.Inet{}
-		inet.Set(value.(net.IP))
-		return inet
+		inet.Set(v)
+		return inet, nil
+	case parser.MyIPList:
+		v, ok := value.([]net.IP)
+		if !ok {
+			return nil, errKindMismatch
+		}
+		// the invalid hops are stored as NULL elements
+		elements := make([]pgtype.Inet, len(v))
+		for i, ip := range v {
+			if ip == nil {
+				elements[i].Status = pgtype.Null
+			} else {
+				elements[i].Set(ip)
+			}
+		}
+		return &pgtype.InetArray{
+			Elements:   elements,
+			Dimensions: []pgtype.ArrayDimension{{Length: int32(len(elements)), LowerBound: 1}},
+			Status:     pgtype.Present,
+		}, nil
 	case parser.MyTime:
-		v := value.(parser.Time)
+		v, ok := value.(parser.Time)
+		if !ok {
+			return nil, errKindMismatch
+		}
 		if v.IsZero() {
-			return pgDefaultVal(t)
+			return pgDefaultVal(t), nil
 		}
-		return &MyMyTime{Time: v}
+		return &MyMyTime{Time: v}, nil
 	case parser.MyTimestamp:
-		v := value.(time.Time)
+		v, ok := value.(time.Time)
+		if !ok {
+			return nil, errKindMismatch
+		}
 		if v.IsZero() {
-			return pgDefaultVal(t)
+			return pgDefaultVal(t), nil
 		}
-		return &pgtype.Timestamptz{Status: pgtype.Present, Time: v}
-	case parser.MyURI:
-		return decodeCharset(value.(string))
+		return &pgtype.Timestamptz{Status: pgtype.Present, Time: v}, nil
 	case parser.Float64:
-		return value.(float64)
+		v, ok := value.(float64)
+		if !ok {
+			return nil, errKindMismatch
+		}
+		return v, nil
 	case parser.Int64:
-		return value.(int64)
+		v, ok := value.(int64)
+		if !ok {
+			return nil, errKindMismatch
+		}
+		return v, nil
 	case parser.Bool:
-		return value.(bool)
-	case parser.String:
-		return decodeCharset(value.(string))
+		v, ok := value.(bool)
+		if !ok {
+			return nil, errKindMismatch
+		}
+		return v, nil
+	case parser.Map:
+		jsonb := &pgtype.JSONB{}
+		if err := jsonb.Set(decodeCharsets(value)); err != nil {
+			return nil, err
+		}
+		return jsonb, nil
+	case parser.MyGeoPoint:
+		v, ok := value.(parser.GeoPoint)
+		if !ok {
+			return nil, errKindMismatch
+		}
+		return &pgtype.Point{Status: pgtype.Present, P: pgtype.Vec2{X: v.Lon, Y: v.Lat}}, nil
+	}
+	v, ok := value.(string)
+	if !ok {
+		return nil, errKindMismatch
 	}
-	return decodeCharset(value.(string))
+	return decodeCharset(v), nil
 }
 
 func decodeCharset(s string) string {
@@ -413,6 +859,38 @@ func decodeCharset(s string) string {
 	return unidecode.Unidecode(s)
 }
 
+// decodeCharsets applies decodeCharset to the strings stored in a map field.
+func decodeCharsets(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return decodeCharset(v)
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			ret[decodeCharset(key)] = decodeCharsets(val)
+		}
+		return ret
+	case map[string]string:
+		ret := make(map[string]string, len(v))
+		for key, val := range v {
+			ret[decodeCharset(key)] = decodeCharset(val)
+		}
+		return ret
+	case map[string][]string:
+		ret := make(map[string][]string, len(v))
+		for key, vals := range v {
+			decoded := make([]string, 0, len(vals))
+			for _, val := range vals {
+				decoded = append(decoded, decodeCharset(val))
+			}
+			ret[decodeCharset(key)] = decoded
+		}
+		return ret
+	default:
+		return value
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(push2pgCmd)
 	push2pgCmd.Flags().StringArrayVar(&filenames, "filename", []string{}, "file to be parsed (can be repeated)")
@@ -421,4 +899,17 @@ func init() {
 	push2pgCmd.Flags().Uint8Var(&parallel, "parallel", 1, "number of parallel injectors")
 	push2pgCmd.Flags().IntVar(&batchsize, "batchsize", 5000, "batch size for postgresql INSERT")
 	push2pgCmd.Flags().StringArrayVar(&excludedFields, "exclude", []string{}, "exclude that field from collection (can be repeated)")
+	push2pgCmd.Flags().BoolVar(&groupHeaders, "headers", false, "group the HTTP header fields into JSONB request_headers and response_headers columns")
+	addMapFlags(push2pgCmd)
+	addEnrichFlags(push2pgCmd)
+	addWhereFlag(push2pgCmd)
+	addTimeFlags(push2pgCmd)
+	addIDModeFlag(push2pgCmd)
+	addPGLedgerFlags(push2pgCmd)
+	addPartitionFlags(push2pgCmd)
+	addSchemaPolicyFlag(push2pgCmd)
+	addColumnsFlag(push2pgCmd)
+	addPipelineFlags(push2pgCmd)
+	addRetryFlags(push2pgCmd)
+	addDeadLetterFlag(push2pgCmd)
 }
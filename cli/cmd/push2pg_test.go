@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/pgtype"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+func TestPGConvert(t *testing.T) {
+	tests := []struct {
+		kind  parser.Kind
+		value interface{}
+	}{
+		{parser.Int64, int64(200)},
+		{parser.Float64, 0.5},
+		{parser.Bool, true},
+		{parser.String, "alice"},
+		{parser.MyIP, net.ParseIP("10.0.0.5")},
+		{parser.MyIPList, []net.IP{nil, net.ParseIP("10.1.2.3")}},
+		{parser.MyTimestamp, time.Date(2024, 3, 1, 0, 0, 1, 0, time.UTC)},
+		{parser.MyDate, parser.Date{Year: 2024, Month: 3, Day: 1}},
+		{parser.Map, map[string]string{"sid": "abc"}},
+	}
+	for _, test := range tests {
+		v, err := pgConvert(test.kind, test.value)
+		if err != nil || v == nil {
+			t.Errorf("%#v: got %v %v", test.value, v, err)
+		}
+	}
+	if v, err := pgConvert(parser.Int64, nil); err != nil || !reflect.DeepEqual(v, pgDefaultVal(parser.Int64)) {
+		t.Errorf("nil: got %v %v", v, err)
+	}
+	if v, _ := pgConvert(parser.MyIPList, []net.IP{nil}); v.(*pgtype.InetArray).Elements[0].Status != pgtype.Null {
+		t.Errorf("an invalid hop is not NULL: got %v", v)
+	}
+
+	// the values that do not have the type of their column are rejected
+	invalid := []struct {
+		kind  parser.Kind
+		value interface{}
+	}{
+		{parser.Int64, "pseudonym"},
+		{parser.Float64, int64(1)},
+		{parser.Bool, "true"},
+		{parser.String, int64(200)},
+		{parser.MyIP, "10.0.0.0"},
+		{parser.MyIPList, net.ParseIP("10.0.0.5")},
+		{parser.MyTimestamp, "2024-03-01"},
+		{parser.MyDate, time.Now()},
+		{parser.MyTime, "00:00:01"},
+		{parser.MyGeoPoint, "48.8,2.3"},
+	}
+	for _, test := range invalid {
+		if v, err := pgConvert(test.kind, test.value); err != errKindMismatch {
+			t.Errorf("%#v: got %v %v", test.value, v, err)
+		}
+	}
+}
+
+func TestConvertLine(t *testing.T) {
+	p := parser.NewFileParser(strings.NewReader("#Fields: date time c-ip sc-status\n2024-03-01 00:00:01 10.0.0.5 200\n"))
+	err := p.ParseHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := p.Next()
+	if err != nil || l == nil {
+		t.Fatalf("got %v %v", l, err)
+	}
+	fNames := []string{"id", "c-ip", "sc-status"}
+	types := map[string]parser.Kind{"c-ip": parser.MyIP, "sc-status": parser.Int64}
+	values := make([]interface{}, len(fNames))
+	err = convertLine(l, fNames, types, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0] != nil || values[2] != int64(200) {
+		t.Errorf("got %v", values)
+	}
+
+	// a stage replaced the status with a string
+	l.Set("sc-status", "pseudonym")
+	err = convertLine(l, fNames, types, values)
+	if err == nil || !strings.Contains(err.Error(), "sc-status") {
+		t.Errorf("got %v", err)
+	}
+}
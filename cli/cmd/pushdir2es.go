@@ -22,6 +22,10 @@ var pushdir2esCmd = &cobra.Command{
 		if len(input) == 0 {
 			fatal(errors.New("specify an input directory"))
 		}
+		fatal(checkPartialPolicy())
+		fatal(buildEnrichers())
+		fatal(buildTimeRange())
+		defer closeEnrichers()
 		curdir, err := os.Getwd()
 		fatal(err)
 		curdir, err = filepath.Abs(curdir)
@@ -31,6 +35,7 @@ var pushdir2esCmd = &cobra.Command{
 
 		inputFiles, err := findFiles(input, extension)
 		fatal(err)
+		inputFiles = pruneFiles(inputFiles)
 
 		if len(inputFiles) == 0 {
 			fmt.Fprintln(os.Stderr, "No file to process.")
@@ -48,6 +53,9 @@ var pushdir2esCmd = &cobra.Command{
 
 		_, err = getESClient(params, logger)
 		fatal(err)
+		fatal(openFileLedger())
+		fatal(openDeadLetter())
+		defer closeDeadLetter()
 
 		excludes := make(map[string]bool)
 		for _, fName := range excludedFields {
@@ -57,11 +65,10 @@ var pushdir2esCmd = &cobra.Command{
 		excludes["time"] = true
 
 		for report := range uploadFilesES(params, inputFiles, batchsize, excludes, time.Month(onlyMonth), int(parallel), logger) {
-			if report.err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to upload '%s': %s\n", report.filename, report.err.Error())
-			} else {
-				fmt.Fprintf(os.Stderr, "Uploaded '%s': %d lines\n", report.filename, report.nbLines)
+			if report.err == errSkipped {
+				continue
 			}
+			report.print()
 		}
 
 	},
@@ -79,4 +86,12 @@ func init() {
 	pushdir2esCmd.Flags().StringArrayVar(&excludedFields, "exclude", []string{}, "exclude that field from collection (can be repeated)")
 	pushdir2esCmd.Flags().IntVar(&onlyMonth, "month", 0, "Only upload logs from that month")
 	pushdir2esCmd.Flags().Uint8Var(&parallel, "parallel", 1, "number of parallel injectors")
+	pushdir2esCmd.Flags().BoolVar(&groupHeaders, "headers", false, "group the HTTP header fields into request.headers and response.headers objects")
+	addMapFlags(pushdir2esCmd)
+	addEnrichFlags(pushdir2esCmd)
+	addWhereFlag(pushdir2esCmd)
+	addRetryFlags(pushdir2esCmd)
+	addDeadLetterFlag(pushdir2esCmd)
+	addTimeFlags(pushdir2esCmd)
+	addESLedgerFlags(pushdir2esCmd)
 }
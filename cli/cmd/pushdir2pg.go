@@ -25,6 +25,16 @@ var pushdir2pgCmd = &cobra.Command{
 		if len(input) == 0 {
 			fatal(errors.New("specify an input directory"))
 		}
+		fatal(checkIDMode())
+		fatal(checkPartialPolicy())
+		fatal(checkAutoPartition())
+		fatal(checkSchemaPolicy())
+		checkPipeline()
+		fatal(openDeadLetter())
+		defer closeDeadLetter()
+		fatal(buildEnrichers())
+		fatal(buildTimeRange())
+		defer closeEnrichers()
 		curdir, err := os.Getwd()
 		fatal(err)
 		curdir, err = filepath.Abs(curdir)
@@ -34,6 +44,7 @@ var pushdir2pgCmd = &cobra.Command{
 
 		inputFiles, err := findFiles(input, extension)
 		fatal(err)
+		inputFiles = pruneFiles(inputFiles)
 
 		if len(inputFiles) == 0 {
 			fmt.Fprintln(os.Stderr, "No file to process.")
@@ -53,10 +64,11 @@ var pushdir2pgCmd = &cobra.Command{
 		fatal(err)
 		pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
 			ConnConfig:     config,
-			MaxConnections: int(parallel),
+			MaxConnections: int(parallel)*int(copiers) + 1, // one more for the ledger and the partitions
 		})
 		fatal(err)
 		defer pool.Close()
+		fatal(openPGLedger(pool))
 
 		excludes := make(map[string]bool)
 		for _, fName := range excludedFields {
@@ -64,6 +76,8 @@ var pushdir2pgCmd = &cobra.Command{
 		}
 		excludes["time"] = true
 		excludes["date"] = true
+		fatal(openPartitioner(pool, excludes))
+		fatal(openSchema(pool))
 
 		uploadFilesPG(inputFiles, excludes, pool, uint(parallel), batchsize)
 
@@ -79,4 +93,17 @@ func init() {
 	pushdir2pgCmd.Flags().Uint8Var(&parallel, "parallel", 1, "number of parallel injectors")
 	pushdir2pgCmd.Flags().IntVar(&batchsize, "batchsize", 5000, "batch size for postgresql INSERT")
 	pushdir2pgCmd.Flags().StringArrayVar(&excludedFields, "exclude", []string{}, "exclude that field from collection (can be repeated)")
+	pushdir2pgCmd.Flags().BoolVar(&groupHeaders, "headers", false, "group the HTTP header fields into JSONB request_headers and response_headers columns")
+	addMapFlags(pushdir2pgCmd)
+	addEnrichFlags(pushdir2pgCmd)
+	addWhereFlag(pushdir2pgCmd)
+	addTimeFlags(pushdir2pgCmd)
+	addIDModeFlag(pushdir2pgCmd)
+	addPGLedgerFlags(pushdir2pgCmd)
+	addPartitionFlags(pushdir2pgCmd)
+	addSchemaPolicyFlag(pushdir2pgCmd)
+	addColumnsFlag(pushdir2pgCmd)
+	addPipelineFlags(pushdir2pgCmd)
+	addRetryFlags(pushdir2pgCmd)
+	addDeadLetterFlag(pushdir2pgCmd)
 }
@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+var rdnsFields []string
+var rdnsResolver string
+var rdnsWorkers int
+var rdnsCacheFile string
+var rdnsTTL time.Duration
+var rdnsTimeout time.Duration
+
+func addRDNSFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&rdnsFields, "rdns-field", []string{}, "IP field to resolve with a reverse DNS lookup (can be repeated)")
+	cmd.Flags().StringVar(&rdnsResolver, "rdns-resolver", "", "address of the DNS server to use (host:port), instead of the system resolver")
+	cmd.Flags().IntVar(&rdnsWorkers, "rdns-workers", 16, "maximum number of concurrent DNS lookups")
+	cmd.Flags().StringVar(&rdnsCacheFile, "rdns-cache", "", "file where the DNS lookup results are kept between runs")
+	cmd.Flags().DurationVar(&rdnsTTL, "rdns-ttl", 24*time.Hour, "how long the DNS lookup results are kept in cache")
+	cmd.Flags().DurationVar(&rdnsTimeout, "rdns-timeout", 2*time.Second, "timeout of a DNS lookup")
+}
+
+// rdnsRetryDelay is how long a failed lookup is kept in cache.
+const rdnsRetryDelay = time.Minute
+
+// rdnsMinSweep is the cache size that triggers the first removal of the
+// expired entries.
+const rdnsMinSweep = 4096
+
+// rdnsEntry is the result of the reverse lookup of an IP. Confirmed is true
+// when the name resolves back to the IP.
+type rdnsEntry struct {
+	Name      string    `json:"name"`
+	Confirmed bool      `json:"confirmed"`
+	Expires   time.Time `json:"expires"`
+}
+
+// rdnsCall is a lookup in progress, shared by the callers that need the same
+// IP at the same time, like the uploads of several files.
+type rdnsCall struct {
+	done  chan struct{}
+	entry rdnsEntry
+}
+
+// rdnsEnricher adds the dns.<field>.name and dns.<field>.confirmed fields for
+// each configured IP field.
+type rdnsEnricher struct {
+	ipFields  []string
+	resolver  *net.Resolver
+	timeout   time.Duration
+	ttl       time.Duration
+	cacheFile string
+	// sem bounds the number of concurrent lookups
+	sem      chan struct{}
+	mu       sync.Mutex
+	cache    map[string]rdnsEntry
+	inflight map[string]*rdnsCall
+	// nextSweep is the cache size that triggers the next removal of the
+	// expired entries
+	nextSweep int
+}
+
+func newRDNSEnricher(ipFields []string, resolver string, workers int, cacheFile string, ttl time.Duration, timeout time.Duration) (*rdnsEnricher, error) {
+	if workers <= 0 {
+		workers = 1
+	}
+	e := &rdnsEnricher{
+		ipFields:  ipFields,
+		resolver:  net.DefaultResolver,
+		timeout:   timeout,
+		ttl:       ttl,
+		cacheFile: cacheFile,
+		sem:       make(chan struct{}, workers),
+		cache:     make(map[string]rdnsEntry),
+		inflight:  make(map[string]*rdnsCall),
+		nextSweep: rdnsMinSweep,
+	}
+	if resolver != "" {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+		e.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, resolver)
+			},
+		}
+	}
+	if cacheFile != "" {
+		err := e.loadCache()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// loadCache reads the lookup results saved by a previous run. The expired
+// entries are dropped.
+func (e *rdnsEnricher) loadCache() error {
+	content, err := ioutil.ReadFile(e.cacheFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cache := make(map[string]rdnsEntry)
+	err = json.Unmarshal(content, &cache)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for ip, entry := range cache {
+		if entry.Expires.After(now) {
+			e.cache[ip] = entry
+		}
+	}
+	return nil
+}
+
+// Close saves the lookup results that have not expired to the cache file.
+func (e *rdnsEnricher) Close() error {
+	if e.cacheFile == "" {
+		return nil
+	}
+	e.mu.Lock()
+	e.sweep()
+	content, err := json.Marshal(e.cache)
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(e.cacheFile, content)
+}
+
+// writeFileAtomic writes to a temporary file first, and then renames it, so
+// that an interrupted run does not leave a truncated file.
+func writeFileAtomic(fname string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fname)
+}
+
+func (e *rdnsEnricher) Fields(names []string) (added []string, removed []string) {
+	for _, ipField := range e.ipFields {
+		for _, name := range names {
+			if name == ipField {
+				added = append(added, "dns."+ipField+".name", "dns."+ipField+".confirmed")
+				break
+			}
+		}
+	}
+	return added, nil
+}
+
+func (e *rdnsEnricher) Kind(name string) (parser.Kind, bool) {
+	for _, ipField := range e.ipFields {
+		switch name {
+		case "dns." + ipField + ".name":
+			return parser.String, true
+		case "dns." + ipField + ".confirmed":
+			return parser.Bool, true
+		}
+	}
+	return parser.Invalid, false
+}
+
+func (e *rdnsEnricher) Process(l *parser.Line) (bool, error) {
+	for _, ipField := range e.ipFields {
+		if !l.Has(ipField) {
+			continue
+		}
+		prefix := "dns." + ipField + "."
+		ip, ok := l.Get(ipField).(net.IP)
+		if !ok {
+			l.Set(prefix+"name", nil)
+			l.Set(prefix+"confirmed", nil)
+			continue
+		}
+		entry := e.lookup(ip)
+		if entry.Name == "" {
+			l.Set(prefix+"name", nil)
+			l.Set(prefix+"confirmed", nil)
+			continue
+		}
+		l.Set(prefix+"name", entry.Name)
+		l.Set(prefix+"confirmed", entry.Confirmed)
+	}
+	return true, nil
+}
+
+// lookup returns the cached result for ip, or resolves it. The expired
+// result is evicted. At most rdns-workers lookups run at the same time.
+func (e *rdnsEnricher) lookup(ip net.IP) rdnsEntry {
+	key := ip.String()
+	e.mu.Lock()
+	if entry, ok := e.cache[key]; ok {
+		if entry.Expires.After(time.Now()) {
+			e.mu.Unlock()
+			return entry
+		}
+		delete(e.cache, key)
+	}
+	if call, ok := e.inflight[key]; ok {
+		e.mu.Unlock()
+		<-call.done
+		return call.entry
+	}
+	call := &rdnsCall{done: make(chan struct{})}
+	e.inflight[key] = call
+	e.mu.Unlock()
+
+	e.sem <- struct{}{}
+	call.entry = e.resolve(ip)
+	<-e.sem
+
+	e.mu.Lock()
+	e.cache[key] = call.entry
+	delete(e.inflight, key)
+	if len(e.cache) >= e.nextSweep {
+		e.sweep()
+	}
+	e.mu.Unlock()
+	close(call.done)
+	return call.entry
+}
+
+// sweep removes the expired entries from the cache. The next sweep happens
+// when the size of the cache has doubled, so that the cost of the sweeps
+// stays proportional to the number of lookups. It must be called with e.mu
+// held.
+func (e *rdnsEnricher) sweep() {
+	now := time.Now()
+	for key, entry := range e.cache {
+		if !entry.Expires.After(now) {
+			delete(e.cache, key)
+		}
+	}
+	e.nextSweep = 2 * len(e.cache)
+	if e.nextSweep < rdnsMinSweep {
+		e.nextSweep = rdnsMinSweep
+	}
+}
+
+// resolve performs the reverse lookup of ip, and checks that the returned
+// names resolve back to ip. The first confirmed name is preferred.
+func (e *rdnsEnricher) resolve(ip net.IP) (entry rdnsEntry) {
+	entry.Expires = time.Now().Add(e.ttl)
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	names, err := e.resolver.LookupAddr(ctx, ip.String())
+	if dnsErr, ok := err.(*net.DNSError); ok && (dnsErr.IsTimeout || dnsErr.IsTemporary) {
+		// retry the transient failures sooner
+		if e.ttl > rdnsRetryDelay {
+			entry.Expires = time.Now().Add(rdnsRetryDelay)
+		}
+		return entry
+	}
+	if err != nil || len(names) == 0 {
+		return entry
+	}
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if entry.Name == "" {
+			entry.Name = name
+		}
+		addrs, err := e.resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				entry.Name = name
+				entry.Confirmed = true
+				return entry
+			}
+		}
+	}
+	return entry
+}
@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+)
+
+// fakeDNS answers the DNS queries of a net.Resolver through its Dial
+// function, from the PTR and A records of a map indexed by name.
+type fakeDNS struct {
+	ptr map[string]string
+	a   map[string]net.IP
+	// delay is the time taken by each query
+	delay   time.Duration
+	mu      sync.Mutex
+	queries int
+	active  int
+	max     int
+}
+
+func (d *fakeDNS) stats() (queries int, max int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queries, d.max
+}
+
+func (d *fakeDNS) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go d.serve(server)
+			return client, nil
+		},
+	}
+}
+
+// serve answers the queries sent on conn, with the TCP framing since a pipe
+// is not a net.PacketConn.
+func (d *fakeDNS) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		d.mu.Lock()
+		d.queries++
+		d.active++
+		if d.active > d.max {
+			d.max = d.active
+		}
+		d.mu.Unlock()
+		time.Sleep(d.delay)
+		d.mu.Lock()
+		d.active--
+		d.mu.Unlock()
+
+		resp := d.answer(query)
+		binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+		if _, err := conn.Write(append(size[:], resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// answer builds the response to a query with a single question.
+func (d *fakeDNS) answer(query []byte) []byte {
+	// the question starts after the 12 bytes header
+	var labels []string
+	i := 12
+	for query[i] != 0 {
+		labels = append(labels, string(query[i+1:i+1+int(query[i])]))
+		i += 1 + int(query[i])
+	}
+	question := query[12 : i+5]
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	var rdata []byte
+	switch qtype {
+	case dnsTypePTR:
+		if target, ok := d.ptr[name]; ok {
+			for _, label := range strings.Split(target, ".") {
+				rdata = append(append(rdata, byte(len(label))), label...)
+			}
+			rdata = append(rdata, 0)
+		}
+	case dnsTypeA:
+		if ip, ok := d.a[name]; ok {
+			rdata = ip.To4()
+		}
+	}
+	_, known := d.a[name]
+	_, knownPTR := d.ptr[name]
+
+	resp := make([]byte, 12, 512)
+	copy(resp, query[:2])
+	// response, authoritative, recursion desired and available
+	flags := uint16(0x8580)
+	if !known && !knownPTR {
+		// NXDOMAIN
+		flags |= 3
+	}
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	resp = append(resp, question...)
+	if rdata != nil {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		// the name is a pointer to the question
+		resp = append(resp, 0xc0, 12)
+		resp = append(resp, byte(qtype>>8), byte(qtype), 0, 1, 0, 0, 0, 60)
+		resp = append(resp, byte(len(rdata)>>8), byte(len(rdata)))
+		resp = append(resp, rdata...)
+	}
+	return resp
+}
+
+func newTestRDNSEnricher(t *testing.T, d *fakeDNS, workers int) *rdnsEnricher {
+	e, err := newRDNSEnricher([]string{"c-ip"}, "", workers, "", time.Hour, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.resolver = d.resolver()
+	return e
+}
+
+func TestRDNSResolve(t *testing.T) {
+	d := &fakeDNS{
+		ptr: map[string]string{
+			"5.0.0.10.in-addr.arpa": "host.example",
+			"6.0.0.10.in-addr.arpa": "spoofed.example",
+		},
+		a: map[string]net.IP{
+			"host.example":    net.ParseIP("10.0.0.5"),
+			"spoofed.example": net.ParseIP("10.9.9.9"),
+		},
+	}
+	e := newTestRDNSEnricher(t, d, 4)
+	tests := []struct {
+		ip        string
+		name      string
+		confirmed bool
+	}{
+		{"10.0.0.5", "host.example", true},
+		// the name does not resolve back to the IP
+		{"10.0.0.6", "spoofed.example", false},
+		{"10.0.0.7", "", false},
+	}
+	for _, test := range tests {
+		entry := e.lookup(net.ParseIP(test.ip))
+		if entry.Name != test.name || entry.Confirmed != test.confirmed {
+			t.Errorf("%s: got %+v", test.ip, entry)
+		}
+	}
+
+	// the results are cached
+	queries, _ := d.stats()
+	l := parser.NewLine([]string{"c-ip"})
+	l.Set("c-ip", net.ParseIP("10.0.0.5"))
+	keep, err := e.Process(l)
+	if !keep || err != nil {
+		t.Fatalf("got %v %v", keep, err)
+	}
+	if l.Get("dns.c-ip.name") != "host.example" || l.Get("dns.c-ip.confirmed") != true {
+		t.Errorf("got %v %v", l.Get("dns.c-ip.name"), l.Get("dns.c-ip.confirmed"))
+	}
+	if got, _ := d.stats(); got != queries {
+		t.Errorf("got %d queries, want %d", got, queries)
+	}
+}
+
+func TestRDNSWorkers(t *testing.T) {
+	d := &fakeDNS{delay: 20 * time.Millisecond}
+	e := newTestRDNSEnricher(t, d, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			e.lookup(net.IPv4(10, 0, 1, byte(i)))
+		}(i)
+	}
+	wg.Wait()
+	queries, max := d.stats()
+	if queries < 12 {
+		t.Errorf("got %d queries", queries)
+	}
+	if max > 2 {
+		t.Errorf("got %d concurrent lookups, want at most 2", max)
+	}
+}
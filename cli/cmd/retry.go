@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/olivere/elastic"
+	"github.com/spf13/cobra"
+)
+
+var retries int
+var retryWait time.Duration
+var retryMaxWait time.Duration
+
+func addRetryFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&retries, "retries", 3, "number of retries of a batch after a transient error")
+	cmd.Flags().DurationVar(&retryWait, "retry-wait", time.Second, "wait before the first retry, doubled at each retry")
+	cmd.Flags().DurationVar(&retryMaxWait, "retry-max-wait", 30*time.Second, "maximum wait between two retries")
+}
+
+// retryBackoff is an exponential backoff that stops after --retries retries.
+// It implements elastic.Backoff.
+type retryBackoff struct{}
+
+// Next returns the wait before the given retry, starting at 1.
+func (b retryBackoff) Next(retry int) (time.Duration, bool) {
+	if retry > retries {
+		return 0, false
+	}
+	wait := retryWait
+	for i := 1; i < retry && wait < retryMaxWait; i++ {
+		wait *= 2
+	}
+	if wait > retryMaxWait {
+		wait = retryMaxWait
+	}
+	return wait, true
+}
+
+// withRetry calls op until it succeeds, or returns an error that is not
+// retryable, or the retries are exhausted.
+func withRetry(what string, op func() error) error {
+	var b retryBackoff
+	for retry := 1; ; retry++ {
+		err := op()
+		if err == nil || !retryable(err) {
+			return err
+		}
+		wait, ok := b.Next(retry)
+		if !ok {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%s failed, retrying in %s: %s\n", what, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// retryablePGCodes are the Postgres errors that do not depend on the rows.
+var retryablePGCodes = map[string]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"53300": true, // too_many_connections
+	"55P03": true, // lock_not_available
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// retryable returns true if err is transient: the same operation may succeed
+// later.
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case pgx.PgError:
+		// class 08 is connection_exception
+		return retryablePGCodes[e.Code] || strings.HasPrefix(e.Code, "08")
+	case *elastic.Error:
+		return e.Status == 429 || e.Status == 502 || e.Status == 503 || e.Status == 504
+	case net.Error:
+		return true
+	}
+	switch err {
+	case pgx.ErrDeadConn, pgx.ErrAcquireTimeout, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	return elastic.IsConnErr(err)
+}
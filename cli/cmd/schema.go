@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+// The policies for the fields that have no column in the target table.
+const (
+	// schemaFail copies the fields anyway, so that the upload fails.
+	schemaFail = "fail"
+	// schemaAdd adds the missing columns to the table.
+	schemaAdd = "add"
+	// schemaDrop ignores the fields.
+	schemaDrop = "drop"
+	// schemaExtra stores the fields in the extra JSONB column.
+	schemaExtra = "extra"
+)
+
+// extraColumn is the JSONB column that stores the fields without a column.
+const extraColumn = "extra"
+
+var schemaPolicy string
+
+// typedColumns are the fields stored in typed columns, when the other fields
+// are stored in the extra column.
+var typedColumns []string
+
+// targetSchema knows the columns of the target table. It is nil when the
+// schema policy is fail.
+var targetSchema *tableSchema
+
+func addSchemaPolicyFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&schemaPolicy, "schema-policy", schemaFail, "what to do with the fields that have no column in the table: fail, add (add the columns), drop (ignore the fields) or extra (store them in an extra JSONB column)")
+}
+
+func addColumnsFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&typedColumns, "columns", []string{}, "if set, only these fields are stored in typed columns, and the other fields are stored in the extra JSONB column (comma separated)")
+}
+
+// splitColumns returns the fields that are stored in typed columns, and the
+// fields that are stored in the extra column, according to --columns. The id
+// and gmttime columns are always typed.
+func splitColumns(fNames []string) (columns []string, extras []string) {
+	if len(typedColumns) == 0 {
+		return fNames, nil
+	}
+	typed := make(map[string]bool, len(typedColumns))
+	for _, name := range typedColumns {
+		typed[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	for _, fName := range fNames {
+		if fName == "id" || fName == "gmttime" || typed[strings.ToLower(fName)] {
+			columns = append(columns, fName)
+		} else {
+			extras = append(extras, fName)
+		}
+	}
+	return columns, extras
+}
+
+func checkSchemaPolicy() error {
+	switch schemaPolicy {
+	case schemaFail, schemaAdd, schemaDrop, schemaExtra:
+		return nil
+	default:
+		return fmt.Errorf("invalid --schema-policy: '%s' (expected fail, add, drop or extra)", schemaPolicy)
+	}
+}
+
+// openSchema loads the columns of the target table, unless the schema policy
+// is fail. With --columns, the table needs the extra column: it is added,
+// unless the policy is drop.
+func openSchema(pool *pgx.ConnPool) error {
+	if schemaPolicy == schemaFail {
+		return nil
+	}
+	s, err := newTableSchema(pool, tableName, schemaPolicy)
+	if err != nil {
+		return err
+	}
+	if len(typedColumns) > 0 && !s.has(extraColumn) {
+		if schemaPolicy == schemaDrop {
+			return fmt.Errorf(
+				"table '%s' has no '%s' column for the fields that are not in --columns: add the column, or use --schema-policy add or extra",
+				tableName, extraColumn,
+			)
+		}
+		err = s.addColumn(extraColumn)
+		if err != nil {
+			return err
+		}
+	}
+	targetSchema = s
+	return nil
+}
+
+// tableSchema stores the columns of a table, and applies the schema policy to
+// the fields of the uploaded files.
+type tableSchema struct {
+	mu      sync.Mutex
+	pool    *pgx.ConnPool
+	table   string
+	policy  string
+	columns map[string]bool
+}
+
+func newTableSchema(pool *pgx.ConnPool, table string, policy string) (*tableSchema, error) {
+	s := &tableSchema{
+		pool:    pool,
+		table:   table,
+		policy:  policy,
+		columns: make(map[string]bool),
+	}
+	rows, err := pool.Query(
+		"SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1;",
+		strings.ToLower(table),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		s.columns[name] = true
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	if len(s.columns) == 0 {
+		return nil, fmt.Errorf("table '%s' not found", table)
+	}
+	return s, nil
+}
+
+func (s *tableSchema) has(fName string) bool {
+	return s.columns[strings.ToLower(pgKey(fName))]
+}
+
+// evolve applies the schema policy to the fields of a file. It returns the
+// fields that have a column, and the fields that must be stored in the extra
+// column. With the add policy, the missing columns are created first.
+func (s *tableSchema) evolve(fNames []string) (columns []string, extras []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var missing []string
+	for _, fName := range fNames {
+		if s.has(fName) {
+			columns = append(columns, fName)
+		} else {
+			missing = append(missing, fName)
+		}
+	}
+	if len(missing) == 0 {
+		return fNames, nil, nil
+	}
+	switch s.policy {
+	case schemaAdd:
+		for _, fName := range missing {
+			err = s.addColumn(fName)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return fNames, nil, nil
+	case schemaDrop:
+		fmt.Fprintf(os.Stderr, "Fields without a column in '%s' are ignored: %s\n", s.table, strings.Join(missing, ", "))
+		return columns, nil, nil
+	case schemaExtra:
+		err = s.addColumn(extraColumn)
+		if err != nil {
+			return nil, nil, err
+		}
+		return columns, missing, nil
+	default:
+		return fNames, nil, nil
+	}
+}
+
+// addColumn adds the column of a field to the table, with the type that
+// create-table would choose.
+func (s *tableSchema) addColumn(fName string) error {
+	if s.has(fName) {
+		return nil
+	}
+	stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s;", s.table, pgKey(fName), pgColumnType(fName))
+	fmt.Fprintln(os.Stderr, stmt)
+	_, err := s.pool.Exec(stmt)
+	if err != nil {
+		return err
+	}
+	s.columns[strings.ToLower(pgKey(fName))] = true
+	return nil
+}
+
+// extraValue returns the JSONB value of the extra column, that stores the
+// given fields of the line. The empty fields are omitted.
+func extraValue(l *parser.Line, names []string) interface{} {
+	fields := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		v := l.Get(name)
+		if v == nil {
+			continue
+		}
+		if str, ok := v.(string); ok && len(str) == 0 {
+			continue
+		}
+		fields[name] = decodeCharsets(v)
+	}
+	if len(fields) == 0 {
+		return pgDefaultVal(parser.Map)
+	}
+	jsonb := &pgtype.JSONB{}
+	if err := jsonb.Set(fields); err != nil {
+		return pgDefaultVal(parser.Map)
+	}
+	return jsonb
+}
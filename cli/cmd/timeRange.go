@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+var sinceStr string
+var untilStr string
+var timeRange parser.TimeRange
+
+func addTimeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&sinceStr, "since", "", "only keep the lines logged at or after that time (e.g. 2024-03-01, 2024-03-01T10:00:00Z or -24h)")
+	cmd.Flags().StringVar(&untilStr, "until", "", "only keep the lines logged before that time (e.g. 2024-03-02, 2024-03-01T12:00:00Z or -1h)")
+}
+
+// buildTimeRange parses the --since and --until options.
+func buildTimeRange() (err error) {
+	now := time.Now().UTC()
+	timeRange = parser.TimeRange{}
+	if sinceStr != "" {
+		timeRange.Since, err = parser.ParseTimeBound(sinceStr, now)
+		if err != nil {
+			return err
+		}
+	}
+	if untilStr != "" {
+		timeRange.Until, err = parser.ParseTimeBound(untilStr, now)
+		if err != nil {
+			return err
+		}
+	}
+	if !timeRange.Since.IsZero() && !timeRange.Until.IsZero() && !timeRange.Since.Before(timeRange.Until) {
+		return fmt.Errorf("--since (%s) should be before --until (%s)", timeRange.Since, timeRange.Until)
+	}
+	return nil
+}
+
+// pruneFiles removes the files whose lines are all outside of the time range.
+func pruneFiles(fnames []string) (selected []string) {
+	if timeRange.IsZero() {
+		return fnames
+	}
+	selected = make([]string, 0, len(fnames))
+	for _, fname := range fnames {
+		start, end, err := fileTimeSpan(strings.TrimSpace(fname))
+		if err == nil && !start.IsZero() && !end.IsZero() && !timeRange.Overlaps(start, end) {
+			fmt.Fprintf(os.Stderr, "Skipping '%s': outside of the time range\n", fname)
+			continue
+		}
+		// when the time span is unknown, the lines are checked one by one
+		selected = append(selected, fname)
+	}
+	return selected
+}
+
+// fileTimeSpanTail is the size of the end of file that is searched for the
+// last log line.
+const fileTimeSpanTail = 64 * 1024
+
+// fileTimeSpan returns the times of the first and last lines of a log file,
+// from the #Start-Date and #End-Date directives if present, or else by
+// parsing the first and last lines. The times are zero if unknown.
+func fileTimeSpan(fname string) (start, end time.Time, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return start, end, err
+	}
+	defer f.Close()
+	p := parser.NewFileParser(bufio.NewReaderSize(f, 64*1024))
+	err = p.ParseHeader()
+	if err != nil {
+		return start, end, err
+	}
+	if start, end, ok := p.TimeSpan(); ok {
+		return start, end, nil
+	}
+	first, err := p.Next()
+	if err != nil || first == nil {
+		return start, end, err
+	}
+	start = first.GetTime()
+
+	infos, err := f.Stat()
+	if err != nil {
+		return start, end, err
+	}
+	offset := infos.Size() - fileTimeSpanTail
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, infos.Size()-offset)
+	_, err = f.ReadAt(tail, offset)
+	if err != nil && err != io.EOF {
+		return start, end, err
+	}
+	// find the last line that is not a directive
+	lines := bytes.Split(bytes.TrimRight(tail, "\r\n"), []byte("\n"))
+	for i := len(lines) - 1; i > 0 || (i == 0 && offset == 0); i-- {
+		line := bytes.TrimSpace(lines[i])
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		lp := parser.NewFileParser(bufio.NewReader(bytes.NewReader(append(line, '\n'))))
+		last, err := lp.SetFieldNames(p.FieldNames()).Next()
+		if err != nil || last == nil {
+			// the fields may have changed in a later header
+			return start, end, err
+		}
+		return start, last.GetTime(), nil
+	}
+	return start, end, nil
+}
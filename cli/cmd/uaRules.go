@@ -0,0 +1,115 @@
+package cmd
+
+// defaultUARules are the user-agent parsing rules used when no rules file is
+// given with --ua-rules. They follow the uap-core regexes.yaml format, so that
+// they can be replaced by an up-to-date uap-core file.
+const defaultUARules = `
+user_agent_parsers:
+  # robots
+  - regex: '(Googlebot-Image|Googlebot-News|Googlebot-Video|Googlebot|AdsBot-Google-Mobile|AdsBot-Google|Mediapartners-Google|Storebot-Google|Google-InspectionTool)(?:/(\d+)\.(\d+))?'
+  - regex: '(bingbot|BingPreview|msnbot|adidxbot)(?:/(\d+)\.(\d+)(?:\.(\d+))?)?'
+  - regex: '(Yahoo! Slurp|Slurp)'
+  - regex: '(DuckDuckBot|DuckDuckGo-Favicons-Bot)(?:/(\d+)\.(\d+))?'
+  - regex: '(Baiduspider|Baiduspider-image|YandexBot|YandexImages|YandexMobileBot|Sogou web spider|Exabot|SeznamBot|PetalBot|Applebot|Bytespider)(?:/(\d+)\.(\d+)(?:\.(\d+))?)?'
+  - regex: '(facebookexternalhit|Facebot|Twitterbot|LinkedInBot|Pinterestbot|Slackbot|Slackbot-LinkExpanding|Discordbot|TelegramBot|WhatsApp|redditbot)(?:/(\d+)\.(\d+)(?:\.(\d+))?)?'
+  - regex: '(AhrefsBot|SemrushBot|MJ12bot|DotBot|BLEXBot|DataForSeoBot|MojeekBot|serpstatbot|Screaming Frog SEO Spider)(?:/(\d+)\.(\d+)(?:\.(\d+))?)?'
+  - regex: '(GPTBot|ChatGPT-User|OAI-SearchBot|ClaudeBot|Claude-Web|anthropic-ai|PerplexityBot|CCBot|Amazonbot|Google-Extended)(?:/(\d+)\.(\d+)(?:\.(\d+))?)?'
+  - regex: '(ia_archiver|archive\.org_bot|heritrix)(?:/(\d+)\.(\d+)(?:\.(\d+))?)?'
+  - regex: '(Pingdom\.com_bot|UptimeRobot|StatusCake|Site24x7|NewRelicPinger|Datadog Agent|ELB-HealthChecker|kube-probe|GoogleHC)(?:/(\d+)\.(\d+)(?:\.(\d+))?)?'
+
+  # tools and libraries
+  - regex: '(curl)/(\d+)\.(\d+)(?:\.(\d+))?'
+  - regex: '(Wget)/(\d+)\.(\d+)(?:\.(\d+))?'
+  - regex: '(python-requests)/(\d+)\.(\d+)(?:\.(\d+))?'
+    family_replacement: 'Python Requests'
+  - regex: '(Python-urllib|aiohttp|httpx)/(\d+)\.(\d+)(?:\.(\d+))?'
+  - regex: '(Go-http-client)/(\d+)\.(\d+)'
+  - regex: '(okhttp)/(\d+)\.(\d+)(?:\.(\d+))?'
+  - regex: '(Apache-HttpClient)/(\d+)\.(\d+)(?:\.(\d+))?'
+  - regex: '^(Java)/(\d+)\.(\d+)(?:\.(\d+))?'
+  - regex: '(PostmanRuntime)/(\d+)\.(\d+)(?:\.(\d+))?'
+  - regex: '(libwww-perl|Scrapy|axios|node-fetch|Dart|WinHttp|Microsoft-WebDAV-MiniRedir|Microsoft Office|Outlook-iOS|MSOffice)(?:/(\d+)\.(\d+)(?:\.(\d+))?)?'
+
+  # browsers
+  - regex: '(Edg(?:e|A|iOS)?)/(\d+)\.(\d+)(?:\.(\d+))?'
+    family_replacement: 'Edge'
+  - regex: '(OPR|OPiOS)/(\d+)\.(\d+)(?:\.(\d+))?'
+    family_replacement: 'Opera'
+  - regex: '(Opera)/.+Version/(\d+)\.(\d+)'
+    family_replacement: 'Opera'
+  - regex: '(YaBrowser)/(\d+)\.(\d+)(?:\.(\d+))?'
+    family_replacement: 'Yandex Browser'
+  - regex: '(SamsungBrowser)/(\d+)\.(\d+)'
+    family_replacement: 'Samsung Internet'
+  - regex: '(Vivaldi|Brave|UCBrowser|Whale|QQBrowser)/(\d+)\.(\d+)(?:\.(\d+))?'
+  - regex: '(CriOS)/(\d+)\.(\d+)(?:\.(\d+))?'
+    family_replacement: 'Chrome Mobile iOS'
+  - regex: '(FxiOS)/(\d+)\.(\d+)(?:\.(\d+))?'
+    family_replacement: 'Firefox iOS'
+  - regex: '(Mobile|Tablet);.+Firefox/(\d+)\.(\d+)(?:\.(\d+))?'
+    family_replacement: 'Firefox Mobile'
+  - regex: '(Firefox)/(\d+)\.(\d+)(?:\.(\d+))?'
+  - regex: '(; wv\)).+Chrome/(\d+)\.(\d+)\.(\d+)'
+    family_replacement: 'Chrome Mobile WebView'
+  - regex: '(Chrome)/(\d+)\.(\d+)\.(\d+)[\d.]* Mobile'
+    family_replacement: 'Chrome Mobile'
+  - regex: '(Chromium|Chrome)/(\d+)\.(\d+)\.(\d+)'
+  - regex: '(Version)/(\d+)\.(\d+)(?:\.(\d+))? Mobile/\S+ Safari'
+    family_replacement: 'Mobile Safari'
+  - regex: '(?:iPhone|iPad|iPod).+AppleWebKit/'
+    family_replacement: 'Mobile Safari UI/WKWebView'
+  - regex: '(Version)/(\d+)\.(\d+)(?:\.(\d+))? Safari/'
+    family_replacement: 'Safari'
+  - regex: '(MSIE) (\d+)\.(\d+)'
+    family_replacement: 'IE'
+  - regex: '(Trident)/\d+\.\d+.*rv:(\d+)\.(\d+)'
+    family_replacement: 'IE'
+
+  # other robots
+  - regex: '([A-Za-z][\w\-]*(?:[Bb]ot|[Cc]rawler|[Ss]pider))(?:/(\d+)(?:\.(\d+))?(?:\.(\d+))?)?'
+
+os_parsers:
+  - regex: '(Windows Phone) (?:OS )?(\d+)\.(\d+)'
+  - regex: 'Windows NT 10\.0'
+    os_replacement: 'Windows'
+    os_v1_replacement: '10'
+  - regex: 'Windows NT 6\.3'
+    os_replacement: 'Windows'
+    os_v1_replacement: '8'
+    os_v2_replacement: '1'
+  - regex: 'Windows NT 6\.2'
+    os_replacement: 'Windows'
+    os_v1_replacement: '8'
+  - regex: 'Windows NT 6\.1'
+    os_replacement: 'Windows'
+    os_v1_replacement: '7'
+  - regex: 'Windows NT 6\.0'
+    os_replacement: 'Windows'
+    os_v1_replacement: 'Vista'
+  - regex: 'Windows NT 5\.[12]'
+    os_replacement: 'Windows'
+    os_v1_replacement: 'XP'
+  - regex: '(Windows) (?:95|98|CE|ME)'
+  - regex: '(Android)[ /-]?(\d+)(?:\.(\d+))?(?:\.(\d+))?'
+    os_replacement: 'Android'
+  - regex: '(CPU OS|iPhone OS|CPU iPhone OS) (\d+)_(\d+)(?:_(\d+))?'
+    os_replacement: 'iOS'
+  - regex: '(?:iPhone|iPad|iPod)'
+    os_replacement: 'iOS'
+  - regex: '(CrOS) \S+ (\d+)\.(\d+)\.(\d+)'
+    os_replacement: 'Chrome OS'
+  - regex: '(Mac OS X) (\d+)[_.](\d+)(?:[_.](\d+))?'
+    os_replacement: 'Mac OS X'
+  - regex: '(Ubuntu|Kubuntu|Debian|Fedora|Red Hat|SUSE|CentOS|Mint)'
+  - regex: '(FreeBSD|OpenBSD|NetBSD)'
+  - regex: '(Linux)'
+
+device_parsers:
+  - regex: '(?:bot|crawl|spider|slurp|archiver|facebookexternalhit|WhatsApp|Pingdom|UptimeRobot|StatusCake|HealthCheck|kube-probe|GoogleHC|curl/|Wget/|python-requests|Python-urllib|aiohttp|httpx/|Go-http-client|libwww-perl|Scrapy|^Java/|heritrix|Google-InspectionTool|Google-Extended|ChatGPT-User|anthropic-ai|Claude-Web)'
+    regex_flag: 'i'
+    device_replacement: 'Spider'
+  - regex: '(iPad|iPod|iPhone)'
+  - regex: 'Android [^;]+; (?:[a-zA-Z]{2}[-_][a-zA-Z]{2}; )?([^;)]+?)(?: Build/|\))'
+  - regex: 'Macintosh'
+    device_replacement: 'Mac'
+`
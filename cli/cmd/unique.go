@@ -28,9 +28,13 @@ var uniqueCmd = &cobra.Command{
 		fatal(err)
 		input, err = filepath.Abs(input)
 		fatal(err)
+		fatal(buildEnrichers())
+		fatal(buildTimeRange())
+		defer closeEnrichers()
 
 		inputFiles, err := findFiles(input, extension)
 		fatal(err)
+		inputFiles = pruneFiles(inputFiles)
 		if len(inputFiles) == 0 {
 			fmt.Fprintln(os.Stderr, "No file to process.")
 			return
@@ -91,7 +95,12 @@ func uniqueFile(fname string, uniques *map[string]*hyperloglog.HyperLogLogPlus,
 	if err != nil {
 		return err
 	}
+	pipeline, err := buildPipeline(p, nil)
+	if err != nil {
+		return err
+	}
 	var line *parser.Line
+	var keep bool
 	var h hash.Hash64
 	var date string
 	var lineB []byte
@@ -101,6 +110,13 @@ func uniqueFile(fname string, uniques *map[string]*hyperloglog.HyperLogLogPlus,
 		if line == nil || err != nil {
 			break
 		}
+		keep, err = pipeline.Process(line)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			continue
+		}
 		date = line.GetDate().String()
 		(*totals)[date]++
 		lineB, err = line.MarshalJSON()
@@ -119,4 +135,7 @@ func init() {
 	rootCmd.AddCommand(uniqueCmd)
 	uniqueCmd.Flags().StringVar(&input, "input", "", "input directory")
 	uniqueCmd.Flags().StringVar(&extension, "ext", "log", "only select input files with that extension")
+	addEnrichFlags(uniqueCmd)
+	addWhereFlag(uniqueCmd)
+	addTimeFlags(uniqueCmd)
 }
@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var parseUA bool
+var uaRulesFile string
+var uaCacheSize int
+
+// The fields added by the user-agent enricher.
+const (
+	uaBrowser        = "ua.browser"
+	uaBrowserVersion = "ua.browser_version"
+	uaOS             = "ua.os"
+	uaOSVersion      = "ua.os_version"
+	uaDevice         = "ua.device"
+	uaIsBot          = "ua.is_bot"
+)
+
+var uaFields = []string{uaBrowser, uaBrowserVersion, uaOS, uaOSVersion, uaDevice, uaIsBot}
+
+func addUAFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&parseUA, "ua", false, "parse the user-agent into the ua.* fields")
+	cmd.Flags().StringVar(&uaRulesFile, "ua-rules", "", "YAML file of user-agent parsing rules (uap-core format) to use instead of the embedded rules")
+	cmd.Flags().IntVar(&uaCacheSize, "ua-cache", 10000, "number of parsed user-agents to keep in cache")
+}
+
+// uaRules are the user-agent parsing rules, in the uap-core format.
+type uaRules struct {
+	UserAgent []*uaRule `yaml:"user_agent_parsers"`
+	OS        []*uaRule `yaml:"os_parsers"`
+	Device    []*uaRule `yaml:"device_parsers"`
+}
+
+type uaRule struct {
+	Regex  string `yaml:"regex"`
+	Flag   string `yaml:"regex_flag"`
+	Family string `yaml:"family_replacement"`
+	V1     string `yaml:"v1_replacement"`
+	V2     string `yaml:"v2_replacement"`
+	V3     string `yaml:"v3_replacement"`
+	OS     string `yaml:"os_replacement"`
+	OSV1   string `yaml:"os_v1_replacement"`
+	OSV2   string `yaml:"os_v2_replacement"`
+	OSV3   string `yaml:"os_v3_replacement"`
+	Device string `yaml:"device_replacement"`
+	re     *regexp.Regexp
+}
+
+func (r *uaRule) compile() (err error) {
+	expr := r.Regex
+	if r.Flag == "i" {
+		expr = "(?i)" + expr
+	}
+	r.re, err = regexp.Compile(expr)
+	return err
+}
+
+// replace returns the replacement string with the $n placeholders expanded,
+// or the nth submatch if there is no replacement.
+func replace(replacement string, n int, matches []string) string {
+	if replacement == "" {
+		if n < len(matches) {
+			return strings.TrimSpace(matches[n])
+		}
+		return ""
+	}
+	for i := len(matches) - 1; i > 0; i-- {
+		replacement = strings.Replace(replacement, "$"+strconv.Itoa(i), matches[i], -1)
+	}
+	return strings.TrimSpace(replacement)
+}
+
+func joinVersion(major, minor, patch string) string {
+	if major == "" {
+		return ""
+	}
+	if minor == "" {
+		return major
+	}
+	if patch == "" {
+		return major + "." + minor
+	}
+	return major + "." + minor + "." + patch
+}
+
+func loadUARules(fname string) (*uaRules, error) {
+	content := []byte(defaultUARules)
+	if fname != "" {
+		var err error
+		content, err = ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rules := new(uaRules)
+	err := yaml.Unmarshal(content, rules)
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range [][]*uaRule{rules.UserAgent, rules.OS, rules.Device} {
+		for _, r := range section {
+			err = r.compile()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rules, nil
+}
+
+type userAgent struct {
+	browser        string
+	browserVersion string
+	os             string
+	osVersion      string
+	device         string
+	isBot          bool
+}
+
+func (rules *uaRules) parse(s string) (ua userAgent) {
+	ua.browser, ua.os, ua.device = "Other", "Other", "Other"
+	for _, r := range rules.UserAgent {
+		if m := r.re.FindStringSubmatch(s); m != nil {
+			ua.browser = replace(r.Family, 1, m)
+			ua.browserVersion = joinVersion(replace(r.V1, 2, m), replace(r.V2, 3, m), replace(r.V3, 4, m))
+			break
+		}
+	}
+	for _, r := range rules.OS {
+		if m := r.re.FindStringSubmatch(s); m != nil {
+			ua.os = replace(r.OS, 1, m)
+			ua.osVersion = joinVersion(replace(r.OSV1, 2, m), replace(r.OSV2, 3, m), replace(r.OSV3, 4, m))
+			break
+		}
+	}
+	for _, r := range rules.Device {
+		if m := r.re.FindStringSubmatch(s); m != nil {
+			ua.device = replace(r.Device, 1, m)
+			break
+		}
+	}
+	// uap-core classifies the robots as the Spider device
+	ua.isBot = ua.device == "Spider"
+	return ua
+}
+
+// uaEnricher parses the cs(user-agent) field into the ua.* fields.
+type uaEnricher struct {
+	rules *uaRules
+	cache *lruCache
+}
+
+func newUAEnricher(rulesFile string, cacheSize int) (*uaEnricher, error) {
+	rules, err := loadUARules(rulesFile)
+	if err != nil {
+		return nil, err
+	}
+	return &uaEnricher{rules: rules, cache: newLRU(cacheSize)}, nil
+}
+
+func (e *uaEnricher) Fields(names []string) (added []string, removed []string) {
+	for _, name := range names {
+		if name == "cs(user-agent)" {
+			return uaFields, nil
+		}
+	}
+	return nil, nil
+}
+
+func (e *uaEnricher) Kind(name string) (parser.Kind, bool) {
+	switch name {
+	case uaIsBot:
+		return parser.Bool, true
+	case uaBrowser, uaBrowserVersion, uaOS, uaOSVersion, uaDevice:
+		return parser.String, true
+	}
+	return parser.Invalid, false
+}
+
+func (e *uaEnricher) Process(l *parser.Line) (bool, error) {
+	if !l.Has("cs(user-agent)") {
+		return true, nil
+	}
+	s, _ := l.Get("cs(user-agent)").(string)
+	if s == "" {
+		for _, name := range uaFields {
+			l.Set(name, nil)
+		}
+		return true, nil
+	}
+	var ua userAgent
+	if cached, ok := e.cache.get(s); ok {
+		ua = cached.(userAgent)
+	} else {
+		// spaces are logged as '+' in header fields
+		ua = e.rules.parse(strings.Replace(s, "+", " ", -1))
+		e.cache.add(s, ua)
+	}
+	l.Set(uaBrowser, ua.browser)
+	l.Set(uaBrowserVersion, nilIfEmpty(ua.browserVersion))
+	l.Set(uaOS, ua.os)
+	l.Set(uaOSVersion, nilIfEmpty(ua.osVersion))
+	l.Set(uaDevice, ua.device)
+	l.Set(uaIsBot, ua.isBot)
+	return true, nil
+}
+
+// nilIfEmpty returns nil for an empty string, so that the field is absent
+// from the exported line.
+func nilIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+func TestUARules(t *testing.T) {
+	rules, err := loadUARules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		s    string
+		want userAgent
+	}{
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0.6261.95 Safari/537.36",
+			userAgent{browser: "Chrome", browserVersion: "122.0.6261", os: "Windows", osVersion: "10", device: "Other"},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0.0.0 Safari/537.36 Edg/122.0.2365.66",
+			userAgent{browser: "Edge", browserVersion: "122.0.2365", os: "Windows", osVersion: "10", device: "Other"},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 6.1; rv:115.0) Gecko/20100101 Firefox/115.0",
+			userAgent{browser: "Firefox", browserVersion: "115.0", os: "Windows", osVersion: "7", device: "Other"},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 6.3; Trident/7.0; rv:11.0) like Gecko",
+			userAgent{browser: "IE", browserVersion: "11.0", os: "Windows", osVersion: "8.1", device: "Other"},
+		},
+		{
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_3_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.3 Mobile/15E148 Safari/604.1",
+			userAgent{browser: "Mobile Safari", browserVersion: "17.3", os: "iOS", osVersion: "17.3.1", device: "iPhone"},
+		},
+		{
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15",
+			userAgent{browser: "Safari", browserVersion: "17.2", os: "Mac OS X", osVersion: "10.15.7", device: "Mac"},
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0.6261.64 Mobile Safari/537.36",
+			userAgent{browser: "Chrome Mobile", browserVersion: "122.0.6261", os: "Android", osVersion: "14", device: "Pixel 8"},
+		},
+		{
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			userAgent{browser: "Googlebot", browserVersion: "2.1", os: "Other", device: "Spider", isBot: true},
+		},
+		{
+			"curl/8.5.0",
+			userAgent{browser: "curl", browserVersion: "8.5.0", os: "Other", device: "Spider", isBot: true},
+		},
+		{
+			"python-requests/2.31.0",
+			userAgent{browser: "Python Requests", browserVersion: "2.31.0", os: "Other", device: "Spider", isBot: true},
+		},
+		// an unknown robot
+		{
+			"Mozilla/5.0 (compatible; FooCrawler/3; +https://example.com)",
+			userAgent{browser: "FooCrawler", browserVersion: "3", os: "Other", device: "Spider", isBot: true},
+		},
+		{
+			"something else",
+			userAgent{browser: "Other", os: "Other", device: "Other"},
+		},
+	}
+	for _, test := range tests {
+		if got := rules.parse(test.s); got != test.want {
+			t.Errorf("'%s':\ngot  %+v\nwant %+v", test.s, got, test.want)
+		}
+	}
+}
+
+func TestUARulesFile(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+	fname := filepath.Join(dir, "regexes.yaml")
+	content := `
+user_agent_parsers:
+  - regex: '(MyApp)-(\d+)\.(\d+)'
+    family_replacement: '$1 Client'
+    v2_replacement: 'x'
+os_parsers:
+  - regex: 'os=(\w+)'
+device_parsers:
+  - regex: 'MYBOT'
+    regex_flag: 'i'
+    device_replacement: 'Spider'
+`
+	err := ioutil.WriteFile(fname, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadUARules(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := userAgent{browser: "MyApp Client", browserVersion: "4.x", os: "plan9", device: "Spider", isBot: true}
+	if got := rules.parse("MyApp-4.2 os=plan9 mybot"); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	err = ioutil.WriteFile(fname, []byte("user_agent_parsers:\n  - regex: '(unclosed'\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadUARules(fname); err == nil {
+		t.Error("expected an error")
+	}
+	if _, err := loadUARules(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestJoinVersion(t *testing.T) {
+	tests := []struct {
+		major, minor, patch string
+		want                string
+	}{
+		{"", "", "", ""},
+		{"", "2", "3", ""},
+		{"1", "", "3", "1"},
+		{"1", "2", "", "1.2"},
+		{"1", "2", "3", "1.2.3"},
+	}
+	for _, test := range tests {
+		if got := joinVersion(test.major, test.minor, test.patch); got != test.want {
+			t.Errorf("%v: got '%s', want '%s'", test, got, test.want)
+		}
+	}
+}
+
+func TestLRU(t *testing.T) {
+	c := newLRU(2)
+	c.add("a", 1)
+	c.add("b", 2)
+	// a becomes the most recently used
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Errorf("got %v %v", v, ok)
+	}
+	c.add("c", 3)
+	if _, ok := c.get("b"); ok {
+		t.Error("b was not evicted")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if v, ok := c.get(key); !ok || v != want {
+			t.Errorf("%s: got %v %v", key, v, ok)
+		}
+	}
+	// updating a key does not grow the cache
+	c.add("a", 10)
+	c.add("d", 4)
+	if _, ok := c.get("c"); ok {
+		t.Error("c was not evicted")
+	}
+	if v, _ := c.get("a"); v != 10 {
+		t.Errorf("got %v", v)
+	}
+	if c.ll.Len() != 2 || len(c.items) != 2 {
+		t.Errorf("got %d elements and %d items", c.ll.Len(), len(c.items))
+	}
+
+	// the size is at least 1
+	c = newLRU(0)
+	c.add("a", 1)
+	c.add("b", 2)
+	if _, ok := c.get("a"); ok || c.ll.Len() != 1 {
+		t.Errorf("got %d elements", c.ll.Len())
+	}
+}
+
+func TestUAEnricher(t *testing.T) {
+	e, err := newUAEnricher("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, _ := e.Fields([]string{"date", "cs(user-agent)"}); len(added) != len(uaFields) {
+		t.Errorf("got %v", added)
+	}
+	if added, _ := e.Fields([]string{"date"}); added != nil {
+		t.Errorf("got %v", added)
+	}
+	if kind, ok := e.Kind(uaIsBot); !ok || kind != parser.Bool {
+		t.Errorf("got %v %v", kind, ok)
+	}
+
+	l := parser.NewLine([]string{"cs(user-agent)"})
+	// the spaces are logged as '+'
+	ua := "Mozilla/5.0+(Windows+NT+10.0;+Win64;+x64;+rv:123.0)+Gecko/20100101+Firefox/123.0"
+	for i := 0; i < 2; i++ {
+		l.Set("cs(user-agent)", ua)
+		keep, err := e.Process(l)
+		if !keep || err != nil {
+			t.Fatalf("got %v %v", keep, err)
+		}
+		want := map[string]interface{}{
+			uaBrowser:        "Firefox",
+			uaBrowserVersion: "123.0",
+			uaOS:             "Windows",
+			uaOSVersion:      "10",
+			uaDevice:         "Other",
+			uaIsBot:          false,
+		}
+		for name, v := range want {
+			if got := l.Get(name); got != v {
+				t.Errorf("%d: %s: got %v, want %v", i, name, got, v)
+			}
+		}
+	}
+	// the second line is read from the cache
+	if _, ok := e.cache.get(ua); !ok {
+		t.Error("the user-agent is not in cache")
+	}
+
+	// the versions are absent when unknown, and the empty user-agent clears
+	// the fields
+	l.Set("cs(user-agent)", "something+else")
+	e.Process(l)
+	if l.Get(uaBrowserVersion) != nil || l.Get(uaBrowser) != "Other" {
+		t.Errorf("got %v %v", l.Get(uaBrowser), l.Get(uaBrowserVersion))
+	}
+	l.Set("cs(user-agent)", nil)
+	e.Process(l)
+	for _, name := range uaFields {
+		if v := l.Get(name); v != nil {
+			t.Errorf("%s: got %v", name, v)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	parser "github.com/stephane-martin/w3c-extendedlog-parser"
+)
+
+var whereExpr string
+
+func addWhereFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&whereExpr, "where", "", "only keep the lines that match that filter expression (e.g. 'sc-status >= 500 && c-ip in 10.0.0.0/8')")
+}
+
+// compileWhere compiles the --where expression against the field names of a
+// file. It returns nil when there is no filter.
+func compileWhere(names []string) (*parser.Filter, error) {
+	if whereExpr == "" {
+		return nil, nil
+	}
+	return parser.CompileFilter(whereExpr, names, filterType)
+}
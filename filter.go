@@ -0,0 +1,667 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filter is a compiled filter expression, used to select log lines.
+//
+// A filter expression compares fields with values:
+//
+//	sc-status >= 500 && cs-host == "api.example.com" && c-ip in 10.0.0.0/8
+//
+// The comparison operators are ==, !=, <, <=, >, >=, =~ and !~ (regular
+// expression matching), in and not in (lists of values or CIDRs, between
+// parentheses). The expressions are combined with &&, || and !, or with their
+// and, or, not aliases. A field alone is true when it has a non empty value.
+//
+// The values are interpreted according to the type of the field: numbers,
+// IPs and CIDRs, timestamps, dates, times, booleans or strings.
+type Filter struct {
+	expr   string
+	root   filterNode
+	fields []string
+}
+
+// CompileFilter compiles a filter expression. The fields used by the
+// expression must belong to fieldNames. kind gives the type of the fields;
+// if nil, GuessType is used.
+func CompileFilter(expr string, fieldNames []string, kind func(string) Kind) (*Filter, error) {
+	if kind == nil {
+		kind = GuessType
+	}
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	c := &filterCompiler{tokens: tokens, names: make(map[string]bool, len(fieldNames)), kind: kind}
+	for _, name := range fieldNames {
+		c.names[name] = true
+	}
+	f := &Filter{expr: expr}
+	f.root, err = c.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if c.peek().typ != tokEOF {
+		return nil, c.errorf("unexpected '%s'", c.peek().val)
+	}
+	f.fields = c.fields
+	return f, nil
+}
+
+// Match returns true if the line is selected by the filter.
+func (f *Filter) Match(l *Line) bool {
+	return f.root.eval(l)
+}
+
+// Fields returns the names of the fields used by the filter.
+func (f *Filter) Fields() []string {
+	return append([]string(nil), f.fields...)
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+type filterTokenType int
+
+const (
+	tokEOF filterTokenType = iota
+	tokWord
+	tokString
+	tokRegex
+	tokOp
+	tokAnd
+	tokOr
+	tokNot
+	tokIn
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type filterToken struct {
+	typ filterTokenType
+	val string
+	pos int
+}
+
+func isWordChar(r byte) bool {
+	return !unicode.IsSpace(rune(r)) && strings.IndexByte("()!=<>&|,\"'", r) == -1
+}
+
+// lexFilter splits a filter expression into tokens.
+func lexFilter(expr string) (tokens []filterToken, err error) {
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		start := i
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+			continue
+		case c == '(':
+			tokens = append(tokens, filterToken{tokLParen, "(", start})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{tokRParen, ")", start})
+			i++
+		case c == ',':
+			tokens = append(tokens, filterToken{tokComma, ",", start})
+			i++
+		case strings.HasPrefix(expr[i:], "&&"):
+			tokens = append(tokens, filterToken{tokAnd, "&&", start})
+			i += 2
+		case strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, filterToken{tokOr, "||", start})
+			i += 2
+		case strings.HasPrefix(expr[i:], "=="), strings.HasPrefix(expr[i:], "!="),
+			strings.HasPrefix(expr[i:], "<="), strings.HasPrefix(expr[i:], ">="),
+			strings.HasPrefix(expr[i:], "=~"), strings.HasPrefix(expr[i:], "!~"):
+			tokens = append(tokens, filterToken{tokOp, expr[i : i+2], start})
+			i += 2
+		case c == '<' || c == '>':
+			tokens = append(tokens, filterToken{tokOp, expr[i : i+1], start})
+			i++
+		case c == '!':
+			tokens = append(tokens, filterToken{tokNot, "!", start})
+			i++
+		case c == '"' || c == '\'':
+			// find the closing quote, skipping the escaped characters
+			j := i + 1
+			for j < len(expr) && expr[j] != c {
+				if expr[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("filter: unclosed string at position %d", start)
+			}
+			s := expr[i+1 : j]
+			if c == '"' {
+				s, err = strconv.Unquote(expr[i : j+1])
+				if err != nil {
+					return nil, fmt.Errorf("filter: invalid string at position %d: %s", start, err)
+				}
+			}
+			tokens = append(tokens, filterToken{tokString, s, start})
+			i = j + 1
+		case c == '/' && len(tokens) > 0 && tokens[len(tokens)-1].typ == tokOp && strings.HasSuffix(tokens[len(tokens)-1].val, "~"):
+			// regular expression literal, after =~ or !~
+			j := i + 1
+			var re strings.Builder
+			for j < len(expr) && expr[j] != '/' {
+				if expr[j] == '\\' && j+1 < len(expr) && expr[j+1] == '/' {
+					j++
+				}
+				re.WriteByte(expr[j])
+				j++
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("filter: unclosed regular expression at position %d", start)
+			}
+			tokens = append(tokens, filterToken{tokRegex, re.String(), start})
+			i = j + 1
+		default:
+			for i < len(expr) && isWordChar(expr[i]) {
+				i++
+				// a parenthesis directly after a word is part of a field
+				// name, like cs(user-agent)
+				if i < len(expr) && expr[i] == '(' && !isFilterKeyword(expr[start:i]) {
+					end := strings.IndexByte(expr[i:], ')')
+					if end == -1 {
+						return nil, fmt.Errorf("filter: unclosed parenthesis at position %d", i)
+					}
+					i += end + 1
+				}
+			}
+			if i == start {
+				return nil, fmt.Errorf("filter: unexpected character '%c' at position %d", c, start)
+			}
+			word := expr[start:i]
+			switch strings.ToLower(word) {
+			case "and":
+				tokens = append(tokens, filterToken{tokAnd, word, start})
+			case "or":
+				tokens = append(tokens, filterToken{tokOr, word, start})
+			case "not":
+				tokens = append(tokens, filterToken{tokNot, word, start})
+			case "in":
+				tokens = append(tokens, filterToken{tokIn, word, start})
+			default:
+				tokens = append(tokens, filterToken{tokWord, word, start})
+			}
+		}
+	}
+	return append(tokens, filterToken{tokEOF, "end of expression", len(expr)}), nil
+}
+
+func isFilterKeyword(word string) bool {
+	switch strings.ToLower(word) {
+	case "and", "or", "not", "in":
+		return true
+	default:
+		return false
+	}
+}
+
+type filterCompiler struct {
+	tokens []filterToken
+	pos    int
+	names  map[string]bool
+	kind   func(string) Kind
+	fields []string
+}
+
+func (c *filterCompiler) peek() filterToken {
+	return c.tokens[c.pos]
+}
+
+func (c *filterCompiler) next() filterToken {
+	t := c.tokens[c.pos]
+	if t.typ != tokEOF {
+		c.pos++
+	}
+	return t
+}
+
+func (c *filterCompiler) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("filter: position %d: %s", c.peek().pos, fmt.Sprintf(format, args...))
+}
+
+func (c *filterCompiler) parseOr() (filterNode, error) {
+	left, err := c.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for c.peek().typ == tokOr {
+		c.next()
+		right, err := c.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (c *filterCompiler) parseAnd() (filterNode, error) {
+	left, err := c.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for c.peek().typ == tokAnd {
+		c.next()
+		right, err := c.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (c *filterCompiler) parseUnary() (filterNode, error) {
+	switch c.peek().typ {
+	case tokNot:
+		c.next()
+		node, err := c.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node}, nil
+	case tokLParen:
+		c.next()
+		node, err := c.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c.peek().typ != tokRParen {
+			return nil, c.errorf("expected ')', got '%s'", c.peek().val)
+		}
+		c.next()
+		return node, nil
+	case tokWord:
+		return c.parseComparison()
+	default:
+		return nil, c.errorf("expected a field name, got '%s'", c.peek().val)
+	}
+}
+
+func (c *filterCompiler) parseComparison() (filterNode, error) {
+	field := strings.ToLower(c.peek().val)
+	if !c.names[field] {
+		return nil, c.errorf("unknown field '%s'", field)
+	}
+	c.next()
+	c.fields = append(c.fields, field)
+	kind := c.kind(field)
+
+	negate := false
+	if c.peek().typ == tokNot && c.tokens[c.pos+1].typ == tokIn {
+		c.next()
+		negate = true
+	}
+	switch c.peek().typ {
+	case tokIn:
+		c.next()
+		node, err := c.parseList(field, kind)
+		if err != nil {
+			return nil, err
+		}
+		if negate {
+			return notNode{node}, nil
+		}
+		return node, nil
+	case tokOp:
+	default:
+		// a field alone
+		return truthNode{field}, nil
+	}
+	op := c.next().val
+	t := c.next()
+	if t.typ != tokWord && t.typ != tokString && t.typ != tokRegex {
+		return nil, c.errorf("expected a value after '%s', got '%s'", op, t.val)
+	}
+	if op == "=~" || op == "!~" {
+		re, err := regexp.Compile(t.val)
+		if err != nil {
+			return nil, fmt.Errorf("filter: position %d: %s", t.pos, err)
+		}
+		return matchNode{field: field, re: re, negate: op == "!~"}, nil
+	}
+	if t.typ == tokRegex {
+		return nil, fmt.Errorf("filter: position %d: a regular expression needs =~ or !~", t.pos)
+	}
+	lit, err := parseFilterLiteral(kind, t.val, false)
+	if err != nil {
+		return nil, fmt.Errorf("filter: position %d: %s: %s", t.pos, field, err)
+	}
+	if op != "==" && op != "!=" {
+		switch kind {
+		case Bool, Map, MyIPList, MyGeoPoint:
+			return nil, fmt.Errorf("filter: position %d: %s: '%s' is not supported for that field", t.pos, field, op)
+		}
+	}
+	return cmpNode{field: field, op: op, lit: lit}, nil
+}
+
+// parseList parses the values of an in operator: a single value, or a list of
+// values between parentheses.
+func (c *filterCompiler) parseList(field string, kind Kind) (filterNode, error) {
+	node := inNode{field: field}
+	parens := c.peek().typ == tokLParen
+	if parens {
+		c.next()
+	}
+	for {
+		t := c.next()
+		if t.typ != tokWord && t.typ != tokString {
+			return nil, fmt.Errorf("filter: position %d: expected a value, got '%s'", t.pos, t.val)
+		}
+		lit, err := parseFilterLiteral(kind, t.val, true)
+		if err != nil {
+			return nil, fmt.Errorf("filter: position %d: %s: %s", t.pos, field, err)
+		}
+		node.values = append(node.values, lit)
+		if !parens {
+			return node, nil
+		}
+		switch c.next().typ {
+		case tokComma:
+		case tokRParen:
+			return node, nil
+		default:
+			return nil, c.errorf("expected ',' or ')'")
+		}
+	}
+}
+
+// filterLiteral is a value of a filter expression, parsed according to the
+// type of the field it is compared to.
+type filterLiteral struct {
+	kind    Kind
+	raw     string
+	num     float64
+	ip      net.IP
+	network *net.IPNet
+	t       time.Time
+	date    Date
+	tm      Time
+	b       bool
+}
+
+var filterTimestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func parseFilterLiteral(kind Kind, s string, allowNetwork bool) (lit filterLiteral, err error) {
+	lit.kind = kind
+	lit.raw = s
+	switch kind {
+	case Int, Int8, Int16, Int32, Int64, Uint, Uint8, Uint16, Uint32, Uint64, Float32, Float64:
+		lit.num, err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			return lit, fmt.Errorf("'%s' is not a number", s)
+		}
+	case MyIP, MyIPList:
+		if allowNetwork && strings.IndexByte(s, '/') != -1 {
+			_, lit.network, err = net.ParseCIDR(s)
+			if err != nil {
+				return lit, fmt.Errorf("'%s' is not a CIDR", s)
+			}
+			return lit, nil
+		}
+		lit.ip = net.ParseIP(s)
+		if lit.ip == nil {
+			return lit, fmt.Errorf("'%s' is not an IP", s)
+		}
+	case MyTimestamp:
+		for _, layout := range filterTimestampLayouts {
+			lit.t, err = time.Parse(layout, s)
+			if err == nil {
+				return lit, nil
+			}
+		}
+		return lit, fmt.Errorf("'%s' is not a timestamp", s)
+	case MyDate:
+		lit.date, err = ParseDate(s)
+		if err != nil {
+			return lit, fmt.Errorf("'%s' is not a date", s)
+		}
+	case MyTime:
+		lit.tm, err = ParseTime(s)
+		if err != nil {
+			return lit, fmt.Errorf("'%s' is not a time", s)
+		}
+	case Bool:
+		lit.b, err = strconv.ParseBool(s)
+		if err != nil {
+			return lit, fmt.Errorf("'%s' is not a boolean", s)
+		}
+	}
+	return lit, nil
+}
+
+// compare compares a field value with a literal. ok is false when the value
+// cannot be compared with the literal.
+func (lit filterLiteral) compare(value interface{}) (cmp int, ok bool) {
+	switch v := value.(type) {
+	case nil:
+		// the empty strings are stored as nil
+		return 0, lit.raw == ""
+	case int64:
+		return compareFloats(float64(v), lit.num), lit.isNumber()
+	case float64:
+		return compareFloats(v, lit.num), lit.isNumber()
+	case net.IP:
+		if lit.ip == nil {
+			return 0, false
+		}
+		return bytes.Compare(v.To16(), lit.ip.To16()), true
+	case time.Time:
+		if lit.kind != MyTimestamp {
+			return 0, false
+		}
+		switch {
+		case v.Before(lit.t):
+			return -1, true
+		case v.After(lit.t):
+			return 1, true
+		}
+		return 0, true
+	case Date:
+		if lit.kind != MyDate {
+			return 0, false
+		}
+		switch {
+		case v.Before(lit.date):
+			return -1, true
+		case v.After(lit.date):
+			return 1, true
+		}
+		return 0, true
+	case Time:
+		if lit.kind != MyTime {
+			return 0, false
+		}
+		return compareFloats(timeOfDay(v), timeOfDay(lit.tm)), true
+	case bool:
+		if lit.kind != Bool {
+			return 0, false
+		}
+		if v == lit.b {
+			return 0, true
+		}
+		return 1, true
+	case string:
+		return strings.Compare(v, lit.raw), true
+	default:
+		return strings.Compare(itostr(v), lit.raw), true
+	}
+}
+
+func (lit filterLiteral) isNumber() bool {
+	switch lit.kind {
+	case Int, Int8, Int16, Int32, Int64, Uint, Uint8, Uint16, Uint32, Uint64, Float32, Float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// contains returns true if the value equals the literal or belongs to the
+// literal network.
+func (lit filterLiteral) contains(value interface{}) bool {
+	if lit.network != nil {
+		ip, ok := value.(net.IP)
+		return ok && lit.network.Contains(ip)
+	}
+	cmp, ok := lit.compare(value)
+	return ok && cmp == 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func timeOfDay(t Time) float64 {
+	return float64(t.Hour*3600+t.Minute*60+t.Second) + float64(t.Nanosecond)/1e9
+}
+
+type filterNode interface {
+	eval(l *Line) bool
+}
+
+type andNode struct {
+	left, right filterNode
+}
+
+func (n andNode) eval(l *Line) bool {
+	return n.left.eval(l) && n.right.eval(l)
+}
+
+type orNode struct {
+	left, right filterNode
+}
+
+func (n orNode) eval(l *Line) bool {
+	return n.left.eval(l) || n.right.eval(l)
+}
+
+type notNode struct {
+	node filterNode
+}
+
+func (n notNode) eval(l *Line) bool {
+	return !n.node.eval(l)
+}
+
+type truthNode struct {
+	field string
+}
+
+func (n truthNode) eval(l *Line) bool {
+	switch v := l.Get(n.field).(type) {
+	case nil:
+		return false
+	case string:
+		return v != ""
+	case bool:
+		return v
+	default:
+		return true
+	}
+}
+
+type cmpNode struct {
+	field string
+	op    string
+	lit   filterLiteral
+}
+
+func (n cmpNode) eval(l *Line) bool {
+	value := l.Get(n.field)
+	if ips, ok := value.([]net.IP); ok {
+		// a list of IPs is equal to an IP if it contains it
+		found := false
+		for _, ip := range ips {
+			if n.lit.contains(ip) {
+				found = true
+				break
+			}
+		}
+		return found == (n.op == "==")
+	}
+	cmp, ok := n.lit.compare(value)
+	if !ok {
+		return n.op == "!="
+	}
+	switch n.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+type matchNode struct {
+	field  string
+	re     *regexp.Regexp
+	negate bool
+}
+
+func (n matchNode) eval(l *Line) bool {
+	return n.re.MatchString(itostr(l.Get(n.field))) != n.negate
+}
+
+type inNode struct {
+	field  string
+	values []filterLiteral
+}
+
+func (n inNode) eval(l *Line) bool {
+	value := l.Get(n.field)
+	values := []interface{}{value}
+	if ips, ok := value.([]net.IP); ok {
+		values = values[:0]
+		for _, ip := range ips {
+			values = append(values, ip)
+		}
+	}
+	for _, v := range values {
+		for _, lit := range n.values {
+			if lit.contains(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+// newTestLine returns a line with the given raw values, converted as if they
+// were read from a log file.
+func newTestLine(values map[string]string) *Line {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	l := NewLine(names)
+	for name, value := range values {
+		l.add(name, value)
+	}
+	return l
+}
+
+var filterTestFields = []string{
+	"date", "time", "gmttime", "c-ip", "cs-host", "cs-method", "cs-uri-stem",
+	"sc-status", "time-taken", "cs(user-agent)", "cs-username",
+}
+
+func TestFilterMatch(t *testing.T) {
+	l := newTestLine(map[string]string{
+		"date":           "2024-03-10",
+		"time":           "12:30:45",
+		"c-ip":           "10.1.2.3",
+		"cs-host":        "api.example.com",
+		"cs-method":      "GET",
+		"cs-uri-stem":    "/v1/users",
+		"sc-status":      "503",
+		"time-taken":     "0.25",
+		"cs(user-agent)": `Mozilla/5.0+"quoted"`,
+		"cs-username":    "-",
+	})
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// precedence: && binds tighter than ||, ! binds tighter than &&
+		{`sc-status == 200 || sc-status == 503 && cs-method == "GET"`, true},
+		{`sc-status == 503 || sc-status == 200 && cs-method == "POST"`, true},
+		{`(sc-status == 503 || sc-status == 200) && cs-method == "POST"`, false},
+		{`!cs-method == "POST" && sc-status == 503`, true},
+		{`not (sc-status == 503 and cs-method == "GET")`, false},
+		{`sc-status == 200 or not cs-method == "POST"`, true},
+		{`!!cs-username`, false},
+
+		// quoting and escapes
+		{`cs-host == "api.example.com"`, true},
+		{`cs-host == 'api.example.com'`, true},
+		{`cs-host == api.example.com`, true},
+		{`cs(user-agent) == "Mozilla/5.0+\"quoted\""`, true},
+		{`cs(user-agent) == 'Mozilla/5.0+"quoted"'`, true},
+		{`cs(user-agent) =~ "\"quoted\"$"`, true},
+		{`cs-uri-stem == "/v1/users"`, true},
+
+		// in and regex operators
+		{`cs-method in (GET, HEAD)`, true},
+		{`cs-method in ("POST", 'PUT')`, false},
+		{`cs-method not in (POST, PUT)`, true},
+		{`cs-method in GET`, true},
+		{`sc-status in (500, 502, 503)`, true},
+		{`cs-uri-stem =~ /^\/v1\//`, true},
+		{`cs-uri-stem !~ /^\/v2\//`, true},
+		{`cs-host =~ "^api\\."`, true},
+		{`cs-host =~ /^www\./`, false},
+
+		// IPs and CIDRs
+		{`c-ip == 10.1.2.3`, true},
+		{`c-ip != 10.1.2.4`, true},
+		{`c-ip in 10.0.0.0/8`, true},
+		{`c-ip in (192.168.0.0/16, 172.16.0.0/12)`, false},
+		{`c-ip not in (192.168.0.0/16, 10.1.2.3)`, false},
+		{`c-ip > 10.1.2.2 && c-ip < 10.1.2.4`, true},
+
+		// numbers
+		{`sc-status >= 500`, true},
+		{`sc-status > 503`, false},
+		{`sc-status <= 503.0`, true},
+		{`time-taken < 1`, true},
+		{`time-taken == 0.25`, true},
+		{`time-taken > 1e-1`, true},
+
+		// dates, times and timestamps
+		{`date == 2024-03-10`, true},
+		{`date < 2024-03-11 && date > 2024-03-09`, true},
+		{`time >= 12:30:00`, true},
+		{`time < 12:30:45`, false},
+		{`gmttime >= "2024-03-10 12:00:00"`, true},
+		{`gmttime < 2024-03-10T12:30:45Z`, false},
+		{`gmttime == "2024-03-10T12:30:45Z"`, true},
+
+		// a field alone, and the missing values
+		{`cs-host`, true},
+		{`cs-username`, false},
+		{`cs-username == ""`, true},
+		{`cs-username != ""`, false},
+		{`cs-username == alice`, false},
+		{`cs-username != alice`, true},
+		{`cs-username in (alice, bob)`, false},
+		{`cs-username =~ /^$/`, true},
+	}
+	for _, test := range tests {
+		f, err := CompileFilter(test.expr, filterTestFields, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.expr, err)
+			continue
+		}
+		if got := f.Match(l); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestFilterMissingField(t *testing.T) {
+	// the field is known, but not present in the line
+	l := newTestLine(map[string]string{"sc-status": "200"})
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`c-ip == 10.0.0.1`, false},
+		{`c-ip != 10.0.0.1`, true},
+		{`c-ip in 10.0.0.0/8`, false},
+		{`c-ip not in 10.0.0.0/8`, true},
+		{`cs-host`, false},
+		{`!cs-host`, true},
+		{`time-taken > 1`, false},
+	}
+	for _, test := range tests {
+		f, err := CompileFilter(test.expr, filterTestFields, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.expr, err)
+			continue
+		}
+		if got := f.Match(l); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{``, "expected a field name"},
+		{`unknown == 1`, "unknown field"},
+		{`sc-status ==`, "expected a value"},
+		{`sc-status == abc`, "not a number"},
+		{`c-ip == 10.0.0.0/8`, "not an IP"},
+		{`c-ip in 10.0.0.0/33`, "not a CIDR"},
+		{`date == 2024-13-45`, "not a date"},
+		{`time > noon`, "not a time"},
+		{`gmttime > yesterday`, "not a timestamp"},
+		{`cs-host == "unclosed`, "unclosed string"},
+		{`cs-host == "bad \q escape"`, "invalid string"},
+		{`cs-host =~ /unclosed`, "unclosed regular expression"},
+		{`cs-host =~ "("`, "missing closing )"},
+		{`sc-status == /regex/`, "not a number"},
+		{`(sc-status == 200`, "expected ')'"},
+		{`sc-status == 200)`, "unexpected ')'"},
+		{`sc-status == 200 &&`, "expected a field name"},
+		{`&& sc-status == 200`, "expected a field name"},
+		{`cs-method in (GET, `, "expected a value"},
+		{`cs-method in (GET HEAD)`, "expected ',' or ')'"},
+		{`cs-method in ()`, "expected a value"},
+		{`cs(user-agent == 1`, "unclosed parenthesis"},
+		{`sc-status == 200 sc-status`, "unexpected 'sc-status'"},
+	}
+	for _, test := range tests {
+		var err error
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: panic: %v", test.expr, r)
+				}
+			}()
+			_, err = CompileFilter(test.expr, filterTestFields, nil)
+		}()
+		if err == nil {
+			t.Errorf("%s: expected an error", test.expr)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error '%s', want '%s'", test.expr, err, test.err)
+		}
+	}
+}
+
+func TestFilterFields(t *testing.T) {
+	f, err := CompileFilter(`sc-status >= 500 && (c-ip in 10.0.0.0/8 || cs-host)`, filterTestFields, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(f.Fields(), ",")
+	if got != "sc-status,c-ip,cs-host" {
+		t.Errorf("got fields %s", got)
+	}
+}
@@ -0,0 +1,22 @@
+package parser
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// GeoPoint represents a geographical location.
+type GeoPoint struct {
+	Lat float64
+	Lon float64
+}
+
+// String returns the location in the "lat,lon" format.
+func (p GeoPoint) String() string {
+	return strconv.FormatFloat(p.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(p.Lon, 'f', -1, 64)
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (p GeoPoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]float64{"lat": p.Lat, "lon": p.Lon})
+}
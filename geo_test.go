@@ -0,0 +1,30 @@
+package parser
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGeoPoint(t *testing.T) {
+	tests := []struct {
+		p        GeoPoint
+		str      string
+		jsonText string
+	}{
+		{GeoPoint{Lat: 48.8566, Lon: 2.3522}, "48.8566,2.3522", `{"lat":48.8566,"lon":2.3522}`},
+		{GeoPoint{Lat: -33.9, Lon: -70}, "-33.9,-70", `{"lat":-33.9,"lon":-70}`},
+		{GeoPoint{}, "0,0", `{"lat":0,"lon":0}`},
+	}
+	for _, test := range tests {
+		if got := test.p.String(); got != test.str {
+			t.Errorf("got '%s', want '%s'", got, test.str)
+		}
+		b, err := json.Marshal(test.p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.jsonText {
+			t.Errorf("got %s, want %s", b, test.jsonText)
+		}
+	}
+}
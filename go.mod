@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	github.com/clarkduvall/hyperloglog v0.0.0-20171127014514-a0107a5d8004
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/inconshreveable/log15 v0.0.0-20201112154412-8562bdadbbac
 	github.com/jackc/pgx v3.6.2+incompatible
 	github.com/mailru/easyjson v0.7.6 // indirect
@@ -12,5 +13,7 @@ require (
 	github.com/satori/go.uuid v1.2.0
 	github.com/spaolacci/murmur3 v1.1.0
 	github.com/spf13/cobra v1.1.1
+	golang.org/x/sys v0.7.0 // indirect
 	golang.org/x/text v0.3.4
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,67 @@
+package parser
+
+// The names of the fields that group the HTTP header fields.
+const (
+	RequestHeaders  = "request.headers"
+	ResponseHeaders = "response.headers"
+)
+
+// headerGroup returns the group of a HTTP header field like cs(user-agent),
+// and the name of the header. It returns empty strings if fieldName is not
+// a HTTP header field.
+//
+// cs(...) and sr(...) fields are request headers, sc(...) and rs(...)
+// fields are response headers.
+func headerGroup(fieldName string) (group string, header string) {
+	if len(fieldName) < 5 || fieldName[2] != '(' || fieldName[len(fieldName)-1] != ')' {
+		return "", ""
+	}
+	header = fieldName[3 : len(fieldName)-1]
+	switch fieldName[:2] {
+	case "cs", "sr":
+		return RequestHeaders, header
+	case "sc", "rs":
+		return ResponseHeaders, header
+	default:
+		return "", ""
+	}
+}
+
+// HeaderGroup returns the group of a HTTP header field, request.headers or
+// response.headers. It returns an empty string if fieldName is not a HTTP
+// header field.
+func HeaderGroup(fieldName string) string {
+	g, _ := headerGroup(fieldName)
+	return g
+}
+
+// IsHeaderField returns true if fieldName is a HTTP header field.
+func IsHeaderField(fieldName string) bool {
+	g, _ := headerGroup(fieldName)
+	return g != ""
+}
+
+// GroupHeaderNames returns the field names as exposed by lines that group the
+// HTTP header fields: the header fields are replaced by the request.headers
+// and response.headers fields.
+func GroupHeaderNames(names []string) (ret []string) {
+	ret = make([]string, 0, len(names))
+	var hasRequest, hasResponse bool
+	for _, name := range names {
+		switch g, _ := headerGroup(name); g {
+		case RequestHeaders:
+			if !hasRequest {
+				ret = append(ret, RequestHeaders)
+				hasRequest = true
+			}
+		case ResponseHeaders:
+			if !hasResponse {
+				ret = append(ret, ResponseHeaders)
+				hasResponse = true
+			}
+		default:
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
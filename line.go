@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"strings"
 	"time"
 )
 
@@ -13,6 +15,13 @@ type Line struct {
 	// fields stores the individual fields of the log line.
 	fields map[string]interface{}
 	names  []string
+	// derived stores the names of the fields that do not come from the
+	// file header, but are computed from the other fields.
+	derived []string
+	// groupHeaders tells whether the HTTP header fields are exposed as maps.
+	groupHeaders bool
+	// deleted tells whether some header fields have been deleted.
+	deleted bool
 }
 
 func NewLine(names []string) (l *Line) {
@@ -23,6 +32,8 @@ func NewLine(names []string) (l *Line) {
 
 func (l *Line) Reset(names []string) {
 	l.names = names
+	l.derived = l.derived[:0]
+	l.deleted = false
 	if l.fields == nil {
 		l.fields = make(map[string]interface{}, len(l.names))
 	} else {
@@ -35,18 +46,38 @@ func (l *Line) Reset(names []string) {
 	}
 }
 
+// SetGroupHeaders sets whether the HTTP header fields like cs(user-agent)
+// are grouped into the request.headers and response.headers maps.
+func (l *Line) SetGroupHeaders(group bool) *Line {
+	l.groupHeaders = group
+	return l
+}
+
 func (l *Line) Names() (ret []string) {
+	names := l.names
+	if l.deleted {
+		names = make([]string, 0, len(l.names))
+		for _, name := range l.names {
+			if _, ok := l.fields[name]; ok {
+				names = append(names, name)
+			}
+		}
+	}
+	if l.groupHeaders {
+		return append(GroupHeaderNames(names), l.derived...)
+	}
 	// we return a copy of internal names
-	ret = make([]string, 0, len(l.names))
-	for _, name := range l.names {
+	ret = make([]string, 0, len(names)+len(l.derived))
+	for _, name := range names {
 		ret = append(ret, name)
 	}
-	return ret
+	return append(ret, l.derived...)
 }
 
 func (l *Line) Fields() (ret []interface{}) {
-	ret = make([]interface{}, 0, len(l.names))
-	for _, name := range l.names {
+	names := l.Names()
+	ret = make([]interface{}, 0, len(names))
+	for _, name := range names {
 		ret = append(ret, l.Get(name))
 	}
 	return ret
@@ -69,17 +100,113 @@ func (l *Line) add(key string, value string) {
 	}
 }
 
+// Set sets the value of a field. If the field does not come from the file
+// header, it is added to the line as a derived field. A deleted field of the
+// header is restored at its place.
+func (l *Line) Set(key string, value interface{}) {
+	if _, ok := l.fields[key]; !ok && !(l.deleted && contains(l.names, key)) {
+		l.derived = append(l.derived, key)
+	}
+	l.fields[key] = value
+}
+
+// Has returns true if the line has the given field, even with an empty value.
+func (l *Line) Has(key string) bool {
+	_, ok := l.fields[key]
+	return ok
+}
+
+// Clear removes the value of the given field.
+func (l *Line) Clear(key string) {
+	if _, ok := l.fields[key]; ok {
+		l.fields[key] = nil
+	}
+}
+
+// Delete removes the given field from the line.
+func (l *Line) Delete(key string) {
+	if _, ok := l.fields[key]; !ok {
+		return
+	}
+	delete(l.fields, key)
+	for i, name := range l.derived {
+		if name == key {
+			l.derived = append(l.derived[:i], l.derived[i+1:]...)
+			return
+		}
+	}
+	l.deleted = true
+}
+
 func (l *Line) Get(key string) interface{} {
-	if key == "gmttime" {
+	switch key {
+	case "gmttime":
 		return l.GetTime()
+	case RequestHeaders, ResponseHeaders:
+		if h := l.headers(key); h != nil {
+			return h
+		}
+		return nil
 	}
 	return l.fields[key]
 }
 
+// HeaderFields returns the names of the HTTP header fields of the line that
+// belong to the given group, like cs(user-agent) for request.headers, even
+// when the header fields are grouped.
+func (l *Line) HeaderFields(group string) (ret []string) {
+	for _, name := range l.names {
+		if _, ok := l.fields[name]; !ok {
+			continue
+		}
+		if g, _ := headerGroup(name); g == group {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// headers returns the HTTP header fields of the line that belong to the given
+// group, indexed by header name. It returns nil if there is no such header.
+func (l *Line) headers(group string) (ret map[string]interface{}) {
+	for _, name := range l.names {
+		g, header := headerGroup(name)
+		if g != group || l.fields[name] == nil {
+			continue
+		}
+		if ret == nil {
+			ret = make(map[string]interface{})
+		}
+		if _, ok := ret[header]; ok && (name[:2] == "sr" || name[:2] == "rs") {
+			// the headers between client and proxy take precedence
+			continue
+		}
+		ret[header] = l.fields[name]
+	}
+	return ret
+}
+
 func itostr(v interface{}) string {
 	if v == nil {
 		return ""
 	}
+	switch val := v.(type) {
+	case map[string]interface{}, map[string]string, map[string][]string:
+		b, err := json.Marshal(v)
+		if err == nil {
+			return string(b)
+		}
+	case []net.IP:
+		ips := make([]string, 0, len(val))
+		for _, ip := range val {
+			if ip == nil {
+				ips = append(ips, "-")
+			} else {
+				ips = append(ips, ip.String())
+			}
+		}
+		return strings.Join(ips, ",")
+	}
 	return fmt.Sprintf("%v", v)
 }
 
@@ -98,8 +225,25 @@ func (l *Line) GetAsString(key string) string {
 func (l *Line) GetAll() map[string]interface{} {
 	newFields := make(map[string]interface{}, len(l.fields)+1)
 	for k, v := range l.fields {
-		if v != nil {
-			newFields[k] = v
+		if v == nil {
+			continue
+		}
+		if l.groupHeaders {
+			if g, _ := headerGroup(k); g != "" {
+				continue
+			}
+		}
+		if ips, ok := v.([]net.IP); ok {
+			newFields[k] = exportIPList(ips)
+			continue
+		}
+		newFields[k] = v
+	}
+	if l.groupHeaders {
+		for _, group := range []string{RequestHeaders, ResponseHeaders} {
+			if h := l.headers(group); h != nil {
+				newFields[group] = h
+			}
 		}
 	}
 	t := l.GetTime()
@@ -125,26 +269,44 @@ func (l *Line) WriteTo(w io.Writer, jsonExport bool) (err error) {
 	return err
 }
 
+// Cookies returns the cookies parsed from the cs(cookie) field, or nil if
+// the cookies were not parsed.
+func (l *Line) Cookies() map[string]string {
+	if c, ok := l.fields[RequestCookies].(map[string]string); ok {
+		return c
+	}
+	return nil
+}
+
+// Query returns the parameters parsed from the query string, or nil if the
+// query string was not parsed.
+func (l *Line) Query() map[string][]string {
+	if q, ok := l.fields[RequestQuery].(map[string][]string); ok {
+		return q
+	}
+	return nil
+}
+
 // GetTime returns the log line timestamp.
 // It returns the time.Time zero value if the timestamp can not be found.
 func (l *Line) GetTime() time.Time {
-	if l.fields["gmttime"] != nil {
-		return l.fields["gmttime"].(time.Time)
+	if t, ok := l.fields["gmttime"].(time.Time); ok {
+		return t
 	}
-	if l.fields["time"] != nil && l.fields["date"] != nil {
-		t := l.fields["time"].(Time)
-		d := l.fields["date"].(Date)
+	t, okTime := l.fields["time"].(Time)
+	d, okDate := l.fields["date"].(Date)
+	if okTime && okDate {
 		return DateTime{Date: d, Time: t}.In(time.UTC)
 	}
-	if l.fields["localtime"] != nil {
-		return l.fields["localtime"].(time.Time)
+	if t, ok := l.fields["localtime"].(time.Time); ok {
+		return t
 	}
 	return time.Time{}
 }
 
 func (l *Line) GetDate() (d Date) {
-	if l.fields["date"] != nil {
-		return l.fields["date"].(Date)
+	if d, ok := l.fields["date"].(Date); ok {
+		return d
 	}
 	t := l.GetTime()
 	if !t.IsZero() {
@@ -0,0 +1,144 @@
+package parser
+
+import (
+	"net/url"
+	"strings"
+)
+
+// The names of the fields that store the parsed cookies and query string.
+const (
+	RequestCookies = "request.cookies"
+	RequestQuery   = "request.query"
+)
+
+// KeyFilter selects keys by name. A key is kept if Allow is empty or contains
+// the key, and if Deny does not contain the key.
+type KeyFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// Keep returns true if the key is selected by the filter.
+func (f *KeyFilter) Keep(key string) bool {
+	if f == nil {
+		return true
+	}
+	for _, k := range f.Deny {
+		if k == key {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, k := range f.Allow {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCookies parses the raw value of a cs(cookie) field into a map of
+// cookie names to cookie values. The values are not decoded. It returns nil
+// if no cookie was selected by filter.
+func ParseCookies(s string, filter *KeyFilter) (ret map[string]string) {
+	s = strings.TrimSpace(s)
+	if s == "-" || s == "" {
+		return nil
+	}
+	for _, cookie := range strings.Split(s, ";") {
+		// spaces are logged as '+' in header fields
+		cookie = strings.TrimLeft(cookie, "+ ")
+		if cookie == "" {
+			continue
+		}
+		kv := strings.SplitN(cookie, "=", 2)
+		name := strings.TrimRight(kv[0], "+ ")
+		if name == "" || !filter.Keep(name) {
+			continue
+		}
+		value := ""
+		if len(kv) == 2 {
+			value = strings.TrimRight(kv[1], "+ ")
+			if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+		}
+		if ret == nil {
+			ret = make(map[string]string)
+		}
+		ret[name] = value
+	}
+	return ret
+}
+
+// ParseQuery parses the raw value of a query string into a map of parameter
+// names to parameter values. Names and values are decoded separately, so that
+// encoded separators do not split parameters. Names or values that can not be
+// decoded are kept as is. It returns nil if no parameter was selected by
+// filter.
+func ParseQuery(s string, filter *KeyFilter) (ret map[string][]string) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "?")
+	if s == "-" || s == "" {
+		return nil
+	}
+	for _, param := range strings.Split(s, "&") {
+		if param == "" {
+			continue
+		}
+		kv := strings.SplitN(param, "=", 2)
+		name := unescapeQuery(kv[0])
+		if name == "" || !filter.Keep(name) {
+			continue
+		}
+		value := ""
+		if len(kv) == 2 {
+			value = unescapeQuery(kv[1])
+		}
+		if ret == nil {
+			ret = make(map[string][]string)
+		}
+		ret[name] = append(ret[name], value)
+	}
+	return ret
+}
+
+func unescapeQuery(s string) string {
+	unescaped, err := url.QueryUnescape(s)
+	if err != nil {
+		return s
+	}
+	return unescaped
+}
+
+// deriveMaps sets the map fields of l that are derived from the raw value of
+// the given field.
+func (p *FileParser) deriveMaps(l *Line, name string, raw string) {
+	switch {
+	case name == "cs(cookie)" && p.cookies != nil:
+		if cookies := ParseCookies(raw, p.cookies); cookies != nil {
+			l.Set(RequestCookies, cookies)
+			return
+		}
+		l.Set(RequestCookies, nil)
+	case p.query != nil && name == p.queryField():
+		if name == "cs-uri" {
+			raw = uriQuery(raw)
+		}
+		if query := ParseQuery(raw, p.query); query != nil {
+			l.Set(RequestQuery, query)
+			return
+		}
+		l.Set(RequestQuery, nil)
+	}
+}
+
+// uriQuery returns the query part of a raw URI.
+func uriQuery(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i == -1 {
+		return ""
+	}
+	return uri[i+1:]
+}
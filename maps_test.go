@@ -0,0 +1,129 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		s    string
+		want map[string][]string
+	}{
+		{"-", nil},
+		{"", nil},
+		{"?", nil},
+		{"a=1", map[string][]string{"a": {"1"}}},
+		{"?a=1&b=2", map[string][]string{"a": {"1"}, "b": {"2"}}},
+		// repeated keys keep every value, in order
+		{"a=1&a=2&b=3&a=", map[string][]string{"a": {"1", "2", ""}, "b": {"3"}}},
+		// empty values, and parameters without a value
+		{"a=&b&c=3", map[string][]string{"a": {""}, "b": {""}, "c": {"3"}}},
+		{"a=1&&b=2&", map[string][]string{"a": {"1"}, "b": {"2"}}},
+		{"=1&a=2", map[string][]string{"a": {"2"}}},
+		// names and values are decoded separately
+		{"user%5Fid=42&q=a%26b%3Dc&sp=a+b", map[string][]string{"user_id": {"42"}, "q": {"a&b=c"}, "sp": {"a b"}}},
+		{"a=1=2", map[string][]string{"a": {"1=2"}}},
+		// bad percent-encoding is kept as is
+		{"a=%zz&b%=1&c=%4", map[string][]string{"a": {"%zz"}, "b%": {"1"}, "c": {"%4"}}},
+		{"q=%E9t%E9", map[string][]string{"q": {"\xe9t\xe9"}}},
+	}
+	for _, test := range tests {
+		got := ParseQuery(test.s, nil)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("'%s': got %v, want %v", test.s, got, test.want)
+		}
+	}
+}
+
+func TestParseQueryFilter(t *testing.T) {
+	s := "a=1&b=2&c=3&user%5Fid=4"
+	tests := []struct {
+		filter KeyFilter
+		want   map[string][]string
+	}{
+		{KeyFilter{}, map[string][]string{"a": {"1"}, "b": {"2"}, "c": {"3"}, "user_id": {"4"}}},
+		{KeyFilter{Allow: []string{"a", "user_id"}}, map[string][]string{"a": {"1"}, "user_id": {"4"}}},
+		{KeyFilter{Deny: []string{"a", "user_id"}}, map[string][]string{"b": {"2"}, "c": {"3"}}},
+		{KeyFilter{Allow: []string{"a", "b"}, Deny: []string{"b"}}, map[string][]string{"a": {"1"}}},
+		{KeyFilter{Allow: []string{"z"}}, nil},
+	}
+	for _, test := range tests {
+		filter := test.filter
+		got := ParseQuery(s, &filter)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v: got %v, want %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestParseCookies(t *testing.T) {
+	tests := []struct {
+		s    string
+		want map[string]string
+	}{
+		{"-", nil},
+		{"", nil},
+		{" ", nil},
+		{"a=1", map[string]string{"a": "1"}},
+		// spaces are logged as '+'
+		{"a=1;+b=2;+c=3", map[string]string{"a": "1", "b": "2", "c": "3"}},
+		{"a=1; b=2 ;c=3", map[string]string{"a": "1", "b": "2", "c": "3"}},
+		// the last value of a repeated cookie wins
+		{"a=1;+a=2", map[string]string{"a": "2"}},
+		// empty values, and cookies without a value
+		{"a=;+b;+c=3", map[string]string{"a": "", "b": "", "c": "3"}},
+		{";;a=1;;", map[string]string{"a": "1"}},
+		{"=1;+a=2", map[string]string{"a": "2"}},
+		// quoted values are unquoted, the values are not decoded
+		{`a="quoted";+b="`, map[string]string{"a": "quoted", "b": `"`}},
+		{"a=x%3Dy;+b=%zz;+c=1=2", map[string]string{"a": "x%3Dy", "b": "%zz", "c": "1=2"}},
+	}
+	for _, test := range tests {
+		got := ParseCookies(test.s, nil)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("'%s': got %v, want %v", test.s, got, test.want)
+		}
+	}
+	got := ParseCookies("session=x;+tracking=y;+lang=fr", &KeyFilter{Deny: []string{"tracking"}})
+	if want := map[string]string{"session": "x", "lang": "fr"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deny: got %v, want %v", got, want)
+	}
+	if got = ParseCookies("tracking=y", &KeyFilter{Deny: []string{"tracking"}}); got != nil {
+		t.Errorf("deny all: got %v, want nil", got)
+	}
+}
+
+func TestDeriveMaps(t *testing.T) {
+	p := NewFileParser(nil)
+	p.SetFieldNames([]string{"cs-uri", "cs(cookie)"})
+	p.SetCookies(&KeyFilter{})
+	p.SetQuery(&KeyFilter{})
+	names := p.LineNames()
+	if want := []string{"cs-uri", "cs(cookie)", RequestQuery, RequestCookies}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names: got %v, want %v", names, want)
+	}
+	tests := []struct {
+		uri, cookie string
+		query       interface{}
+		cookies     interface{}
+	}{
+		{"/p?a=1&a=2", "s=1", map[string][]string{"a": {"1", "2"}}, map[string]string{"s": "1"}},
+		{"/p", "-", nil, nil},
+		{"/p?", "", nil, nil},
+	}
+	for _, test := range tests {
+		l := NewLine(p.FieldNames())
+		p.deriveMaps(l, "cs-uri", test.uri)
+		p.deriveMaps(l, "cs(cookie)", test.cookie)
+		if got := l.Get(RequestQuery); !reflect.DeepEqual(got, test.query) {
+			t.Errorf("%s: query: got %#v, want %#v", test.uri, got, test.query)
+		}
+		if got := l.Get(RequestCookies); !reflect.DeepEqual(got, test.cookies) {
+			t.Errorf("%s: cookies: got %#v, want %#v", test.cookie, got, test.cookies)
+		}
+		if !l.Has(RequestQuery) || !l.Has(RequestCookies) {
+			t.Error("the map fields must be set, even when empty")
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strings"
 )
 
@@ -41,21 +42,24 @@ func (h *FileHeader) FieldNames() (ret []string) {
 	return ret
 }
 
-func parseFileHeader(reader *bufio.Reader) (*FileHeader, error) {
-	h := new(FileHeader)
+// parseFileHeader parses the header directives. size is the number of bytes
+// of the header.
+func parseFileHeader(reader *bufio.Reader) (h *FileHeader, size int64, err error) {
+	h = new(FileHeader)
 	h.Meta = make(map[string]string)
 	for {
 		c, err := reader.Peek(1)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		if c[0] != '#' {
 			break
 		}
 		metaline, err := reader.ReadString('\n')
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
+		size += int64(len(metaline))
 		metaline = strings.TrimSpace(metaline[1:])
 		if len(metaline) > 0 {
 			kv := strings.SplitN(metaline, ":", 2)
@@ -81,14 +85,23 @@ func parseFileHeader(reader *bufio.Reader) (*FileHeader, error) {
 			}
 		}
 	}
-	return h, nil
+	return h, size, nil
 }
 
 // FileParser is used to parse a W3C Extended Log Format file.
 type FileParser struct {
 	FileHeader
+	// source is the reader given to NewFileParser.
+	source  io.Reader
 	reader  *bufio.Reader
 	scanner *Scanner
+	// base is the offset in the file of the first byte read by scanner.
+	base         int64
+	groupHeaders bool
+	cookies      *KeyFilter
+	query        *KeyFilter
+	// trustedProxies enables the client.ip field when not nil.
+	trustedProxies []*net.IPNet
 }
 
 // NewFileParser constructs a FileParser
@@ -101,6 +114,7 @@ func NewFileParser(reader io.Reader) *FileParser {
 		bufreader = bufio.NewReaderSize(reader, 16*1024*1024)
 	}
 	parser := FileParser{
+		source:  reader,
 		reader:  bufreader,
 		scanner: NewScanner(bufreader),
 	}
@@ -110,11 +124,42 @@ func NewFileParser(reader io.Reader) *FileParser {
 // ParseHeader is used to parse the header part of a W3C Extended Log Format file.
 // The io.Reader should be at the start of the file.
 func (p *FileParser) ParseHeader() error {
-	header, err := parseFileHeader(p.reader)
+	header, size, err := parseFileHeader(p.reader)
 	if err != nil {
 		return err
 	}
 	p.FileHeader = *header
+	p.base += size
+	return nil
+}
+
+// Offset returns the byte offset in the file of the end of the last line
+// returned by the parser, or of the end of the header if no line has been
+// returned yet. Parsing can be resumed from that offset with SeekTo.
+func (p *FileParser) Offset() int64 {
+	return p.base + p.scanner.Offset()
+}
+
+// SeekTo positions the parser at the given byte offset, that should have
+// been returned by Offset. The header must have been parsed first, so that
+// the field names are known: the directives between the header and the
+// offset are not read. The reader given to NewFileParser must implement
+// io.Seeker.
+func (p *FileParser) SeekTo(offset int64) error {
+	if offset == p.Offset() {
+		return nil
+	}
+	seeker, ok := p.source.(io.Seeker)
+	if !ok {
+		return errors.New("the reader is not seekable")
+	}
+	_, err := seeker.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	p.reader.Reset(p.source)
+	p.scanner = NewScanner(p.reader)
+	p.base = offset
 	return nil
 }
 
@@ -124,6 +169,63 @@ func (p *FileParser) SetFieldNames(fieldNames []string) *FileParser {
 	return p
 }
 
+// SetGroupHeaders sets whether the parsed lines should group the HTTP header
+// fields into the request.headers and response.headers maps.
+func (p *FileParser) SetGroupHeaders(group bool) *FileParser {
+	p.groupHeaders = group
+	return p
+}
+
+// SetCookies sets whether the cs(cookie) field is parsed into the
+// request.cookies map. Only the cookies selected by filter are kept.
+// A nil filter disables cookie parsing.
+func (p *FileParser) SetCookies(filter *KeyFilter) *FileParser {
+	p.cookies = filter
+	return p
+}
+
+// SetQuery sets whether the query string is parsed into the request.query
+// map. Only the parameters selected by filter are kept. A nil filter disables
+// query string parsing.
+func (p *FileParser) SetQuery(filter *KeyFilter) *FileParser {
+	p.query = filter
+	return p
+}
+
+// LineNames returns the field names of the lines returned by the parser,
+// taking into account the grouped header fields and the derived fields.
+func (p *FileParser) LineNames() (ret []string) {
+	if p.groupHeaders {
+		ret = GroupHeaderNames(p.fieldNames)
+	} else {
+		ret = p.FieldNames()
+	}
+	// the derived fields are set in the order of the fields they come from
+	for _, name := range p.fieldNames {
+		switch {
+		case p.cookies != nil && name == "cs(cookie)":
+			ret = append(ret, RequestCookies)
+		case p.query != nil && name == p.queryField():
+			ret = append(ret, RequestQuery)
+		}
+	}
+	if p.hasClientIP() {
+		ret = append(ret, ClientIP)
+	}
+	return ret
+}
+
+// queryField returns the name of the field that carries the query string.
+func (p *FileParser) queryField() string {
+	if p.HasField("cs-uri-query") {
+		return "cs-uri-query"
+	}
+	if p.HasField("cs-uri") {
+		return "cs-uri"
+	}
+	return ""
+}
+
 // Next returns the next parsed log line.
 func (p *FileParser) Next() (*Line, error) {
 	return p.NextTo(nil)
@@ -144,12 +246,17 @@ func (p *FileParser) NextTo(l *Line) (*Line, error) {
 			// reuse the given line, but make sure to clean it before usage
 			l.Reset(p.FileHeader.fieldNames)
 		}
+		l.SetGroupHeaders(p.groupHeaders)
 		fields := p.scanner.Strings()
 		if len(fields) != len(p.FileHeader.fieldNames) {
 			return nil, fmt.Errorf("Wrong number of fields: expected = %d, actual = %d", len(p.FileHeader.fieldNames), len(fields))
 		}
 		for i, name = range p.FileHeader.fieldNames {
 			l.add(name, fields[i])
+			p.deriveMaps(l, name, fields[i])
+		}
+		if p.hasClientIP() {
+			p.deriveClientIP(l)
 		}
 		return l, nil
 	}
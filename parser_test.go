@@ -0,0 +1,143 @@
+package parser
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const offsetTestLog = `#Software: Microsoft Internet Information Services 10.0
+#Version: 1.0
+#Date: 2024-03-01 00:00:00
+#Fields: date time c-ip cs-method cs-uri-stem sc-status cs(user-agent)
+2024-03-01 00:00:01 10.0.0.1 GET /one 200 "Mozilla/5.0 (Windows)"
+2024-03-01 00:00:02 10.0.0.2 GET /two 404 curl/8.4.0
+#Remark: the server restarted
+#Date: 2024-03-01 00:00:03
+2024-03-01 00:00:03 10.0.0.3 POST /three 500 -
+
+2024-03-01 00:00:04 10.0.0.4 GET /four 200 "quoted # not a comment"
+# a comment
+2024-03-01 00:00:05 10.0.0.5 GET /five 301 -
+`
+
+// parseAll returns the fields of the lines of content, and the offset after
+// each line.
+func parseAll(t *testing.T, content string) (lines [][]interface{}, offsets []int64) {
+	p := NewFileParser(bytes.NewReader([]byte(content)))
+	err := p.ParseHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets = append(offsets, p.Offset())
+	for {
+		l, err := p.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l == nil {
+			return lines, offsets
+		}
+		lines = append(lines, l.Fields())
+		offsets = append(offsets, p.Offset())
+	}
+}
+
+func TestOffsetSeekTo(t *testing.T) {
+	tests := map[string]string{
+		"lf":                 offsetTestLog,
+		"crlf":               strings.Replace(offsetTestLog, "\n", "\r\n", -1),
+		"no final newline":   strings.TrimSuffix(offsetTestLog, "\n"),
+		"crlf, no final one": strings.TrimSuffix(strings.Replace(offsetTestLog, "\n", "\r\n", -1), "\r\n"),
+		"final comment":      offsetTestLog + "#End-Date: 2024-03-01 00:00:06",
+	}
+	for name, content := range tests {
+		lines, offsets := parseAll(t, content)
+		if len(lines) != 5 {
+			t.Errorf("%s: got %d lines, want 5", name, len(lines))
+			continue
+		}
+		for n, offset := range offsets {
+			if offset > int64(len(content)) {
+				t.Errorf("%s: offset %d after line %d is beyond the end", name, offset, n)
+				continue
+			}
+			// parse n lines, then resume with a fresh parser
+			p := NewFileParser(bytes.NewReader([]byte(content)))
+			err := p.ParseHeader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < n; i++ {
+				if _, err = p.Next(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if p.Offset() != offset {
+				t.Errorf("%s: offset after %d lines: got %d, want %d", name, n, p.Offset(), offset)
+			}
+			fresh := NewFileParser(bytes.NewReader([]byte(content)))
+			err = fresh.ParseHeader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = fresh.SeekTo(p.Offset())
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := fresh.Next()
+			if err != nil {
+				t.Fatalf("%s: after %d lines: %s", name, n, err)
+			}
+			if n == len(lines) {
+				if l != nil {
+					t.Errorf("%s: got a line after the last one: %v", name, l.Fields())
+				}
+				continue
+			}
+			if l == nil {
+				t.Errorf("%s: no line after %d lines", name, n)
+				continue
+			}
+			if !reflect.DeepEqual(l.Fields(), lines[n]) {
+				t.Errorf("%s: after %d lines: got %v, want %v", name, n, l.Fields(), lines[n])
+			}
+			// the offsets of the resumed parser match the original ones
+			if n+1 < len(offsets) && fresh.Offset() != offsets[n+1] {
+				t.Errorf("%s: offset of line %d after the seek: got %d, want %d", name, n+1, fresh.Offset(), offsets[n+1])
+			}
+		}
+	}
+}
+
+func TestOffsetEndOfLine(t *testing.T) {
+	content := strings.Replace(offsetTestLog, "\n", "\r\n", -1)
+	_, offsets := parseAll(t, content)
+	for _, offset := range offsets {
+		// every offset is at the start of a line
+		if offset > 0 && offset < int64(len(content)) && content[offset-1] != '\n' {
+			t.Errorf("offset %d is not at the start of a line: %q", offset, content[offset-1:])
+		}
+	}
+}
+
+func TestSeekToNotSeekable(t *testing.T) {
+	p := NewFileParser(strings.NewReader(offsetTestLog))
+	err := p.ParseHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// seeking to the current offset does not need to seek
+	if err = p.SeekTo(p.Offset()); err != nil {
+		t.Errorf("got %s", err)
+	}
+	p = NewFileParser(bytes.NewBufferString(offsetTestLog))
+	err = p.ParseHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.SeekTo(p.Offset() + 10); err == nil {
+		t.Error("expected an error")
+	}
+}
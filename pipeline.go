@@ -0,0 +1,173 @@
+package parser
+
+import "io"
+
+// Processor transforms the lines returned by a FileParser before they reach
+// an output. It can modify the fields of the line, or drop the line.
+type Processor interface {
+	// Process transforms l. keep is false if the line should be dropped.
+	Process(l *Line) (keep bool, err error)
+}
+
+// SchemaTransformer is implemented by the processors that change the fields
+// of the lines, so that the outputs can know the fields in advance, for
+// example to print a CSV header or to create a table.
+type SchemaTransformer interface {
+	// Fields returns the names of the fields that the processor adds to and
+	// removes from the lines that have the given field names.
+	Fields(names []string) (added []string, removed []string)
+	// Kind returns the data type of a field added or converted by the
+	// processor. ok is false if the processor does not change that field.
+	Kind(name string) (kind Kind, ok bool)
+}
+
+// ProcessorFunc adapts a function to the Processor interface.
+type ProcessorFunc func(l *Line) (keep bool, err error)
+
+// Process calls f(l).
+func (f ProcessorFunc) Process(l *Line) (bool, error) {
+	return f(l)
+}
+
+// Process implements the Processor interface: it drops the lines that do not
+// match the filter.
+func (f *Filter) Process(l *Line) (bool, error) {
+	return f.Match(l), nil
+}
+
+// Process implements the Processor interface: it drops the lines that were
+// not logged in the time range.
+func (r TimeRange) Process(l *Line) (bool, error) {
+	return r.Contains(l.GetTime()), nil
+}
+
+// Pipeline chains processors. A line is passed to the processors in order,
+// until one of them drops the line or returns an error. A Pipeline is itself
+// a Processor and a SchemaTransformer, so pipelines can be nested.
+type Pipeline struct {
+	processors []Processor
+}
+
+// NewPipeline returns a pipeline that applies the given processors in order.
+func NewPipeline(processors ...Processor) *Pipeline {
+	return new(Pipeline).Append(processors...)
+}
+
+// Append adds processors at the end of the pipeline. The nil processors are
+// ignored.
+func (p *Pipeline) Append(processors ...Processor) *Pipeline {
+	for _, proc := range processors {
+		if proc != nil {
+			p.processors = append(p.processors, proc)
+		}
+	}
+	return p
+}
+
+// Len returns the number of processors in the pipeline.
+func (p *Pipeline) Len() int {
+	return len(p.processors)
+}
+
+// Process applies the processors to l.
+func (p *Pipeline) Process(l *Line) (keep bool, err error) {
+	for _, proc := range p.processors {
+		keep, err = proc.Process(l)
+		if err != nil || !keep {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Fields returns the names of the fields that the processors add to and
+// remove from the lines that have the given field names. A processor sees
+// the fields added by the previous processors.
+func (p *Pipeline) Fields(names []string) (added []string, removed []string) {
+	available := append([]string(nil), names...)
+	for _, proc := range p.processors {
+		s, ok := proc.(SchemaTransformer)
+		if !ok {
+			continue
+		}
+		procAdded, procRemoved := s.Fields(available)
+		for _, name := range procRemoved {
+			available = removeName(available, name)
+			if contains(added, name) {
+				added = removeName(added, name)
+			} else {
+				removed = append(removed, name)
+			}
+		}
+		added = append(added, procAdded...)
+		available = append(available, procAdded...)
+	}
+	return added, removed
+}
+
+// Kind returns the data type of a field, as set by the last processor that
+// changes that field.
+func (p *Pipeline) Kind(name string) (Kind, bool) {
+	for i := len(p.processors) - 1; i >= 0; i-- {
+		if s, ok := p.processors[i].(SchemaTransformer); ok {
+			if k, ok := s.Kind(name); ok {
+				return k, true
+			}
+		}
+	}
+	return Invalid, false
+}
+
+// Names returns the field names of the processed lines, given the field names
+// of the input lines, as returned by FileParser.LineNames.
+func (p *Pipeline) Names(names []string) []string {
+	added, removed := p.Fields(names)
+	ret := make([]string, 0, len(names)+len(added))
+	for _, name := range names {
+		if !contains(removed, name) {
+			ret = append(ret, name)
+		}
+	}
+	return append(ret, added...)
+}
+
+// GuessType returns the data type of a field of the processed lines.
+func (p *Pipeline) GuessType(name string) Kind {
+	if k, ok := p.Kind(name); ok {
+		return k
+	}
+	return GuessType(name)
+}
+
+// Close closes the processors that implement io.Closer, in order. It returns
+// the first error.
+func (p *Pipeline) Close() (err error) {
+	for _, proc := range p.processors {
+		if c, ok := proc.(io.Closer); ok {
+			cerr := c.Close()
+			if err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func removeName(names []string, name string) []string {
+	ret := make([]string, 0, len(names))
+	for _, n := range names {
+		if n != name {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
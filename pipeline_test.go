@@ -0,0 +1,317 @@
+package parser
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testStage is a processor that adds and removes fields. The added fields are
+// only added when the line has all the required fields.
+type testStage struct {
+	name     string
+	requires []string
+	adds     map[string]Kind
+	removes  []string
+	drop     bool
+	err      error
+	closeErr error
+	calls    *[]string
+}
+
+func (s *testStage) Fields(names []string) (added []string, removed []string) {
+	for _, name := range s.requires {
+		if !contains(names, name) {
+			return nil, nil
+		}
+	}
+	for _, name := range sortedKeys(s.adds) {
+		added = append(added, name)
+	}
+	for _, name := range s.removes {
+		if contains(names, name) {
+			removed = append(removed, name)
+		}
+	}
+	return added, removed
+}
+
+func (s *testStage) Kind(name string) (Kind, bool) {
+	k, ok := s.adds[name]
+	return k, ok
+}
+
+func (s *testStage) Process(l *Line) (bool, error) {
+	if s.calls != nil {
+		*s.calls = append(*s.calls, s.name)
+	}
+	if s.err != nil {
+		return false, s.err
+	}
+	if s.drop {
+		return false, nil
+	}
+	for _, name := range sortedKeys(s.adds) {
+		l.Set(name, s.name)
+	}
+	for _, name := range s.removes {
+		l.Delete(name)
+	}
+	return true, nil
+}
+
+func (s *testStage) Close() error {
+	if s.calls != nil {
+		*s.calls = append(*s.calls, "close "+s.name)
+	}
+	return s.closeErr
+}
+
+func sortedKeys(m map[string]Kind) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestPipelineFields(t *testing.T) {
+	p := NewPipeline(
+		&testStage{name: "a", adds: map[string]Kind{"a.one": Int64, "a.two": String}},
+		// removes a field added by a previous stage, and a field of the file
+		&testStage{name: "b", removes: []string{"a.two", "c-ip"}},
+		// only adds its field when a.two is still there
+		&testStage{name: "c", requires: []string{"a.two"}, adds: map[string]Kind{"c.one": Bool}},
+		// sees the field added by a
+		&testStage{name: "d", requires: []string{"a.one"}, adds: map[string]Kind{"d.one": MyIP}},
+		nil,
+	)
+	if p.Len() != 4 {
+		t.Errorf("got %d processors, want 4", p.Len())
+	}
+	added, removed := p.Fields([]string{"date", "time", "c-ip"})
+	if want := []string{"a.one", "d.one"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("added: got %v, want %v", added, want)
+	}
+	if want := []string{"c-ip"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed: got %v, want %v", removed, want)
+	}
+	names := p.Names([]string{"date", "time", "c-ip"})
+	if want := []string{"date", "time", "a.one", "d.one"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names: got %v, want %v", names, want)
+	}
+	// the fields that are not in the input are not removed
+	_, removed = p.Fields([]string{"date"})
+	if len(removed) != 0 {
+		t.Errorf("removed: got %v, want nothing", removed)
+	}
+}
+
+func TestPipelineFieldsReAdded(t *testing.T) {
+	// a field removed and added again is only reported as added
+	p := NewPipeline(
+		&testStage{name: "a", removes: []string{"cs-host"}},
+		&testStage{name: "b", adds: map[string]Kind{"cs-host": String}},
+	)
+	added, removed := p.Fields([]string{"cs-host"})
+	if !reflect.DeepEqual(added, []string{"cs-host"}) || len(removed) != 1 {
+		t.Errorf("got added %v, removed %v", added, removed)
+	}
+	// a field added and removed again is not reported at all
+	p = NewPipeline(
+		&testStage{name: "a", adds: map[string]Kind{"tmp": String}},
+		&testStage{name: "b", removes: []string{"tmp"}},
+	)
+	added, removed = p.Fields([]string{"date"})
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("got added %v, removed %v", added, removed)
+	}
+}
+
+func TestPipelineKind(t *testing.T) {
+	inner := NewPipeline(&testStage{name: "inner", adds: map[string]Kind{"x": Float64, "y": Bool}})
+	p := NewPipeline(
+		&testStage{name: "a", adds: map[string]Kind{"x": Int64, "sc-status": Int64}},
+		inner,
+		&testStage{name: "c", adds: map[string]Kind{"sc-status": String}},
+		ProcessorFunc(func(l *Line) (bool, error) { return true, nil }),
+	)
+	tests := []struct {
+		name string
+		kind Kind
+		ok   bool
+	}{
+		// the last stage that changes a field gives its type
+		{"x", Float64, true},
+		{"y", Bool, true},
+		{"sc-status", String, true},
+		{"c-ip", Invalid, false},
+	}
+	for _, test := range tests {
+		kind, ok := p.Kind(test.name)
+		if kind != test.kind || ok != test.ok {
+			t.Errorf("%s: got %v %v, want %v %v", test.name, kind, ok, test.kind, test.ok)
+		}
+	}
+	if k := p.GuessType("sc-status"); k != String {
+		t.Errorf("GuessType(sc-status): got %v, want String", k)
+	}
+	// the fields of the file keep their type
+	if k := p.GuessType("c-ip"); k != MyIP {
+		t.Errorf("GuessType(c-ip): got %v, want MyIP", k)
+	}
+}
+
+func TestPipelineProcess(t *testing.T) {
+	var calls []string
+	p := NewPipeline(
+		&testStage{name: "a", adds: map[string]Kind{"a.one": String}, calls: &calls},
+		&testStage{name: "b", removes: []string{"c-ip"}, calls: &calls},
+	)
+	l := newTestLine(map[string]string{"date": "2024-03-01", "c-ip": "10.0.0.1"})
+	keep, err := p.Process(l)
+	if !keep || err != nil {
+		t.Fatalf("got %v %v", keep, err)
+	}
+	if !reflect.DeepEqual(calls, []string{"a", "b"}) {
+		t.Errorf("calls: got %v", calls)
+	}
+	if l.Get("a.one") != "a" || l.Has("c-ip") {
+		t.Errorf("got line %v", l.GetAll())
+	}
+}
+
+func TestPipelineDrop(t *testing.T) {
+	var calls []string
+	p := NewPipeline(
+		&testStage{name: "a", calls: &calls},
+		&testStage{name: "drop", drop: true, calls: &calls},
+		&testStage{name: "c", adds: map[string]Kind{"c.one": String}, calls: &calls},
+	)
+	l := newTestLine(map[string]string{"date": "2024-03-01"})
+	keep, err := p.Process(l)
+	if keep || err != nil {
+		t.Errorf("got %v %v, want the line to be dropped", keep, err)
+	}
+	// the stages after the drop are not called
+	if !reflect.DeepEqual(calls, []string{"a", "drop"}) {
+		t.Errorf("calls: got %v", calls)
+	}
+	if l.Has("c.one") {
+		t.Error("the dropped line was processed by the last stage")
+	}
+
+	calls = nil
+	p = NewPipeline(
+		&testStage{name: "a", calls: &calls},
+		&testStage{name: "fail", err: errors.New("failed"), calls: &calls},
+		&testStage{name: "c", calls: &calls},
+	)
+	keep, err = p.Process(l)
+	if keep || err == nil || err.Error() != "failed" {
+		t.Errorf("got %v %v, want the error", keep, err)
+	}
+	if !reflect.DeepEqual(calls, []string{"a", "fail"}) {
+		t.Errorf("calls: got %v", calls)
+	}
+
+	// the filters drop the lines
+	f, err := CompileFilter("sc-status >= 500", []string{"sc-status"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = NewPipeline(f)
+	for status, want := range map[string]bool{"200": false, "503": true} {
+		keep, err = p.Process(newTestLine(map[string]string{"sc-status": status}))
+		if keep != want || err != nil {
+			t.Errorf("status %s: got %v %v, want %v", status, keep, err, want)
+		}
+	}
+}
+
+func TestPipelineClose(t *testing.T) {
+	var calls []string
+	p := NewPipeline(
+		&testStage{name: "a", calls: &calls},
+		&testStage{name: "b", closeErr: errors.New("b failed"), calls: &calls},
+		&testStage{name: "c", closeErr: errors.New("c failed"), calls: &calls},
+	)
+	err := p.Close()
+	if err == nil || err.Error() != "b failed" {
+		t.Errorf("got %v, want the first error", err)
+	}
+	// every processor is closed, in order
+	if !reflect.DeepEqual(calls, []string{"close a", "close b", "close c"}) {
+		t.Errorf("calls: got %v", calls)
+	}
+}
+
+func TestLineDelete(t *testing.T) {
+	l := NewLine([]string{"date", "time", "c-ip", "cs-host"})
+	l.add("date", "2024-03-01")
+	l.add("c-ip", "10.0.0.1")
+	l.add("cs-host", "example.com")
+	l.Set("derived.one", "x")
+	l.Set("derived.two", "y")
+
+	l.Delete("c-ip")
+	l.Delete("derived.one")
+	// deleting an unknown field does nothing
+	l.Delete("unknown")
+
+	if want := []string{"date", "time", "cs-host", "derived.two"}; !reflect.DeepEqual(l.Names(), want) {
+		t.Errorf("names: got %v, want %v", l.Names(), want)
+	}
+	if len(l.Fields()) != 4 {
+		t.Errorf("fields: got %v", l.Fields())
+	}
+	if l.Has("c-ip") || l.Get("c-ip") != nil || l.Has("derived.one") {
+		t.Error("the deleted fields are still there")
+	}
+	if _, ok := l.GetAll()["c-ip"]; ok {
+		t.Error("GetAll returns a deleted field")
+	}
+	// a deleted field can be set again, at its place
+	l.Set("c-ip", "10.0.0.2")
+	if want := []string{"date", "time", "c-ip", "cs-host", "derived.two"}; !reflect.DeepEqual(l.Names(), want) {
+		t.Errorf("names: got %v, want %v", l.Names(), want)
+	}
+
+	// Reset restores the fields of the header
+	l.Reset([]string{"date", "c-ip"})
+	if want := []string{"date", "c-ip"}; !reflect.DeepEqual(l.Names(), want) {
+		t.Errorf("names after reset: got %v, want %v", l.Names(), want)
+	}
+	if !l.Has("c-ip") || l.Get("c-ip") != nil {
+		t.Error("the field is not restored by Reset")
+	}
+}
+
+func TestLineClear(t *testing.T) {
+	l := NewLine([]string{"date", "c-ip"})
+	l.add("date", "2024-03-01")
+	l.add("c-ip", "10.0.0.1")
+	l.Set("derived", "x")
+
+	l.Clear("c-ip")
+	l.Clear("derived")
+	// clearing an unknown field does not add it
+	l.Clear("unknown")
+
+	if want := []string{"date", "c-ip", "derived"}; !reflect.DeepEqual(l.Names(), want) {
+		t.Errorf("names: got %v, want %v", l.Names(), want)
+	}
+	if !l.Has("c-ip") || l.Get("c-ip") != nil || l.Get("derived") != nil {
+		t.Error("the cleared fields must be kept, without a value")
+	}
+	if l.Has("unknown") {
+		t.Error("Clear added a field")
+	}
+	if _, ok := l.GetAll()["c-ip"]; ok {
+		t.Error("GetAll returns a cleared field")
+	}
+	if l.GetAsString("c-ip") != "" {
+		t.Errorf("got '%s', want an empty string", l.GetAsString("c-ip"))
+	}
+}
@@ -13,6 +13,8 @@ type Scanner struct {
 	buf     []byte
 	origbuf []byte
 	err     error
+	// read is the number of bytes read from reader.
+	read int64
 }
 
 // NewScanner constructs a Scanner.
@@ -108,9 +110,16 @@ func (s *Scanner) Scan() bool {
 			return false
 		}
 		s.buf = s.buf[:len(s.buf)+n]
+		s.read += int64(n)
 	}
 }
 
+// Offset returns the number of bytes of the input consumed by the lines
+// returned so far.
+func (s *Scanner) Offset() int64 {
+	return s.read - int64(len(s.buf))
+}
+
 // Strings returns the most recent fields generated by a call to Scan as a newly allocated string slice.
 func (s *Scanner) Strings() []string {
 	return s.strings
@@ -0,0 +1,113 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeRange selects log lines by time. Since is inclusive, Until is
+// exclusive. A zero bound means that the range is not bounded on that side.
+type TimeRange struct {
+	Since time.Time
+	Until time.Time
+}
+
+// IsZero returns true if the range is not bounded at all.
+func (r TimeRange) IsZero() bool {
+	return r.Since.IsZero() && r.Until.IsZero()
+}
+
+// Contains returns true if t belongs to the range. An unknown (zero) time only
+// belongs to an unbounded range.
+func (r TimeRange) Contains(t time.Time) bool {
+	if r.IsZero() {
+		return true
+	}
+	if t.IsZero() {
+		return false
+	}
+	if !r.Since.IsZero() && t.Before(r.Since) {
+		return false
+	}
+	if !r.Until.IsZero() && !t.Before(r.Until) {
+		return false
+	}
+	return true
+}
+
+// Overlaps returns true if some time between start and end, both inclusive,
+// belongs to the range.
+func (r TimeRange) Overlaps(start, end time.Time) bool {
+	if !r.Since.IsZero() && end.Before(r.Since) {
+		return false
+	}
+	if !r.Until.IsZero() && !start.Before(r.Until) {
+		return false
+	}
+	return true
+}
+
+var timeBoundLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// ParseTimeBound parses a range bound: an absolute time, like 2024-03-01 or
+// 2024-03-01T10:00:00Z, or a time relative to now, like -24h or -7d. The
+// absolute times without a time zone are read as UTC, like the W3C log times.
+func ParseTimeBound(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "now" {
+		return now, nil
+	}
+	for _, layout := range timeBoundLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+	if strings.HasPrefix(s, "-") {
+		d, err := parseDuration(s[1:])
+		if err == nil {
+			return now.Add(-d), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time: '%s' (expected a date, a timestamp or a relative time like -24h)", s)
+}
+
+// parseDuration is like time.ParseDuration, but also accepts a number of days
+// like 7d.
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// TimeSpan returns the times of the first and last lines of the file, as
+// given by the #Start-Date and #End-Date directives. ok is false if the
+// header does not have both directives.
+func (h *FileHeader) TimeSpan() (start, end time.Time, ok bool) {
+	startDate, hasStart := h.Meta["start-date"]
+	endDate, hasEnd := h.Meta["end-date"]
+	if !hasStart || !hasEnd {
+		return start, end, false
+	}
+	start, err := time.Parse("2006-01-02 15:04:05", startDate)
+	if err != nil {
+		return start, end, false
+	}
+	end, err = time.Parse("2006-01-02 15:04:05", endDate)
+	if err != nil {
+		return start, end, false
+	}
+	return start, end, true
+}
@@ -0,0 +1,178 @@
+package parser
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeBound(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		s    string
+		want time.Time
+	}{
+		{"2024-03-01", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{" 2024-03-01 ", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-03-01 10:20:30", time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC)},
+		{"2024-03-01T10:20:30", time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC)},
+		{"2024-03-01T10:20:30Z", time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC)},
+		{"2024-03-01T10:20:30.5Z", time.Date(2024, 3, 1, 10, 20, 30, 500000000, time.UTC)},
+		// the zones are converted to UTC
+		{"2024-03-01T10:20:30+02:00", time.Date(2024, 3, 1, 8, 20, 30, 0, time.UTC)},
+		{"2024-03-01T00:30:00-05:00", time.Date(2024, 3, 1, 5, 30, 0, 0, time.UTC)},
+		// relative times
+		{"now", now},
+		{"-24h", now.Add(-24 * time.Hour)},
+		{"-90m", now.Add(-90 * time.Minute)},
+		{"-7d", now.AddDate(0, 0, -7)},
+		{"-1.5d", now.Add(-36 * time.Hour)},
+		{"-0s", now},
+	}
+	for _, test := range tests {
+		got, err := ParseTimeBound(test.s, now)
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", test.s, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("'%s': got %s, want %s", test.s, got, test.want)
+		}
+		if got.Location() != time.UTC && test.s != "now" {
+			t.Errorf("'%s': got location %s, want UTC", test.s, got.Location())
+		}
+	}
+}
+
+func TestParseTimeBoundErrors(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	for _, s := range []string{"", "yesterday", "24h", "+24h", "-7x", "-d", "2024-13-01", "2024-03-01 25:00:00", "10/03/2024"} {
+		_, err := ParseTimeBound(s, now)
+		if err == nil {
+			t.Errorf("'%s': expected an error", s)
+		}
+	}
+}
+
+func TestTimeRangeContains(t *testing.T) {
+	since := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		r    TimeRange
+		t    time.Time
+		want bool
+	}{
+		// Since is inclusive, Until is exclusive
+		{TimeRange{Since: since, Until: until}, since, true},
+		{TimeRange{Since: since, Until: until}, since.Add(-time.Nanosecond), false},
+		{TimeRange{Since: since, Until: until}, until, false},
+		{TimeRange{Since: since, Until: until}, until.Add(-time.Nanosecond), true},
+		// the bounds are compared as instants, whatever the zone of t
+		{TimeRange{Since: since, Until: until}, until.In(time.FixedZone("CET", 3600)), false},
+		{TimeRange{Since: since, Until: until}, since.In(time.FixedZone("EST", -5*3600)), true},
+		// half bounded ranges
+		{TimeRange{Since: since}, until.AddDate(10, 0, 0), true},
+		{TimeRange{Since: since}, since.Add(-time.Second), false},
+		{TimeRange{Until: until}, since.AddDate(-10, 0, 0), true},
+		{TimeRange{Until: until}, until, false},
+		// an unknown time only belongs to an unbounded range
+		{TimeRange{}, time.Time{}, true},
+		{TimeRange{}, since, true},
+		{TimeRange{Since: since}, time.Time{}, false},
+		{TimeRange{Until: until}, time.Time{}, false},
+	}
+	for i, test := range tests {
+		if got := test.r.Contains(test.t); got != test.want {
+			t.Errorf("%d: %v contains %s: got %v, want %v", i, test.r, test.t, got, test.want)
+		}
+	}
+}
+
+func TestTimeRangeOverlaps(t *testing.T) {
+	r := TimeRange{
+		Since: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		Until: time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		start, end time.Time
+		want       bool
+	}{
+		{time.Date(2024, 2, 28, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 29, 23, 59, 59, 0, time.UTC), false},
+		{time.Date(2024, 2, 28, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 11, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 3, 1, 23, 59, 59, 0, time.UTC), time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC), false},
+	}
+	for i, test := range tests {
+		if got := r.Overlaps(test.start, test.end); got != test.want {
+			t.Errorf("%d: overlaps %s-%s: got %v, want %v", i, test.start, test.end, got, test.want)
+		}
+	}
+	if !(TimeRange{}).Overlaps(time.Time{}, time.Time{}) {
+		t.Error("an unbounded range should overlap everything")
+	}
+}
+
+func TestTimeSpan(t *testing.T) {
+	h := &FileHeader{Meta: map[string]string{"start-date": "2024-03-01 00:00:00", "end-date": "2024-03-01 23:59:59"}}
+	start, end, ok := h.TimeSpan()
+	if !ok {
+		t.Fatal("expected a time span")
+	}
+	if !start.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) || !end.Equal(time.Date(2024, 3, 1, 23, 59, 59, 0, time.UTC)) {
+		t.Errorf("got %s-%s", start, end)
+	}
+	for _, meta := range []map[string]string{
+		{},
+		{"start-date": "2024-03-01 00:00:00"},
+		{"start-date": "2024-03-01", "end-date": "2024-03-02"},
+	} {
+		if _, _, ok := (&FileHeader{Meta: meta}).TimeSpan(); ok {
+			t.Errorf("%v: expected no time span", meta)
+		}
+	}
+}
+
+func TestTimeRangeProcess(t *testing.T) {
+	r := TimeRange{
+		Since: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		Until: time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		date, time string
+		want       bool
+	}{
+		{"2024-03-01", "00:00:00", true},
+		{"2024-03-01", "23:59:59", true},
+		{"2024-03-02", "00:00:00", false},
+		{"2024-02-29", "23:59:59", false},
+		{"-", "-", false},
+	}
+	for _, test := range tests {
+		l := newTestLine(map[string]string{"date": test.date, "time": test.time})
+		keep, err := r.Process(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keep != test.want {
+			t.Errorf("%s %s: got %v, want %v", test.date, test.time, keep, test.want)
+		}
+	}
+}
+
+func TestGetTimeWrongTypes(t *testing.T) {
+	// the time fields may be replaced by strings, like pseudonyms
+	l := NewLine([]string{"date", "time", "gmttime"})
+	l.Set("date", "pseudonym")
+	l.Set("time", "pseudonym")
+	if got := l.GetTime(); !got.IsZero() {
+		t.Errorf("got %v", got)
+	}
+	if got := l.GetDate(); !got.IsZero() {
+		t.Errorf("got %v", got)
+	}
+	l.Set("gmttime", "pseudonym")
+	if got := l.GetTime(); !got.IsZero() {
+		t.Errorf("got %v", got)
+	}
+}
@@ -42,6 +42,8 @@ const (
 	MyIP
 	MyTimestamp
 	MyURI
+	MyGeoPoint
+	MyIPList
 )
 
 func GuessType(fieldName string) Kind {
@@ -64,6 +66,12 @@ func GuessType(fieldName string) Kind {
 		return Int64
 	case "gmttime", "localtime", "timestamp", "x-timestamp-unix", "x-timestamp-unix-utc":
 		return MyTimestamp
+	case RequestHeaders, ResponseHeaders, RequestCookies, RequestQuery:
+		return Map
+	case "cs(x-forwarded-for)", "x-forwarded-for":
+		return MyIPList
+	case ClientIP:
+		return MyIP
 	default:
 	}
 	if strings.IndexByte(fieldName, '(') != -1 {
@@ -209,6 +217,8 @@ func ConvertValue(fieldName string, value string) interface{} {
 			return time.Unix(i.(int64), 0).UTC()
 		}
 		return nil
+	case "cs(x-forwarded-for)", "x-forwarded-for":
+		return makeIPList(value)
 	default:
 	}
 	if strings.IndexByte(fieldName, '(') != -1 {
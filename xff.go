@@ -0,0 +1,131 @@
+package parser
+
+import (
+	"net"
+	"strings"
+)
+
+// ClientIP is the name of the field that stores the real client IP, derived
+// from c-ip and the X-Forwarded-For header.
+const ClientIP = "client.ip"
+
+// isForwardedFor returns true if the field carries an X-Forwarded-For header.
+func isForwardedFor(fieldName string) bool {
+	switch fieldName {
+	case "cs(x-forwarded-for)", "x-forwarded-for":
+		return true
+	default:
+		return false
+	}
+}
+
+// makeIPList parses a comma separated list of IPs, like the value of an
+// X-Forwarded-For header. The invalid elements are kept as nil IPs, so that
+// the list still has one element per hop.
+func makeIPList(s string) interface{} {
+	if ips := parseIPChain(s); ips != nil {
+		return ips
+	}
+	// necessary to return untyped nil
+	return nil
+}
+
+// exportIPList returns a list of IPs as it is exported, with null for the
+// invalid elements instead of an empty string.
+func exportIPList(ips []net.IP) interface{} {
+	for _, ip := range ips {
+		if ip == nil {
+			values := make([]interface{}, 0, len(ips))
+			for _, ip := range ips {
+				if ip == nil {
+					values = append(values, nil)
+				} else {
+					values = append(values, ip)
+				}
+			}
+			return values
+		}
+	}
+	return ips
+}
+
+// parseIPChain returns the IPs of a comma separated list, with nil for the
+// invalid elements.
+func parseIPChain(s string) []net.IP {
+	if s == "-" || s == "" {
+		return nil
+	}
+	var ips []net.IP
+	for _, elt := range strings.Split(s, ",") {
+		// IIS replaces the spaces with '+'
+		elt = strings.Trim(elt, " +\"")
+		ip := net.ParseIP(elt)
+		if ip == nil {
+			// the element may carry a port
+			if host, _, err := net.SplitHostPort(elt); err == nil {
+				ip = net.ParseIP(host)
+			}
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// SetTrustedProxies sets the networks of the trusted proxies, and enables the
+// derivation of the client.ip field. The client IP is the last IP of the
+// c-ip, X-Forwarded-For chain, read from the right, that does not belong to a
+// trusted proxy. A nil list disables the client.ip field.
+func (p *FileParser) SetTrustedProxies(networks []*net.IPNet) *FileParser {
+	p.trustedProxies = networks
+	return p
+}
+
+func (p *FileParser) trusted(ip net.IP) bool {
+	for _, network := range p.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedForField returns the name of the field that carries the
+// X-Forwarded-For header.
+func (p *FileParser) forwardedForField() string {
+	for _, name := range p.fieldNames {
+		if isForwardedFor(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// hasClientIP returns true if the parsed lines have the client.ip field.
+func (p *FileParser) hasClientIP() bool {
+	return p.trustedProxies != nil && (p.HasField("c-ip") || p.forwardedForField() != "")
+}
+
+// deriveClientIP sets the client.ip field of l. When the first untrusted hop
+// cannot be parsed, the client IP is unknown.
+func (p *FileParser) deriveClientIP(l *Line) {
+	var chain []net.IP
+	if name := p.forwardedForField(); name != "" {
+		chain, _ = l.fields[name].([]net.IP)
+	}
+	if ip, ok := l.fields["c-ip"].(net.IP); ok {
+		chain = append(chain[:len(chain):len(chain)], ip)
+	}
+	client := -1
+	for i := len(chain) - 1; i >= 0; i-- {
+		client = i
+		if chain[i] == nil || !p.trusted(chain[i]) {
+			break
+		}
+	}
+	// when every hop is trusted, the client is the first one
+	if client == -1 || chain[client] == nil {
+		l.Set(ClientIP, nil)
+		return
+	}
+	l.Set(ClientIP, chain[client])
+}
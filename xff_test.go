@@ -0,0 +1,119 @@
+package parser
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func ips(s ...string) []net.IP {
+	ret := make([]net.IP, 0, len(s))
+	for _, ip := range s {
+		ret = append(ret, net.ParseIP(ip))
+	}
+	return ret
+}
+
+func TestMakeIPList(t *testing.T) {
+	tests := []struct {
+		s    string
+		want interface{}
+	}{
+		{"-", nil},
+		{"", nil},
+		{"203.0.113.9", ips("203.0.113.9")},
+		// IIS replaces the spaces with '+'
+		{"203.0.113.9,+10.1.2.3", ips("203.0.113.9", "10.1.2.3")},
+		{"203.0.113.9, 2001:db8::1 ,10.1.2.3", ips("203.0.113.9", "2001:db8::1", "10.1.2.3")},
+		// ports are removed
+		{"203.0.113.9:4711,[2001:db8::1]:443", ips("203.0.113.9", "2001:db8::1")},
+		// the invalid elements are kept as nil IPs
+		{"unknown,10.1.2.3", []net.IP{nil, net.ParseIP("10.1.2.3")}},
+		{"10.1.2.3,,garbage", []net.IP{net.ParseIP("10.1.2.3"), nil, nil}},
+	}
+	for _, test := range tests {
+		got := makeIPList(test.s)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("'%s': got %#v, want %#v", test.s, got, test.want)
+		}
+	}
+	if kind := GuessType("cs(x-forwarded-for)"); kind != MyIPList {
+		t.Errorf("kind: got %v, want %v", kind, MyIPList)
+	}
+}
+
+func TestExportIPList(t *testing.T) {
+	l := NewLine([]string{"cs(x-forwarded-for)"})
+	l.Set("cs(x-forwarded-for)", []net.IP{nil, net.ParseIP("10.1.2.3")})
+	b, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"cs(x-forwarded-for)":[null,"10.1.2.3"]}`; string(b) != want {
+		t.Errorf("json: got %s, want %s", b, want)
+	}
+	if got, want := l.GetAsString("cs(x-forwarded-for)"), "-,10.1.2.3"; got != want {
+		t.Errorf("string: got '%s', want '%s'", got, want)
+	}
+	l.Set("cs(x-forwarded-for)", ips("203.0.113.9", "10.1.2.3"))
+	if got, ok := l.GetAll()["cs(x-forwarded-for)"].([]net.IP); !ok || len(got) != 2 {
+		t.Errorf("a valid list is exported as is: got %#v", l.GetAll()["cs(x-forwarded-for)"])
+	}
+}
+
+const xffTestLog = `#Fields: date time c-ip cs(x-forwarded-for)
+2024-03-01 00:00:01 10.0.0.5 203.0.113.9,+10.1.2.3
+2024-03-01 00:00:02 10.0.0.5 -
+2024-03-01 00:00:03 10.0.0.5 198.51.100.7,+203.0.113.9,+10.1.2.3
+2024-03-01 00:00:04 10.0.0.5 unknown,+10.1.2.3
+2024-03-01 00:00:05 10.0.0.5 203.0.113.9,+unknown,+10.1.2.3
+2024-03-01 00:00:06 198.51.100.7 203.0.113.9
+2024-03-01 00:00:07 10.0.0.5 10.1.2.4,+10.1.2.3
+`
+
+func TestDeriveClientIP(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{
+		net.ParseIP("203.0.113.9"),
+		// only the balancer
+		net.ParseIP("10.0.0.5"),
+		// the last untrusted hop, read from the right
+		net.ParseIP("203.0.113.9"),
+		// the first untrusted hop is invalid
+		nil,
+		nil,
+		// c-ip is not trusted
+		net.ParseIP("198.51.100.7"),
+		// every hop is trusted
+		net.ParseIP("10.1.2.4"),
+	}
+	p := NewFileParser(strings.NewReader(xffTestLog))
+	p.SetTrustedProxies([]*net.IPNet{trusted})
+	err = p.ParseHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		l, err := p.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l == nil {
+			if i != len(want) {
+				t.Errorf("got %d lines, want %d", i, len(want))
+			}
+			break
+		}
+		got := l.Get(ClientIP)
+		ip, _ := got.(net.IP)
+		wantIP, _ := want[i].(net.IP)
+		if (got == nil) != (want[i] == nil) || !ip.Equal(wantIP) {
+			t.Errorf("line %d: got %v, want %v", i+1, got, want[i])
+		}
+	}
+}